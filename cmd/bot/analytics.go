@@ -0,0 +1,49 @@
+package main
+
+import (
+	"emperror.dev/errors"
+	"flag"
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/analytics"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+func runAnalytics(logFile string, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("analytics", flag.ContinueOnError)
+	num := flags.Int("n", 20, "number of entries per report")
+	slow := flags.Duration("slow", 5*time.Second, "threshold for slow queries")
+	if err := flags.Parse(args); err != nil {
+		return errors.Wrap(err, "cannot parse analytics flags")
+	}
+	if logFile == "" {
+		return errors.New("no analytics log configured")
+	}
+	entries, err := analytics.ReadFile(logFile)
+	if err != nil {
+		return errors.Wrap(err, "cannot read analytics log")
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%d command invocations in %s\n\n", len(entries), logFile)
+
+	fmt.Fprintf(tw, "Top queries\n")
+	fmt.Fprintf(tw, "COUNT\tQUERY\n")
+	for _, qc := range analytics.TopQueries(entries, *num) {
+		fmt.Fprintf(tw, "%d\t%s\n", qc.Count, qc.Query)
+	}
+
+	fmt.Fprintf(tw, "\nZero result queries\n")
+	fmt.Fprintf(tw, "COUNT\tQUERY\n")
+	for _, qc := range analytics.ZeroResultQueries(entries, *num) {
+		fmt.Fprintf(tw, "%d\t%s\n", qc.Count, qc.Query)
+	}
+
+	fmt.Fprintf(tw, "\nSlow queries (>= %s)\n", *slow)
+	fmt.Fprintf(tw, "LATENCY\tTIME\tCOMMAND\tTYPE\tHITS\tQUERY\tERROR\n")
+	for _, entry := range analytics.SlowQueries(entries, *slow, *num) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", entry.Latency(), entry.Time.Format(time.RFC3339), entry.Command, entry.SearchType, entry.Total, entry.Query, entry.Error)
+	}
+	return errors.WithStack(tw.Flush())
+}
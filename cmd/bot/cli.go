@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/catalogue"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// cliChannel is the channel of all command line requests, so that /more and /similar refer to the previous search
+const cliChannel = "cli"
+
+// cliCommands are the commands available from the command line
+var cliCommands = []string{"search", "searchknn", "similar", "text", "more", "magic", "research", "summarize", "list"}
+
+type filterList []string
+
+func (f *filterList) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *filterList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// cliOutput prints the responses of the commands as text tables or json lines
+type cliOutput struct {
+	sync.Mutex
+	out    io.Writer
+	format string
+}
+
+type cliMessage struct {
+	Command string       `json:"command"`
+	Message string       `json:"message,omitempty"`
+	Cards   []*chat.Card `json:"cards,omitempty"`
+	Files   []string     `json:"files,omitempty"`
+}
+
+func (o *cliOutput) print(command, msg string, cards []*chat.Card, files []*chat.File) error {
+	o.Lock()
+	defer o.Unlock()
+	if o.format == "json" {
+		m := &cliMessage{Command: command, Message: msg, Cards: cards}
+		for _, file := range files {
+			m.Files = append(m.Files, file.Name)
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return errors.Wrap(err, "cannot marshal response")
+		}
+		_, err = fmt.Fprintln(o.out, string(data))
+		return err
+	}
+	if msg != "" {
+		fmt.Fprintln(o.out, msg)
+	}
+	tw := tabwriter.NewWriter(o.out, 0, 4, 2, ' ', 0)
+	for _, card := range cards {
+		fmt.Fprintf(tw, "%s\t%s\n", card.Title, card.URL)
+		if card.Description != "" {
+			fmt.Fprintf(tw, "\t%s\n", oneLine(card.Description))
+		}
+		for _, field := range card.Fields {
+			fmt.Fprintf(tw, "  %s\t%s\n", field.Name, oneLine(field.Value))
+		}
+		if card.Footer != nil && card.Footer.Text != "" {
+			fmt.Fprintf(tw, "\t%s\n", oneLine(card.Footer.Text))
+		}
+		fmt.Fprintln(tw)
+	}
+	for _, file := range files {
+		fmt.Fprintf(tw, "file\t%s\n", file.Name)
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Wrap(err, "cannot write response")
+	}
+	// text attachments replace long messages
+	for _, file := range files {
+		if !strings.HasPrefix(file.ContentType, "text/") {
+			continue
+		}
+		if _, err := io.Copy(o.out, file.Reader); err != nil {
+			return errors.Wrapf(err, "cannot write file %s", file.Name)
+		}
+		fmt.Fprintln(o.out)
+	}
+	return nil
+}
+
+func oneLine(text string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(text, "\n", " / ")), " ")
+}
+
+type cliRequest struct {
+	ctx     context.Context
+	name    string
+	options []*chat.Option
+	topic   string
+	output  *cliOutput
+}
+
+func (r *cliRequest) Context() context.Context      { return r.ctx }
+func (r *cliRequest) CommandName() string           { return r.name }
+func (r *cliRequest) Options() []*chat.Option       { return r.options }
+func (r *cliRequest) Channel() string               { return cliChannel }
+func (r *cliRequest) Guild() string                 { return "" }
+func (r *cliRequest) UserID() string                { return "cli" }
+func (r *cliRequest) UserName() string              { return "cli" }
+func (r *cliRequest) Roles() []string               { return nil }
+func (r *cliRequest) IsGuildAdmin() bool            { return true }
+func (r *cliRequest) ChannelTopic() (string, error) { return r.topic, nil }
+
+func (r *cliRequest) SendInteractionResponseMessage(msg string) error {
+	return r.output.print(r.name, msg, nil, nil)
+}
+
+func (r *cliRequest) SendInteractionResponseCards(cards []*chat.Card) error {
+	return r.output.print(r.name, "", cards, nil)
+}
+
+func (r *cliRequest) SendChannelMessage(msg string) error {
+	return r.output.print(r.name, msg, nil, nil)
+}
+
+func (r *cliRequest) SendChannelCards(cards []*chat.Card) error {
+	return r.output.print(r.name, "", cards, nil)
+}
+
+func (r *cliRequest) SendChannelCardsWithFiles(cards []*chat.Card, files []*chat.File) error {
+	return r.output.print(r.name, "", cards, files)
+}
+
+// runCLI executes a single catalogue command and waits until all its responses are printed
+func runCLI(ctx context.Context, cat *catalogue.Catalog, args []string, topic string, output *cliOutput) error {
+	if len(args) < 1 {
+		return errors.Errorf("usage: %s [name:value...]", strings.Join(cliCommands, "|"))
+	}
+	if !slices.Contains(cliCommands, args[0]) {
+		return errors.Errorf("unknown command %s, available: %s", args[0], strings.Join(cliCommands, ", "))
+	}
+	cmd := cat.Command(args[0])
+	if cmd == nil {
+		return errors.Errorf("command %s not found", args[0])
+	}
+	options, err := chat.ParseOptions(cmd.Definition, args[1:])
+	if err != nil {
+		return errors.Wrapf(err, "cannot parse options of %s", args[0])
+	}
+	cmd.Handler(&cliRequest{
+		ctx:     ctx,
+		name:    cmd.Definition.Name,
+		options: options,
+		topic:   topic,
+		output:  output,
+	})
+	return errors.Wrap(cat.Drain(ctx), "cannot wait for command")
+}
+
+func runRepl(ctx context.Context, cat *catalogue.Catalog, in io.Reader, topic string, output *cliOutput) error {
+	scanner := bufio.NewScanner(in)
+	prompt := func() {
+		if output.format != "json" {
+			fmt.Fprintf(output.out, "ub-bot> ")
+		}
+	}
+	prompt()
+	for scanner.Scan() {
+		args, err := chat.SplitArgs(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(output.out, "error: %v\n", err)
+			prompt()
+			continue
+		}
+		if len(args) > 0 {
+			if args[0] == "exit" || args[0] == "quit" {
+				return nil
+			}
+			if err := runCLI(ctx, cat, args, topic, output); err != nil {
+				fmt.Fprintf(output.out, "error: %v\n", err)
+			}
+		}
+		prompt()
+	}
+	return errors.Wrap(scanner.Err(), "cannot read input")
+}
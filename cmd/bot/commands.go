@@ -0,0 +1,39 @@
+package main
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/discord"
+	"io"
+	"strings"
+)
+
+func runCommands(session *discord.Session, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errors.New("usage: commands diff|sync|prune")
+	}
+	var diff *discord.CommandDiff
+	var err error
+	switch args[0] {
+	case "diff":
+		diff, _, err = session.DiffCommands()
+	case "sync":
+		diff, err = session.SyncCommands()
+	case "prune":
+		diff, err = session.PruneCommands()
+	default:
+		return errors.Errorf("unknown commands action %s", args[0])
+	}
+	if err != nil {
+		return errors.Wrapf(err, "cannot %s commands", args[0])
+	}
+	fmt.Fprintf(out, "added:     %s\n", strings.Join(diff.Added, ", "))
+	fmt.Fprintf(out, "changed:   %s\n", strings.Join(diff.Changed, ", "))
+	fmt.Fprintf(out, "unchanged: %s\n", strings.Join(diff.Unchanged, ", "))
+	if args[0] == "prune" {
+		fmt.Fprintf(out, "removed:   %s\n", strings.Join(diff.Stale, ", "))
+	} else {
+		fmt.Fprintf(out, "stale:     %s\n", strings.Join(diff.Stale, ", "))
+	}
+	return nil
+}
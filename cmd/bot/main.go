@@ -1,23 +1,39 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"emperror.dev/errors"
 	"flag"
 	"github.com/bwmarrin/discordgo"
 	"github.com/dgraph-io/badger/v4"
 	"github.com/elastic/elastic-transport-go/v8/elastictransport"
 	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/je4/ub-bot/v2/data"
+	"github.com/je4/ub-bot/v2/pkg/analytics"
 	"github.com/je4/ub-bot/v2/pkg/catalogue"
 	"github.com/je4/ub-bot/v2/pkg/discord"
+	"github.com/je4/ub-bot/v2/pkg/health"
+	"github.com/je4/ub-bot/v2/pkg/llm"
+	"github.com/je4/ub-bot/v2/pkg/matrix"
+	"github.com/je4/ub-bot/v2/pkg/metrics"
+	"github.com/je4/ub-bot/v2/pkg/permission"
+	"github.com/je4/ub-bot/v2/pkg/queue"
+	"github.com/je4/ub-bot/v2/pkg/templates"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
 	"github.com/je4/utils/v2/pkg/zLogger"
 	"github.com/rs/zerolog"
 	"go.elastic.co/apm/module/apmelasticsearch"
+	"go.opentelemetry.io/otel"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -29,13 +45,30 @@ var logLevel = flag.String("loglevel", "DEBUG", "log level")
 var elasticURL = flag.String("elastic", "http://localhost:9200", "Elasticsearch URL")
 var elasticIndex = flag.String("index", "", "Elasticsearch index")
 var devMode = flag.Bool("dev", false, "Development mode")
+var httpAddr = flag.String("http", "", "HTTP listen address for /metrics, /healthz and /readyz (empty to disable)")
+var shutdownTimeout = flag.Duration("shutdowntimeout", 30*time.Second, "maximum time to wait for in-flight searches on shutdown")
+var workers = flag.Int("workers", 4, "number of searches running concurrently over all channels")
+var queueSize = flag.Int("queuesize", 5, "maximum number of searches waiting per channel")
+var openaiConcurrency = flag.Int("openaiconcurrency", 4, "maximum number of concurrent OpenAI calls (0 for unlimited)")
+var elasticConcurrency = flag.Int("elasticconcurrency", 8, "maximum number of concurrent Elasticsearch queries (0 for unlimited)")
+var permissionFile = flag.String("permissions", "", "JSON file with role permissions per guild (empty allows all commands except admin commands)")
+var searchTimeout = flag.Duration("searchtimeout", 2*time.Minute, "maximum duration of a search including OpenAI calls (0 to disable)")
+var traceTarget = flag.String("trace", "", "trace exporter: stdout or file path (empty to disable)")
+var analyticsFile = flag.String("analytics", "./analytics.jsonl", "query analytics log (empty to disable)")
+var templateDir = flag.String("templates", "", "folder with the text templates of the records, changes are reloaded (empty for the built-in templates)")
+var cardTemplateDir = flag.String("cardtemplates", "", "folder with the result card templates card.gotmpl and compact.gotmpl, changes are reloaded (empty for the built-in templates)")
+var matrixHomeserver = flag.String("matrix", "", "matrix homeserver URL, the bot also answers !commands in matrix rooms (empty to disable)")
+var fakeLLM = flag.String("fakellm", "", "JSON file with scripted chat model answers for /research and /summarize, for deterministic runs without OpenAI (empty to use OpenAI)")
+var outputFormat = flag.String("format", "table", "output of repl and command line searches: table or json")
+var filters filterList
+
+func init() {
+	flag.Var(&filters, "filter", "filter field:pattern for repl and command line searches (repeatable)")
+}
 
 func main() {
 	flag.Parse()
 
-	openaiApiKey := os.Getenv("OPENAI_API_KEY")
-	elasticApiKey := os.Getenv("ELASTIC_API_KEY")
-
 	var out io.Writer = os.Stderr
 
 	output := zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339}
@@ -58,15 +91,53 @@ func main() {
 	}
 	var logger zLogger.ZLogger = &_logger
 
+	if err := run(logger); err != nil {
+		logger.Fatal().Msgf("%v", err)
+	}
+}
+
+// run starts the bot. errors are returned instead of exiting, so that the deferred cleanups run
+func run(logger zLogger.ZLogger) error {
+	openaiApiKey := os.Getenv("OPENAI_API_KEY")
+	elasticApiKey := os.Getenv("ELASTIC_API_KEY")
+
+	switch flag.Arg(0) {
+	case "analytics":
+		if err := runAnalytics(*analyticsFile, flag.Args()[1:], os.Stdout); err != nil {
+			return errors.Wrap(err, "cannot create analytics report")
+		}
+		return nil
+	}
+
 	if fi, err := os.Stat(*embeddingCacheFolder); err != nil {
-		logger.Fatal().Msgf("Cannot access folder %s: %v", *embeddingCacheFolder, err)
+		return errors.Wrapf(err, "cannot access folder %s", *embeddingCacheFolder)
 	} else if !fi.IsDir() {
-		logger.Fatal().Msgf("Path %s is not a directory", *embeddingCacheFolder)
+		return errors.Errorf("path %s is not a directory", *embeddingCacheFolder)
 	}
 
 	db, err := badger.Open(badger.DefaultOptions(*embeddingCacheFolder))
 	if err != nil {
-		logger.Fatal().Msgf("Cannot open badger db: %v", err)
+		return errors.Wrap(err, "cannot open badger db")
+	}
+	defer func() {
+		logger.Info().Msg("Closing badger db")
+		if err := db.Close(); err != nil {
+			logger.Error().Msgf("Cannot close badger db: %v", err)
+		}
+	}()
+
+	if *traceTarget != "" {
+		shutdown, err := tracing.Init(*traceTarget, "ub-bot")
+		if err != nil {
+			return errors.Wrap(err, "cannot initialize tracing")
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				logger.Error().Msgf("Cannot shutdown tracing: %v", err)
+			}
+		}()
 	}
 
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{
@@ -88,35 +159,197 @@ func main() {
 		//		Transport: doer,
 		Transport: apmelasticsearch.WrapRoundTripper(http.DefaultTransport),
 	}
+	if *traceTarget != "" {
+		elasticConfig.Instrumentation = elasticsearch.NewOpenTelemetryInstrumentation(otel.GetTracerProvider(), false)
+	}
 
 	elastic, err := elasticsearch.NewTypedClient(elasticConfig)
 	if err != nil {
-		logger.Fatal().Err(err)
+		return errors.Wrap(err, "cannot create elastic client")
+	}
+
+	var analyticsLog *analytics.Log
+	if *analyticsFile != "" {
+		analyticsLog, err = analytics.NewLog(*analyticsFile)
+		if err != nil {
+			return errors.Wrap(err, "cannot open analytics log")
+		}
+		defer analyticsLog.Close()
+	}
+
+	var m *metrics.Metrics
+	if *httpAddr != "" {
+		m = metrics.NewMetrics()
 	}
 
 	prefix := ""
 	if *devMode {
 		prefix = "dev-"
 	}
-	client := catalogue.NewCatalogue(elastic, *elasticIndex, db, openaiApiKey, prefix, logger)
+	perms, err := permission.NewPermissions(*permissionFile, prefix)
+	if err != nil {
+		return errors.Wrap(err, "cannot load permissions")
+	}
+	watchCtx, watchCancel := context.WithCancel(context.Background())
+	defer watchCancel()
+	tmplRegistry, err := loadTemplates(watchCtx, *templateDir, "templates", "prose", logger)
+	if err != nil {
+		return errors.Wrap(err, "cannot load templates")
+	}
+	cardRegistry, err := loadTemplates(watchCtx, *cardTemplateDir, "cards", "card", logger)
+	if err != nil {
+		return errors.Wrap(err, "cannot load card templates")
+	}
+
+	client := catalogue.NewCatalogue(elastic, *elasticIndex, db, openaiApiKey, prefix, perms, *searchTimeout, tmplRegistry, cardRegistry, queue.NewQueue(*workers, *queueSize), queue.NewLimiter(*openaiConcurrency), queue.NewLimiter(*elasticConcurrency), analyticsLog, m, logger)
+	if *fakeLLM != "" {
+		provider, err := llm.LoadFakeProvider(*fakeLLM)
+		if err != nil {
+			return errors.Wrap(err, "cannot load scripted chat model answers")
+		}
+		client.SetChatProvider(provider)
+	}
+
+	switch flag.Arg(0) {
+	case "repl", "search", "searchknn", "similar", "text", "more", "magic", "research", "summarize", "list":
+		if *outputFormat != "table" && *outputFormat != "json" {
+			return errors.Errorf("unknown output format %s", *outputFormat)
+		}
+		output := &cliOutput{out: os.Stdout, format: *outputFormat}
+		topic := strings.Join(filters, "\n")
+		if flag.Arg(0) == "repl" {
+			err = runRepl(context.Background(), client, os.Stdin, topic, output)
+		} else {
+			err = runCLI(context.Background(), client, flag.Args(), topic, output)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "cannot run %s", flag.Arg(0))
+		}
+		return nil
+	}
 
 	dSession, err := discord.NewSession(os.Getenv("DISCORD_TOKEN"), APP_ID, GUILD_ID, logger)
 	if err != nil {
-		panic(err)
+		return errors.Wrap(err, "cannot create discord session")
 	}
+	dSession.SetAuthorizer(perms)
+
+	if err := dSession.RegisterCommands(client.Commands()); err != nil {
+		return errors.Wrap(err, "cannot register commands")
+	}
+	if flag.Arg(0) == "commands" {
+		if err := runCommands(dSession, flag.Args()[1:], os.Stdout); err != nil {
+			return errors.Wrap(err, "cannot manage commands")
+		}
+		return nil
+	}
+	if _, err := dSession.SyncCommands(); err != nil {
+		return errors.Wrap(err, "cannot deploy commands")
+	}
+
+	var connects atomic.Int64
+	dSession.AddHandler(func(s *discordgo.Session, c *discordgo.Connect) {
+		if connects.Add(1) > 1 {
+			m.DiscordReconnect()
+		}
+	})
+
+	hc := health.NewHealth(5 * time.Second)
+	hc.AddCheck("badger", true, func(ctx context.Context) error {
+		if db.IsClosed() {
+			return errors.New("badger db closed")
+		}
+		return nil
+	})
+	hc.AddCheck("discord", false, dSession.Ready)
+	hc.AddCheck("elastic", false, client.Ping)
 
-	if err := client.InitCommands(dSession); err != nil {
-		panic(err)
+	var mClient *matrix.Client
+	matrixCtx, matrixCancel := context.WithCancel(context.Background())
+	defer matrixCancel()
+	if *matrixHomeserver != "" {
+		mClient = matrix.NewClient(*matrixHomeserver, os.Getenv("MATRIX_USER_ID"), os.Getenv("MATRIX_ACCESS_TOKEN"), client.Command, logger)
+		mClient.SetAuthorizer(perms)
+		hc.AddCheck("matrix", false, mClient.Ready)
+		go func() {
+			if err := mClient.Run(matrixCtx); err != nil {
+				logger.Error().Msgf("Matrix client stopped: %v", err)
+			}
+		}()
 	}
 
-	dSession.Open()
+	if *httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m.Handler())
+		mux.Handle("/healthz", hc.LivenessHandler())
+		mux.Handle("/readyz", hc.ReadinessHandler())
+		server := &http.Server{
+			Addr:    *httpAddr,
+			Handler: mux,
+		}
+		go func() {
+			logger.Info().Msgf("HTTP listening on %s", *httpAddr)
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error().Msgf("HTTP server stopped: %v", err)
+			}
+		}()
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Error().Msgf("Cannot shutdown HTTP server: %v", err)
+			}
+		}()
+	}
+
+	if err := dSession.Open(); err != nil {
+		return errors.Wrap(err, "cannot open discord session")
+	}
 	defer dSession.Close()
 
 	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
-	<-stop
-	log.Println("Graceful shutdown")
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	logger.Info().Msgf("Graceful shutdown on %v", sig)
 
+	hc.SetShuttingDown()
+	dSession.StopCommands()
+	if mClient != nil {
+		mClient.StopCommands()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := client.Drain(ctx); err != nil {
+		logger.Error().Msgf("Shutdown with unfinished searches: %v", err)
+	} else {
+		logger.Info().Msg("All in-flight searches finished")
+	}
+	return nil
+}
+
+// loadTemplates loads the templates from dir and reloads them on changes until ctx is cancelled.
+// if dir is empty, the built-in templates in data/<builtin> are used
+func loadTemplates(ctx context.Context, dir, builtin, defaultName string, logger zLogger.ZLogger) (*templates.Registry, error) {
+	var fsys fs.FS
+	if dir != "" {
+		fsys = os.DirFS(dir)
+	} else {
+		var err error
+		if fsys, err = fs.Sub(data.Templates, builtin); err != nil {
+			return nil, errors.Wrapf(err, "cannot open built-in templates %s", builtin)
+		}
+	}
+	registry, err := templates.NewRegistry(fsys, defaultName, logger)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if dir != "" {
+		if err := registry.Watch(ctx, dir); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	logger.Info().Msgf("Templates %s: %s", builtin, strings.Join(registry.Versions(), ", "))
+	return registry, nil
 }
 
 func newMessage(discord *discordgo.Session, message *discordgo.MessageCreate) {
@@ -1,6 +1,8 @@
 package data
 
-import _ "embed"
+import "embed"
 
-//go:embed embedding.gotmpl
-var TextTemplate string
+// Templates are the default text templates of the records and the result cards, see pkg/templates
+//
+//go:embed templates/*.gotmpl cards/*.gotmpl
+var Templates embed.FS
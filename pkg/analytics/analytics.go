@@ -0,0 +1,139 @@
+package analytics
+
+import (
+	"bufio"
+	"emperror.dev/errors"
+	"encoding/json"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+type Entry struct {
+	Time       time.Time         `json:"time"`
+	Command    string            `json:"command"`
+	Options    map[string]string `json:"options,omitempty"`
+	Filter     map[string]string `json:"filter,omitempty"`
+	SearchType string            `json:"searchType,omitempty"`
+	Query      string            `json:"query,omitempty"`
+	MagicQuery string            `json:"magicQuery,omitempty"`
+	Template   string            `json:"template,omitempty"`
+	Total      int64             `json:"total"`
+	LatencyMS  int64             `json:"latencyMs"`
+	Error      string            `json:"error,omitempty"`
+	Degraded   bool              `json:"degraded,omitempty"`
+	GuildID    string            `json:"guildId,omitempty"`
+	ChannelID  string            `json:"channelId,omitempty"`
+	UserID     string            `json:"userId,omitempty"`
+	UserName   string            `json:"userName,omitempty"`
+	TraceID    string            `json:"traceId,omitempty"`
+}
+
+// maxChannelHistory is the number of entries per channel kept in memory for the history
+const maxChannelHistory = 100
+
+func (e *Entry) Latency() time.Duration {
+	return time.Duration(e.LatencyMS) * time.Millisecond
+}
+
+// NewLog opens an append-only JSONL file for command invocations.
+// the last entries of each channel are read into memory for the history
+func NewLog(path string) (*Log, error) {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open analytics log %s", path)
+	}
+	l := &Log{
+		path:    path,
+		fp:      fp,
+		enc:     json.NewEncoder(fp),
+		history: map[string][]*Entry{},
+	}
+	entries, err := ReadFile(path)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	for _, entry := range entries {
+		l.addHistory(entry)
+	}
+	return l, nil
+}
+
+type Log struct {
+	sync.Mutex
+	path string
+	fp   *os.File
+	enc  *json.Encoder
+	// history holds the last maxChannelHistory entries per channel, oldest first
+	history map[string][]*Entry
+}
+
+func (l *Log) addHistory(entry *Entry) {
+	if entry.ChannelID == "" {
+		return
+	}
+	entries := append(l.history[entry.ChannelID], entry)
+	if len(entries) > maxChannelHistory {
+		entries = slices.Clone(entries[len(entries)-maxChannelHistory:])
+	}
+	l.history[entry.ChannelID] = entries
+}
+
+func (l *Log) Add(entry *Entry) error {
+	l.Lock()
+	defer l.Unlock()
+	l.addHistory(entry)
+	if err := l.enc.Encode(entry); err != nil {
+		return errors.Wrapf(err, "cannot write entry to analytics log %s", l.path)
+	}
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return errors.Wrapf(l.fp.Close(), "cannot close analytics log %s", l.path)
+}
+
+// ChannelHistory returns the last num entries of the channel, newest first
+func (l *Log) ChannelHistory(channelID string, num int, skipCommands ...string) ([]*Entry, error) {
+	l.Lock()
+	entries := l.history[channelID]
+	l.Unlock()
+	result := []*Entry{}
+	for i := len(entries) - 1; i >= 0 && len(result) < num; i-- {
+		entry := entries[i]
+		if !slices.Contains(skipCommands, entry.Command) {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+func ReadFile(path string) ([]*Entry, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open analytics log %s", path)
+	}
+	defer fp.Close()
+	entries := []*Entry{}
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		entry := &Entry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return nil, errors.Wrapf(err, "cannot unmarshal analytics entry '%s'", string(line))
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "cannot read analytics log %s", path)
+	}
+	return entries, nil
+}
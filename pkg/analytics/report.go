@@ -0,0 +1,72 @@
+package analytics
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+type QueryCount struct {
+	Query string
+	Count int
+}
+
+func isQuery(entry *Entry) bool {
+	return entry.Query != ""
+}
+
+func TopQueries(entries []*Entry, num int) []QueryCount {
+	counts := map[string]int{}
+	for _, entry := range entries {
+		if !isQuery(entry) {
+			continue
+		}
+		counts[strings.ToLower(strings.TrimSpace(entry.Query))]++
+	}
+	return sortCounts(counts, num)
+}
+
+func ZeroResultQueries(entries []*Entry, num int) []QueryCount {
+	counts := map[string]int{}
+	for _, entry := range entries {
+		if !isQuery(entry) || entry.Error != "" || entry.Total > 0 {
+			continue
+		}
+		counts[strings.ToLower(strings.TrimSpace(entry.Query))]++
+	}
+	return sortCounts(counts, num)
+}
+
+// SlowQueries returns the slowest invocations above the threshold, slowest first
+func SlowQueries(entries []*Entry, threshold time.Duration, num int) []*Entry {
+	result := []*Entry{}
+	for _, entry := range entries {
+		if entry.Latency() >= threshold {
+			result = append(result, entry)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].LatencyMS > result[j].LatencyMS
+	})
+	if len(result) > num {
+		result = result[:num]
+	}
+	return result
+}
+
+func sortCounts(counts map[string]int, num int) []QueryCount {
+	result := []QueryCount{}
+	for query, count := range counts {
+		result = append(result, QueryCount{Query: query, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count == result[j].Count {
+			return result[i].Query < result[j].Query
+		}
+		return result[i].Count > result[j].Count
+	})
+	if len(result) > num {
+		result = result[:num]
+	}
+	return result
+}
@@ -0,0 +1,250 @@
+package catalogue
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"github.com/je4/ubcat/v2/pkg/index"
+	"github.com/je4/ubcat/v2/pkg/schema"
+	"strings"
+	"time"
+)
+
+// embeddingCachePrefix is the key prefix of the embedding cache entries of llm.Client
+const embeddingCachePrefix = "embedding-"
+
+func (cat *Catalog) CacheStats() (num int, size int64, err error) {
+	err = cat.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(embeddingCachePrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			num++
+			size += it.Item().EstimatedSize()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "cannot iterate embedding cache")
+	}
+	return num, size, nil
+}
+
+func (cat *Catalog) ClearCache() error {
+	return errors.Wrap(cat.db.DropPrefix([]byte(embeddingCachePrefix)), "cannot clear embedding cache")
+}
+
+func (cat *Catalog) RawSearch(ctx context.Context, body string) (result *index.Result, resultErr error) {
+	ctx, span := tracing.Start(ctx, "elastic.RawSearch")
+	defer func() { tracing.End(span, resultErr) }()
+	if !json.Valid([]byte(body)) {
+		return nil, errors.New("query is not valid JSON")
+	}
+	if err := cat.elasticLimit.Acquire(ctx); err != nil {
+		return nil, errors.Wrap(err, "cannot query elastic")
+	}
+	start := time.Now()
+	res, err := cat.elastic.Search().
+		Index(cat.elasticIndex).
+		Raw(strings.NewReader(body)).
+		Do(ctx)
+	cat.elasticLimit.Release()
+	if err != nil {
+		cat.metrics.ObserveElastic("rawsearch", err, 0, time.Since(start))
+		return nil, errors.Wrap(err, "cannot search")
+	}
+	result, err = responseResult(res)
+	if err != nil {
+		return nil, err
+	}
+	cat.metrics.ObserveElastic("rawsearch", nil, result.Total, time.Since(start))
+	return result, nil
+}
+
+func (cat *Catalog) CommandCache() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "cache",
+		Description: "show or clear the embedding cache (admin)",
+		Options: []*chat.OptionDefinition{
+			{
+				Type: chat.OptionString,
+				Choices: []*chat.OptionChoice{
+					{
+						Name:  "Statistics",
+						Value: "stats",
+					},
+					{
+						Name:  "Clear",
+						Value: "clear",
+					},
+				},
+				Name:        "action",
+				Description: "Cache action",
+				Required:    true,
+			},
+		},
+	}
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		defer cat.endCommand(ctx, entry)
+		if len(i.Options()) < 1 {
+			if err := i.SendInteractionResponseMessage("Please provide action"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		var msg string
+		switch i.Options()[0].StringValue() {
+		case "stats":
+			num, size, err := cat.CacheStats()
+			if err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error reading cache: %v", err)
+				msg = fmt.Sprintf("Error reading cache: %v%s", err, tracing.ErrorSuffix(ctx))
+				break
+			}
+			msg = fmt.Sprintf("Embedding cache: %d entries, %.1f MB", num, float64(size)/1024/1024)
+		case "clear":
+			if err := cat.ClearCache(); err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error clearing cache: %v", err)
+				msg = fmt.Sprintf("Error clearing cache: %v%s", err, tracing.ErrorSuffix(ctx))
+				break
+			}
+			logger.Info().Msgf("embedding cache cleared by %s", i.UserID())
+			msg = "Embedding cache cleared"
+		default:
+			msg = fmt.Sprintf("Unknown action %s", i.Options()[0].StringValue())
+		}
+		if err := i.SendInteractionResponseMessage(msg); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+	}
+	return
+}
+
+func (cat *Catalog) CommandReload() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "reload",
+		Description: "reload the configuration (admin)",
+		Options:     []*chat.OptionDefinition{},
+	}
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		defer cat.endCommand(ctx, entry)
+		if err := cat.permissions.Reload(); err != nil {
+			entry.Error = err.Error()
+			logger.Error().Msgf("Error reloading permissions: %v", err)
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error reloading permissions: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		if err := cat.templates.Load(); err != nil {
+			entry.Error = err.Error()
+			logger.Error().Msgf("Error reloading templates: %v", err)
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error reloading templates: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		if err := cat.cards.Load(); err != nil {
+			entry.Error = err.Error()
+			logger.Error().Msgf("Error reloading card templates: %v", err)
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error reloading card templates: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		logger.Info().Msgf("configuration reloaded by %s", i.UserID())
+		if err := i.SendInteractionResponseMessage(fmt.Sprintf("Configuration reloaded, templates: %s, cards: %s", strings.Join(cat.templates.Versions(), ", "), strings.Join(cat.cards.Versions(), ", "))); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+	}
+	return
+}
+
+func (cat *Catalog) CommandRawQuery() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "rawquery",
+		Description: "run a raw elasticsearch query (admin)",
+		Options: []*chat.OptionDefinition{
+			{
+				Type:        chat.OptionString,
+				Name:        "query",
+				Description: "Elasticsearch search request body as JSON",
+				Required:    true,
+			},
+		},
+	}
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		async := false
+		defer func() {
+			if !async {
+				cat.endCommand(ctx, entry)
+			}
+		}()
+		if len(i.Options()) < 1 {
+			if err := i.SendInteractionResponseMessage("Please provide query"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		query := i.Options()[0].StringValue()
+		entry.Query = query
+		if err := i.SendInteractionResponseMessage(fmt.Sprintf("Running raw query: `%s`", query)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+		async = cat.enqueue(ctx, i, entry, func() {
+			defer cat.endCommand(ctx, entry)
+			ctx, release := cat.searchContext(ctx, i.Channel())
+			defer release()
+
+			result, err := cat.RawSearch(ctx, query)
+			if err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error searching: %v", err)
+				if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error searching", err)); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			entry.Total = result.Total
+
+			embeds, err := cat.storeResults(i.Channel(), resultDocs(result, nil), result.Total, func(stat *channelStatus) {
+				stat.result = []*schema.UBSchema{}
+				stat.lastQuery = query
+				stat.lastSearchType = SearchTypeSimple
+				stat.lastVector = nil
+				stat.lastStructured = nil
+				stat.lastMatch = nil
+				stat.searchFunc = appCmd.Name
+			})
+			if err != nil {
+				logger.Error().Msgf("Error creating response: %v", err)
+				if err := i.SendChannelMessage(fmt.Sprintf("Error creating response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			if err := i.SendChannelCards(embeds); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+				if err := i.SendChannelMessage(fmt.Sprintf("Error sending response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+		})
+	}
+	return
+}
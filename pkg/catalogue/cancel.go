@@ -0,0 +1,98 @@
+package catalogue
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/llm"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"sync"
+)
+
+type runningSearches struct {
+	sync.Mutex
+	nextID  uint64
+	cancels map[string]map[uint64]context.CancelFunc
+}
+
+// searchContext derives the context of a search pipeline from the command context.
+// the search is aborted by /cancel or after the configured timeout. release must be called when the search is done
+func (cat *Catalog) searchContext(ctx context.Context, channelID string) (searchCtx context.Context, release func()) {
+	var cancel context.CancelFunc
+	if cat.searchTimeout > 0 {
+		searchCtx, cancel = context.WithTimeout(ctx, cat.searchTimeout)
+	} else {
+		searchCtx, cancel = context.WithCancel(ctx)
+	}
+	cat.running.Lock()
+	defer cat.running.Unlock()
+	if cat.running.cancels == nil {
+		cat.running.cancels = map[string]map[uint64]context.CancelFunc{}
+	}
+	if _, ok := cat.running.cancels[channelID]; !ok {
+		cat.running.cancels[channelID] = map[uint64]context.CancelFunc{}
+	}
+	id := cat.running.nextID
+	cat.running.nextID++
+	cat.running.cancels[channelID][id] = cancel
+	return searchCtx, func() {
+		cancel()
+		cat.running.Lock()
+		defer cat.running.Unlock()
+		delete(cat.running.cancels[channelID], id)
+		if len(cat.running.cancels[channelID]) == 0 {
+			delete(cat.running.cancels, channelID)
+		}
+	}
+}
+
+func (cat *Catalog) CancelSearches(channelID string) int {
+	cat.running.Lock()
+	defer cat.running.Unlock()
+	cancels := cat.running.cancels[channelID]
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return len(cancels)
+}
+
+// searchErrorMessage creates the user message for a failed search stage.
+// cancelled and timed out searches get a dedicated message
+func (cat *Catalog) searchErrorMessage(ctx context.Context, msg string, err error) string {
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		return "Search cancelled"
+	case errors.Is(err, llm.ErrCircuitOpen):
+		return "OpenAI is currently unavailable, please try again later"
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Sprintf("Search timed out after %v%s", cat.searchTimeout, tracing.ErrorSuffix(ctx))
+	default:
+		return fmt.Sprintf("%s: %v%s", msg, err, tracing.ErrorSuffix(ctx))
+	}
+}
+
+func (cat *Catalog) CommandCancel() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "cancel",
+		Description: "cancel the running search of this channel",
+		Options:     []*chat.OptionDefinition{},
+	}
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		defer cat.endCommand(ctx, entry)
+
+		dropped := cat.queue.Drop(i.Channel())
+		num := cat.CancelSearches(i.Channel())
+		logger.Info().Msgf("%d searches cancelled and %d removed from queue in channel %s", num, dropped, i.Channel())
+		msg := "No search running"
+		if num > 0 || dropped > 0 {
+			msg = fmt.Sprintf("Cancelled %d running and %d queued search(es)", num, dropped)
+		}
+		if err := i.SendInteractionResponseMessage(msg); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+	}
+	return
+}
@@ -0,0 +1,218 @@
+package catalogue
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"github.com/je4/ubcat/v2/pkg/schema"
+	"strings"
+)
+
+const compactResultsPerCard = 10
+
+type resourceStyle struct {
+	color int
+	icon  string
+}
+
+// resourceStyles maps the resource type of a record to the colour and icon of its card
+var resourceStyles = map[string]resourceStyle{
+	"Book, Monograph":            {color: 0x2e86c1, icon: "📘"},
+	"Journal, Serial":            {color: 0x17a589, icon: "📰"},
+	"Article":                    {color: 0x48c9b0, icon: "📄"},
+	"Manuscript":                 {color: 0x935116, icon: "📜"},
+	"Manuscript Book, Monograph": {color: 0x935116, icon: "📜"},
+	"Manuscript Journal, Serial": {color: 0x935116, icon: "📜"},
+	"Manuscript map":             {color: 0x935116, icon: "🗺️"},
+	"Manuscript sheet music":     {color: 0x935116, icon: "🎼"},
+	"Archive material":           {color: 0x7d6608, icon: "🗃️"},
+	"Collection of documents":    {color: 0x7d6608, icon: "🗂️"},
+	"Map":                        {color: 0x28b463, icon: "🗺️"},
+	"Sheet music":                {color: 0x8e44ad, icon: "🎼"},
+	"Music recording":            {color: 0x8e44ad, icon: "🎵"},
+	"Text recording":             {color: 0xaf7ac5, icon: "🎙️"},
+	"Film":                       {color: 0xc0392b, icon: "🎞️"},
+	"Image":                      {color: 0xe67e22, icon: "🖼️"},
+	"Computer file":              {color: 0x566573, icon: "💾"},
+	"Kit":                        {color: 0x566573, icon: "🧰"},
+	"Object":                     {color: 0x566573, icon: "🏺"},
+	"Language material":          {color: 0x2e86c1, icon: "📘"},
+}
+
+var defaultResourceStyle = resourceStyle{color: 0x99a3a4, icon: "📦"}
+
+type cardData struct {
+	Num      int
+	Score    float64
+	ID       string
+	URL      string
+	Title    string
+	Type     string
+	Icon     string
+	Language string
+	Subjects []string
+	// Persons maps the role to the names of the persons
+	Persons map[string]string
+	Doc     *schema.UBSchema
+	color   int
+}
+
+func newCardData(num int, doc *schema.UBSchema, urlStr string) *cardData {
+	data := &cardData{
+		Num:     num,
+		Score:   doc.Score_,
+		ID:      doc.Id_,
+		URL:     urlStr,
+		Title:   doc.GetMainTitle(),
+		Type:    doc.GetResourceType(),
+		Persons: map[string]string{},
+		Doc:     doc,
+	}
+	style, ok := resourceStyles[data.Type]
+	if !ok {
+		style = defaultResourceStyle
+	}
+	data.Icon = style.icon
+	data.color = style.color
+	if doc.Mapping != nil {
+		data.Language = strings.Join(doc.Mapping.Language, ", ")
+	}
+	for _, topic := range doc.GetSubjectTopics() {
+		data.Subjects = append(data.Subjects, topic.Name)
+	}
+	for _, place := range doc.GetSubjectGeographics() {
+		data.Subjects = append(data.Subjects, place.Name)
+	}
+	for role, persons := range doc.GetPersons() {
+		ps := []string{}
+		for _, p := range persons {
+			if p.Date != "" {
+				ps = append(ps, fmt.Sprintf("%s (%s)", p.Name, p.Date))
+			} else {
+				ps = append(ps, p.Name)
+			}
+		}
+		data.Persons[role] = strings.Join(ps, "; ")
+	}
+	return data
+}
+
+// resultCard renders the card of a single result with the card template.
+// lines of the form "Label: value" become fields, all other lines the description
+func (cat *Catalog) resultCard(data *cardData) (*chat.Card, error) {
+	tmpl, err := cat.cards.Get("card")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	text, err := tmpl.Execute(data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	card := &chat.Card{
+		Author: &chat.CardAuthor{
+			Name: fmt.Sprintf("%s %d - %f - %s", data.Icon, data.Num, data.Score, data.ID),
+		},
+		Title:  data.Title,
+		URL:    data.URL,
+		Color:  data.color,
+		Fields: []*chat.CardField{},
+	}
+	description := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if name, value, found := strings.Cut(line, ": "); found && strings.TrimSpace(value) != "" {
+			card.Fields = append(card.Fields, &chat.CardField{
+				Name:  name,
+				Value: strings.TrimSpace(value),
+			})
+			continue
+		}
+		description = append(description, line)
+	}
+	card.Description = strings.Join(description, "\n")
+	if data.URL != "" {
+		card.Buttons = append(card.Buttons, &chat.Button{
+			Label: "Swisscovery",
+			URL:   data.URL,
+		})
+	}
+	return card, nil
+}
+
+func (cat *Catalog) compactCards(results []*cardData) ([]*chat.Card, error) {
+	tmpl, err := cat.cards.Get("compact")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cards := []*chat.Card{}
+	for start := 0; start < len(results); start += compactResultsPerCard {
+		end := min(start+compactResultsPerCard, len(results))
+		lines := []string{}
+		for _, data := range results[start:end] {
+			line, err := tmpl.Execute(data)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			lines = append(lines, strings.TrimSpace(line))
+		}
+		cards = append(cards, &chat.Card{
+			Title:       fmt.Sprintf("Results %d - %d", results[start].Num, results[end-1].Num),
+			Description: strings.Join(lines, "\n"),
+		})
+	}
+	return cards, nil
+}
+
+func (cat *Catalog) CommandLayout() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "layout",
+		Description: "layout of the search results in this channel",
+		Options: []*chat.OptionDefinition{
+			{
+				Type:        chat.OptionString,
+				Name:        "mode",
+				Description: "one card per result or a compact list",
+				Required:    true,
+				Choices: []*chat.OptionChoice{
+					{
+						Name:  "cards",
+						Value: "cards",
+					},
+					{
+						Name:  "compact",
+						Value: "compact",
+					},
+				},
+			},
+		},
+	}
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		defer cat.endCommand(ctx, entry)
+		var mode string
+		for _, opt := range i.Options() {
+			switch opt.Name {
+			case "mode":
+				mode = opt.StringValue()
+			}
+		}
+		if mode != "cards" && mode != "compact" {
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Unknown layout %s", mode)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		cat.status.Update(i.Channel(), func(stat *channelStatus) {
+			stat.config.compact = mode == "compact"
+		})
+		if err := i.SendInteractionResponseMessage(fmt.Sprintf("Layout set to %s", mode)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+	}
+	return
+}
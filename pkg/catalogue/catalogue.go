@@ -2,26 +2,33 @@ package catalogue
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"emperror.dev/errors"
 	"fmt"
-	"github.com/bwmarrin/discordgo"
 	"github.com/dgraph-io/badger/v4"
 	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/je4/ub-bot/v2/data"
-	"github.com/je4/ub-bot/v2/pkg/discord"
+	"github.com/je4/ub-bot/v2/pkg/analytics"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/llm"
+	"github.com/je4/ub-bot/v2/pkg/metrics"
+	"github.com/je4/ub-bot/v2/pkg/permission"
+	"github.com/je4/ub-bot/v2/pkg/queue"
+	"github.com/je4/ub-bot/v2/pkg/templates"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
 	"github.com/je4/ubcat/v2/pkg/index"
 	"github.com/je4/ubcat/v2/pkg/schema"
 	"github.com/je4/utils/v2/pkg/openai"
 	"github.com/je4/utils/v2/pkg/zLogger"
 	oai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
 	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
-	"text/template"
+	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -33,33 +40,65 @@ const (
 const (
 	defaultResultSize = 9
 	maxResultSize     = 100
+	// maxMessageLength is the maximum number of characters of a discord message
+	maxMessageLength = 2000
 )
 
 type SearchType int
 
-func NewCatalogue(elastic *elasticsearch.TypedClient, elasticIndex string, badgerDB *badger.DB, openaiApiKey string, prefix string, logger zLogger.ZLogger) *Catalog {
-	kvBadger := openai.NewKVBadger(badgerDB)
-	client := openai.NewClientV2(openaiApiKey, kvBadger, logger)
+func NewCatalogue(elastic *elasticsearch.TypedClient, elasticIndex string, badgerDB *badger.DB, openaiApiKey string, prefix string, perms *permission.Permissions, searchTimeout time.Duration, tmplRegistry, cardRegistry *templates.Registry, q *queue.Queue, openaiLimit, elasticLimit *queue.Limiter, analyticsLog *analytics.Log, m *metrics.Metrics, logger zLogger.ZLogger) *Catalog {
+	kvBadger := &kvMetrics{
+		KVStore: openai.NewKVBadger(badgerDB),
+		metrics: m,
+	}
+	client := llm.NewClient(openaiApiKey, kvBadger, openaiLimit, logger)
 	cat := &Catalog{
-		ubClient:     index.NewClient(elasticIndex, elastic),
-		client:       client,
-		logger:       logger,
-		status:       cStatus{},
-		prefix:       prefix,
-		tmpl:         template.Must(template.New("embedding.gotmpl").Parse(data.TextTemplate)),
-		channelMutex: map[string]*sync.Mutex{},
+		elastic:       elastic,
+		elasticIndex:  elasticIndex,
+		ubClient:      index.NewClient(elasticIndex, elastic),
+		client:        client,
+		chatModel:     client,
+		logger:        logger,
+		status:        newStatusStore(maxChannelStates, channelStateTTL),
+		prefix:        prefix,
+		templates:     tmplRegistry,
+		cards:         cardRegistry,
+		analytics:     analyticsLog,
+		metrics:       m,
+		searchTimeout: searchTimeout,
+		db:            badgerDB,
+		permissions:   perms,
+		queue:         q,
+		elasticLimit:  elasticLimit,
 	}
+	cat.commands = cat.declareCommands()
+	m.ActiveChannels(func() float64 {
+		return float64(cat.status.Len())
+	})
 	return cat
 }
 
 type Catalog struct {
-	ubClient     *index.Client
-	client       *openai.ClientV2
-	logger       zLogger.ZLogger
-	status       cStatus
-	prefix       string
-	tmpl         *template.Template
-	channelMutex map[string]*sync.Mutex
+	elastic       *elasticsearch.TypedClient
+	elasticIndex  string
+	ubClient      *index.Client
+	client        *llm.Client
+	chatModel     llm.ChatProvider
+	logger        zLogger.ZLogger
+	status        *statusStore
+	prefix        string
+	templates     *templates.Registry
+	cards         *templates.Registry
+	analytics     *analytics.Log
+	metrics       *metrics.Metrics
+	inFlight      sync.WaitGroup
+	searchTimeout time.Duration
+	running       runningSearches
+	queue         *queue.Queue
+	elasticLimit  *queue.Limiter
+	db            *badger.DB
+	permissions   *permission.Permissions
+	commands      []*chat.Command
 }
 
 var channelFilter = regexp.MustCompile(`^filter-([^-]+)-(.+)$`)
@@ -91,29 +130,10 @@ func FilterFromChannelTopic(topic string) map[string]string {
 	return filter
 }
 
-func (cat *Catalog) tryLock(channelID string) bool {
-	if _, ok := cat.channelMutex[channelID]; !ok {
-		cat.channelMutex[channelID] = &sync.Mutex{}
-	}
-	return cat.channelMutex[channelID].TryLock()
-}
-
-func (cat *Catalog) lock(channelID string) {
-	if _, ok := cat.channelMutex[channelID]; !ok {
-		cat.channelMutex[channelID] = &sync.Mutex{}
-	}
-	cat.channelMutex[channelID].Lock()
-}
-
-func (cat *Catalog) unlock(channelID string) {
-	if _, ok := cat.channelMutex[channelID]; !ok {
-		return
-	}
-	cat.channelMutex[channelID].Unlock()
-}
-
-func (cat *Catalog) GetEmbedding(queryString string) (embedding []float32, resultErr error) {
-	e, err := cat.client.CreateEmbedding(queryString, oai.SmallEmbedding3)
+func (cat *Catalog) GetEmbedding(ctx context.Context, queryString string) (embedding []float32, resultErr error) {
+	start := time.Now()
+	e, err := cat.client.CreateEmbedding(ctx, queryString, oai.SmallEmbedding3)
+	cat.metrics.ObserveOpenAI("embedding", err, time.Since(start))
 	if err != nil {
 		resultErr = err
 		return
@@ -122,19 +142,37 @@ func (cat *Catalog) GetEmbedding(queryString string) (embedding []float32, resul
 	return
 }
 
-func (cat *Catalog) Query2Embedding(queryString string) (string, error) {
-	result, err := cat.client.Query2EmbeddingQuery(queryString)
+func (cat *Catalog) Query2Embedding(ctx context.Context, queryString string) (string, error) {
+	start := time.Now()
+	result, err := cat.client.Query2EmbeddingQuery(ctx, queryString)
+	cat.metrics.ObserveOpenAI("query2embedding", err, time.Since(start))
 	if err != nil {
 		return "", errors.Wrap(err, "cannot create embedding query")
 	}
 	return result, nil
 }
 
-func (cat *Catalog) GetDocuments(identifier ...string) (map[string]*schema.UBSchema, error) {
-	return cat.ubClient.GetDocuments(context.Background(), identifier...)
+func (cat *Catalog) GetDocuments(ctx context.Context, identifier ...string) (result map[string]*schema.UBSchema, resultErr error) {
+	ctx, span := tracing.Start(ctx, "elastic.GetDocuments")
+	defer func() { tracing.End(span, resultErr) }()
+	if err := cat.elasticLimit.Acquire(ctx); err != nil {
+		return nil, errors.Wrap(err, "cannot query elastic")
+	}
+	start := time.Now()
+	docs, err := cat.ubClient.GetDocuments(ctx, identifier...)
+	cat.elasticLimit.Release()
+	cat.metrics.ObserveElastic("getdocuments", err, int64(len(docs)), time.Since(start))
+	return docs, err
 }
 
-func (cat *Catalog) Search(queryString string, filter map[string]string, embedding []float32, searchType SearchType, from, num int64) (*index.Result, error) {
+func (cat *Catalog) Search(ctx context.Context, queryString string, filter map[string]string, embedding []float32, searchType SearchType, from, num int64) (result *index.Result, resultErr error) {
+	ctx, span := tracing.Start(ctx, "elastic.Search")
+	span.SetAttributes(
+		attribute.String("search.type", searchTypeName(searchType)),
+		attribute.Int64("search.from", from),
+		attribute.Int64("search.num", num),
+	)
+	defer func() { tracing.End(span, resultErr) }()
 	var vectorMarc, vectorProse, vectorJSON []float32
 	if searchType != SearchTypeSimple {
 		if embedding == nil {
@@ -151,77 +189,115 @@ func (cat *Catalog) Search(queryString string, filter map[string]string, embeddi
 			return nil, errors.Errorf("unknown search type %v", searchType)
 		}
 	}
-	res, err := cat.ubClient.Search(context.Background(), queryString, filter, vectorMarc, vectorJSON, vectorProse, from, num)
+	if err := cat.elasticLimit.Acquire(ctx); err != nil {
+		return nil, errors.Wrap(err, "cannot query elastic")
+	}
+	start := time.Now()
+	res, err := cat.ubClient.Search(ctx, queryString, filter, vectorMarc, vectorJSON, vectorProse, from, num)
+	cat.elasticLimit.Release()
 	if err != nil {
+		cat.metrics.ObserveElastic("search", err, 0, time.Since(start))
 		return nil, errors.Wrap(err, "cannot search")
 	}
+	cat.metrics.ObserveElastic("search", nil, res.Total, time.Since(start))
+	span.SetAttributes(attribute.Int64("search.total", res.Total))
 	return res, nil
 }
-func (cat *Catalog) SearchKNN(filter map[string]string, embedding []float32, searchType SearchType, k int64, numCandidates int64) (*index.Result, error) {
-	var field string
+func (cat *Catalog) SearchKNN(ctx context.Context, filter map[string]string, embedding []float32, searchType SearchType, k int64, numCandidates int64) (result *index.Result, resultErr error) {
+	ctx, span := tracing.Start(ctx, "elastic.SearchKNN")
+	span.SetAttributes(
+		attribute.String("search.type", searchTypeName(searchType)),
+		attribute.Int64("search.k", k),
+	)
+	defer func() { tracing.End(span, resultErr) }()
 	if embedding == nil {
 		return nil, errors.Errorf("embedding is nil")
 	}
-	switch searchType {
-	case SearchTypeEmbeddingMARC:
-		field = "embedding_marc"
-	case SearchTypeEmbeddingProse:
-		field = "embedding_prose"
-	case SearchTypeEmbeddingJSON:
-		field = "embedding_json"
-	default:
-		return nil, errors.Errorf("unknown search type %v", searchType)
+	field, err := vectorField(searchType)
+	if err != nil {
+		return nil, err
 	}
-	res, err := cat.ubClient.SearchKNN(context.Background(), filter, embedding, field, k, numCandidates)
+	if err := cat.elasticLimit.Acquire(ctx); err != nil {
+		return nil, errors.Wrap(err, "cannot query elastic")
+	}
+	start := time.Now()
+	res, err := cat.ubClient.SearchKNN(ctx, filter, embedding, field, k, numCandidates)
+	cat.elasticLimit.Release()
 	if err != nil {
+		cat.metrics.ObserveElastic("searchknn", err, 0, time.Since(start))
 		return nil, errors.Wrap(err, "cannot search")
 	}
+	cat.metrics.ObserveElastic("searchknn", nil, res.Total, time.Since(start))
+	span.SetAttributes(attribute.Int64("search.total", res.Total))
 	return res, nil
 }
 
 // todo: create regexp which fits all cases
 var idRegexp = regexp.MustCompile(`^(99.*5504)$`)
 
-func (cat *Catalog) Result2MessageEmbed(result *index.Result, stat *channelStatus) ([]*discordgo.MessageEmbed, error) {
-	var embeds = []*discordgo.MessageEmbed{}
+// resultDocs returns the documents of the result in display order, the sort order of the structured query if given
+func resultDocs(result *index.Result, structured *llm.StructuredQuery) []*schema.UBSchema {
+	docs := []*schema.UBSchema{}
+	for _, doc := range result.Docs {
+		docs = append(docs, doc)
+	}
+	order := "relevance"
+	if structured != nil {
+		order = structured.Sort
+	}
+	sortDocs(docs, order)
+	return docs
+}
+
+// storeResults lets f modify the channel state, e.g. for a new search, and appends the documents to the channel results.
+// the cards are created afterwards, so that the store is not locked while rendering
+func (cat *Catalog) storeResults(channelID string, docs []*schema.UBSchema, total int64, f func(stat *channelStatus)) ([]*chat.Card, error) {
+	stat := cat.status.Update(channelID, func(stat *channelStatus) {
+		if f != nil {
+			f(stat)
+		}
+		stat.result = append(stat.result, docs...)
+	})
+	return cat.docCards(docs, total, stat)
+}
+
+// docCards creates the header and result cards of the documents, which are the last results of the channel
+func (cat *Catalog) docCards(docs []*schema.UBSchema, total int64, stat *channelStatus) ([]*chat.Card, error) {
+	var embeds = []*chat.Card{}
 
-	embed := &discordgo.MessageEmbed{
-		Author: &discordgo.MessageEmbedAuthor{
+	embed := &chat.Card{
+		Author: &chat.CardAuthor{
 			Name: "ub-bot",
 		},
 		Title: "Query Results",
-		Fields: []*discordgo.MessageEmbedField{
+		Fields: []*chat.CardField{
 			{
 				Name:  "Query",
 				Value: stat.lastQuery,
 			},
 			{
 				Name:  "Total Hits",
-				Value: fmt.Sprintf("%d", result.Total),
+				Value: fmt.Sprintf("%d", total),
 			},
 		},
 	}
-	if !strings.HasPrefix(stat.lastQuery, "similar:") {
-		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+	if stat.lastStructured != nil {
+		embed.Fields = append(embed.Fields, &chat.CardField{
+			Name:  "Magic Query",
+			Value: stat.lastStructured.String(),
+		})
+	}
+	if !strings.HasPrefix(stat.lastQuery, "similar:") && stat.searchFunc != cat.prefix+"rawquery" && stat.searchFunc != cat.prefix+"list" {
+		embed.Fields = append(embed.Fields, &chat.CardField{
 			Name:  "Swisscovery Search",
 			Value: fmt.Sprintf("https://basel.swisscovery.org/discovery/search?query=any,contains,%s&tab=UBS&search_scope=UBS&vid=41SLSP_UBS:live&offset=0", url.QueryEscape(stat.lastQuery)),
 		})
 	}
 	embeds = append(embeds, embed)
-	start := len(stat.result)
+	start := len(stat.result) - len(docs)
 	var key int
-	for _, entry := range result.Docs {
-		stat.result = append(stat.result, entry)
-		embed := &discordgo.MessageEmbed{
-			Author: &discordgo.MessageEmbedAuthor{
-				Name: fmt.Sprintf("%d - %f - %s", start+key, entry.Score_, entry.Id_),
-			},
-			Title:  entry.GetMainTitle(),
-			Fields: []*discordgo.MessageEmbedField{},
-		}
-		if len(embed.Title) > 256 {
-			embed.Title = embed.Title[:253] + "..."
-		}
+	results := []*cardData{}
+	for _, entry := range docs {
 		var urlStr string
 		if entry.UBSchema001.Mapping != nil && entry.UBSchema001.Mapping.RecordIdentifier != nil {
 			for _, id := range entry.UBSchema001.Mapping.RecordIdentifier {
@@ -239,929 +315,603 @@ func (cat *Catalog) Result2MessageEmbed(result *index.Result, stat *channelStatu
 				}
 			}
 		}
-		if urlStr != "" {
-			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
-				Value: urlStr,
-			})
+		results = append(results, newCardData(start+key, entry, urlStr))
+		key++
+	}
+	if stat.config.compact {
+		cards, err := cat.compactCards(results)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create compact result list")
 		}
-		for role, persons := range entry.GetPersons() {
-			ps := []string{}
-			for _, p := range persons {
-				if p.Date != "" {
-					ps = append(ps, fmt.Sprintf("%s (%s)", p.Name, p.Date))
-				} else {
-					ps = append(ps, p.Name)
-				}
-			}
-			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
-				Name:  role,
-				Value: strings.Join(ps, "; "),
-			})
+		return append(embeds, cards...), nil
+	}
+	for _, data := range results {
+		card, err := cat.resultCard(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot create result card of %s", data.ID)
 		}
-		embeds = append(embeds, embed)
-		key++
+		embeds = append(embeds, card)
 	}
 	return embeds, nil
 }
 
-func (cat *Catalog) CommandSearch() (cmdFunc discord.CommandCreate, appCmd *discordgo.ApplicationCommand) {
-	appCmd = &discordgo.ApplicationCommand{
-		Name:        cat.prefix + "search",
-		Description: "Search the catalogue",
-		Options: []*discordgo.ApplicationCommandOption{
-			{
-				Type: discordgo.ApplicationCommandOptionString,
-				Choices: []*discordgo.ApplicationCommandOptionChoice{
-					{
-						Name:  "Marc Vector",
-						Value: "marc",
-					},
-					{
-						Name:  "Prose Vector",
-						Value: "prose",
-					},
-					{
-						Name:  "JSON Vector",
-						Value: "json",
-					},
-					{
-						Name:  "Simple Elastic Query",
-						Value: "simple",
-					},
+func searchCommandOptions() []*chat.OptionDefinition {
+	return []*chat.OptionDefinition{
+		{
+			Type:        chat.OptionString,
+			Name:        "query",
+			Description: "Query to ask for",
+			Required:    true,
+		},
+		{
+			Type: chat.OptionString,
+			Choices: []*chat.OptionChoice{
+				{
+					Name:  "Marc Vector",
+					Value: "marc",
+				},
+				{
+					Name:  "Prose Vector",
+					Value: "prose",
+				},
+				{
+					Name:  "JSON Vector",
+					Value: "json",
+				},
+				{
+					Name:  "Simple Elastic Query",
+					Value: "simple",
 				},
-				Name:        "querytype",
-				Description: "Query Type",
-				Required:    true,
-			},
-			{
-				Type:        discordgo.ApplicationCommandOptionString,
-				Name:        "query",
-				Description: "Query to ask for",
-				Required:    true,
-			},
-			{
-				Type:        discordgo.ApplicationCommandOptionBoolean,
-				Name:        "magic",
-				Description: "Ask AI for better query before searching",
-				Required:    false,
 			},
+			Name:        "querytype",
+			Description: "Query Type, suggested by the AI if magic is used",
+			Required:    false,
+		},
+		{
+			Type:        chat.OptionBoolean,
+			Name:        "magic",
+			Description: "Ask AI for query, filters and sort order before searching",
+			Required:    false,
 		},
 	}
-	cmdFunc = func(i *discord.Interaction) {
-		// get the search query from the user
-		data := i.ApplicationCommandData()
-		cat.logger.Debug().Msgf("command name: %s", data.Name)
+}
 
-		if cat.tryLock(i.ChannelID) == false {
-			if err := i.SendInteractionResponseMessage("Please wait for the previous search to finish"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-			}
-			return
+// runSearch executes search or searchknn for the interaction. the channel must be locked by the caller
+func (cat *Catalog) runSearch(ctx context.Context, i chat.Request, entry *analytics.Entry, cmdName string, sType, query string, magic bool) {
+	ctx, release := cat.searchContext(ctx, i.Channel())
+	defer release()
+	logger := tracing.Logger(ctx, cat.logger)
+	// with magic the search type may be suggested by the AI
+	if (sType == "" && !magic) || query == "" {
+		if err := i.SendInteractionResponseMessage("Please provide search type and query"); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
 		}
-		go func() {
-			defer cat.unlock(i.ChannelID)
-
-			var sType, query string
-			var magic bool
-			for _, opt := range data.Options {
-				switch opt.Name {
-				case "querytype":
-					sType = opt.StringValue()
-				case "query":
-					query = opt.StringValue()
-				case "magic":
-					magic = opt.BoolValue()
-				}
-			}
-			if sType == "" || query == "" {
-				if err := i.SendInteractionResponseMessage("Please provide search type and query"); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-
-			session := i.GetSession()
-			channel, err := session.State.Channel(i.ChannelID)
-			if err != nil {
-				cat.logger.Error().Msgf("Error getting channel: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error getting channel: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			filter := FilterFromChannelTopic(channel.Topic)
-
-			msg := fmt.Sprintf("Searching for %s: %s", sType, query)
-			msg += "\nFilter:\n"
-			for k, v := range filter {
-				msg += fmt.Sprintf("%s: %s\n", k, v)
-			}
-			if err := i.SendInteractionResponseMessage(msg); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-			}
-
-			var newQuery = query
-			if magic {
-				var err error
-				cat.logger.Debug().Msgf("magic query: %s", query)
-				newQuery, err = cat.Query2Embedding(query)
-				if err != nil {
-					cat.logger.Error().Msgf("Error converting query: %v", err)
-					if err := i.SendChannelMessage(fmt.Sprintf("Error converting query: %v", err)); err != nil {
-						cat.logger.Error().Msgf("Error sending response: %v", err)
-					}
-					return
-				}
-				cat.logger.Debug().Msgf("new query: %s", newQuery)
-			}
-
-			var searchType SearchType
-			var embedding []float32
-			switch sType {
-			case "marc":
-				embedding, err = cat.GetEmbedding(newQuery)
-				searchType = SearchTypeEmbeddingMARC
-			case "prose":
-				embedding, err = cat.GetEmbedding(newQuery)
-				searchType = SearchTypeEmbeddingProse
-			case "json":
-				embedding, err = cat.GetEmbedding(newQuery)
-				searchType = SearchTypeEmbeddingJSON
-			case "simple":
-				searchType = SearchTypeSimple
-			default:
-				if err := i.SendChannelMessage(fmt.Sprintf("Unknown search type %s", sType)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			if err != nil {
-				cat.logger.Error().Msgf("Error getting embedding: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error getting embedding: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-
-			stat := cat.status.Get(i.ChannelID)
-			result, err := cat.Search(newQuery, filter, embedding, searchType, 0, stat.config.maxResults)
-			if err != nil {
-				cat.logger.Error().Msgf("Error searching: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error searching: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			stat.result = []*schema.UBSchema{}
-			stat.lastQuery = newQuery
-			stat.lastSearchType = searchType
-			stat.lastVector = embedding
-			stat.searchFunc = appCmd.Name
-
-			embeds, err := cat.Result2MessageEmbed(result, stat)
-			if err != nil {
-				cat.logger.Error().Msgf("Error creating response: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error creating response: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			cat.logger.Info().Msgf("sending %d embeds", len(embeds))
-			if err := i.SendChannelEmbeds(embeds); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error sending response: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-		}()
-	}
-	return
-}
-func (cat *Catalog) CommandSearchKNN() (cmdFunc discord.CommandCreate, appCmd *discordgo.ApplicationCommand) {
-	appCmd = &discordgo.ApplicationCommand{
-		Name:        cat.prefix + "searchknn",
-		Description: "Search the catalogue",
-		Options: []*discordgo.ApplicationCommandOption{
-			{
-				Type: discordgo.ApplicationCommandOptionString,
-				Choices: []*discordgo.ApplicationCommandOptionChoice{
-					{
-						Name:  "Marc Vector",
-						Value: "marc",
-					},
-					{
-						Name:  "Prose Vector",
-						Value: "prose",
-					},
-					{
-						Name:  "JSON Vector",
-						Value: "json",
-					},
-					{
-						Name:  "Simple Elastic Query",
-						Value: "simple",
-					},
-				},
-				Name:        "querytype",
-				Description: "Query Type",
-				Required:    true,
-			},
-			{
-				Type:        discordgo.ApplicationCommandOptionString,
-				Name:        "query",
-				Description: "Query to ask for",
-				Required:    true,
-			},
-			{
-				Type:        discordgo.ApplicationCommandOptionBoolean,
-				Name:        "magic",
-				Description: "Ask AI for better query before searching",
-				Required:    false,
-			},
-		},
+		return
 	}
-	cmdFunc = func(i *discord.Interaction) {
-		// get the search query from the user
-		data := i.ApplicationCommandData()
-		cat.logger.Debug().Msgf("command name: %s", data.Name)
+	entry.Query = query
 
-		if cat.tryLock(i.ChannelID) == false {
-			if err := i.SendInteractionResponseMessage("Please wait for the previous search to finish"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-			}
-			return
+	topic, err := i.ChannelTopic()
+	if err != nil {
+		entry.Error = err.Error()
+		logger.Error().Msgf("Error getting channel: %v", err)
+		if err := i.SendChannelMessage(fmt.Sprintf("Error getting channel: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
 		}
-		go func() {
-			defer cat.unlock(i.ChannelID)
-
-			var sType, query string
-			var magic bool
-			for _, opt := range data.Options {
-				switch opt.Name {
-				case "querytype":
-					sType = opt.StringValue()
-				case "query":
-					query = opt.StringValue()
-				case "magic":
-					magic = opt.BoolValue()
-				}
-			}
-			if sType == "" || query == "" {
-				if err := i.SendInteractionResponseMessage("Please provide search type and query"); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-
-			session := i.GetSession()
-			channel, err := session.State.Channel(i.ChannelID)
-			if err != nil {
-				cat.logger.Error().Msgf("Error getting channel: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error getting channel: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			filter := FilterFromChannelTopic(channel.Topic)
-
-			msg := fmt.Sprintf("Searching for %s: %s", sType, query)
-			msg += "\nFilter:\n"
-			for k, v := range filter {
-				msg += fmt.Sprintf("%s: %s\n", k, v)
-			}
-			if err := i.SendInteractionResponseMessage(msg); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-			}
-
-			var newQuery = query
-			if magic {
-				var err error
-				cat.logger.Debug().Msgf("magic query: %s", query)
-				newQuery, err = cat.Query2Embedding(query)
-				if err != nil {
-					cat.logger.Error().Msgf("Error converting query: %v", err)
-					if err := i.SendChannelMessage(fmt.Sprintf("Error converting query: %v", err)); err != nil {
-						cat.logger.Error().Msgf("Error sending response: %v", err)
-					}
-					return
-				}
-				cat.logger.Debug().Msgf("new query: %s", newQuery)
-			}
-
-			var searchType SearchType
-			var embedding []float32
-			switch sType {
-			case "marc":
-				embedding, err = cat.GetEmbedding(newQuery)
-				searchType = SearchTypeEmbeddingMARC
-			case "prose":
-				embedding, err = cat.GetEmbedding(newQuery)
-				searchType = SearchTypeEmbeddingProse
-			case "json":
-				embedding, err = cat.GetEmbedding(newQuery)
-				searchType = SearchTypeEmbeddingJSON
-			case "simple":
-				searchType = SearchTypeSimple
-			default:
-				if err := i.SendChannelMessage(fmt.Sprintf("Unknown search type %s", sType)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			if err != nil {
-				cat.logger.Error().Msgf("Error getting embedding: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error getting embedding: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-
-			stat := cat.status.Get(i.ChannelID)
-			result, err := cat.SearchKNN(filter, embedding, searchType, stat.config.maxResults, stat.config.maxResults)
-			if err != nil {
-				cat.logger.Error().Msgf("Error searching: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error searching: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			stat.result = []*schema.UBSchema{}
-			stat.lastQuery = newQuery
-			stat.lastSearchType = searchType
-			stat.lastVector = embedding
-			stat.searchFunc = appCmd.Name
-
-			embeds, err := cat.Result2MessageEmbed(result, stat)
-			if err != nil {
-				cat.logger.Error().Msgf("Error creating response: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error creating response: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			cat.logger.Info().Msgf("sending %d embeds", len(embeds))
-			if err := i.SendChannelEmbeds(embeds); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error sending response: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-		}()
+		return
 	}
-	return
-}
+	filter := FilterFromChannelTopic(topic)
+	entry.Filter = filter
 
-func (cat *Catalog) CommandSimilar() (cmdFunc discord.CommandCreate, appCmd *discordgo.ApplicationCommand) {
-	appCmd = &discordgo.ApplicationCommand{
-		Name:        cat.prefix + "similar",
-		Description: "search similar object based on marc embedding",
-		Options: []*discordgo.ApplicationCommandOption{
-			{
-				Type: discordgo.ApplicationCommandOptionString,
-				Choices: []*discordgo.ApplicationCommandOptionChoice{
-					{
-						Name:  "Marc Vector",
-						Value: "marc",
-					},
-					{
-						Name:  "Prose Vector",
-						Value: "prose",
-					},
-					{
-						Name:  "JSON Vector",
-						Value: "json",
-					},
-				},
-				Name:        "querytype",
-				Description: "Query Type",
-				Required:    true,
-			},
-			{
-				Type:        discordgo.ApplicationCommandOptionString,
-				Name:        "resultid",
-				Description: "Result ID from previous search or full elastic id",
-				Required:    true,
-			},
-		},
+	displayType := sType
+	if displayType == "" {
+		displayType = "suggested type"
 	}
-	cmdFunc = func(i *discord.Interaction) {
-		data := i.ApplicationCommandData()
-		if len(data.Options) < 2 {
-			if err := i.SendInteractionResponseMessage("Please provide search type and result ID"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-			}
-			return
-		}
-		sType := data.Options[0].StringValue()
-		resultIDStr := data.Options[1].StringValue()
-		resultID := -1
+	msg := fmt.Sprintf("Searching for %s: %s", displayType, query)
+	msg += "\nFilter:\n"
+	for k, v := range filter {
+		msg += fmt.Sprintf("%s: %s\n", k, v)
+	}
+	if err := i.SendInteractionResponseMessage(msg); err != nil {
+		logger.Error().Msgf("Error sending response: %v", err)
+	}
+
+	var newQuery = query
+	var structured *llm.StructuredQuery
+	if magic {
 		var err error
-		var searchType SearchType
-		var vector []float32
-		var lastResult *schema.UBSchema
-		stat := cat.status.Get(i.ChannelID)
-		if resultID, err = strconv.Atoi(resultIDStr); err == nil && resultID < 100 {
-			if len(stat.result) == 0 {
-				if err := i.SendInteractionResponseMessage("No search results available"); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			if resultID < 0 || int(resultID) >= len(stat.result) {
-				if err := i.SendInteractionResponseMessage("Invalid result ID"); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			lastResult = stat.result[resultID]
-			stat.lastQuery = fmt.Sprintf("similar:%d - %s", resultID, lastResult.GetMainTitle())
-			cat.logger.Debug().Msgf("result ID: %d", resultID)
-		} else {
-			docs, err := cat.GetDocuments(resultIDStr)
-			if err != nil {
-				cat.logger.Error().Msgf("Error getting document %s: %v", resultIDStr, err)
-				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error getting document %s: %v", resultIDStr, err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			if len(docs) != 1 {
-				cat.logger.Error().Msgf("Invalid document ID %s", resultIDStr)
-				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Invalid document ID %s", resultIDStr)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
+		logger.Debug().Msgf("magic query: %s", query)
+		structured, err = cat.Query2StructuredQuery(ctx, query)
+		if errors.Is(err, llm.ErrCircuitOpen) {
+			logger.Warn().Msgf("OpenAI unavailable, searching without magic: %v", err)
+			entry.Degraded = true
+			structured, err = nil, nil
+			if err := i.SendChannelMessage("OpenAI is currently unavailable, searching without magic"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
-			var ok bool
-			lastResult, ok = docs[resultIDStr]
-			if !ok {
-				cat.logger.Error().Msgf("Document %s not found", resultIDStr)
-				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Document %s not found", resultIDStr)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			stat.lastQuery = fmt.Sprintf("similar:%s - %s", resultIDStr, lastResult.GetMainTitle())
-
-			cat.logger.Debug().Msgf("result ID: %s", resultIDStr)
 		}
-
-		if lastResult == nil {
-			cat.logger.Error().Msgf("No last result available")
-			if err := i.SendInteractionResponseMessage("No last result available"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+		if err != nil {
+			entry.Error = err.Error()
+			logger.Error().Msgf("Error converting query: %v", err)
+			if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error converting query", err)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
 			return
 		}
-
-		switch sType {
-		case "marc":
-			searchType = SearchTypeEmbeddingMARC
-			vector = lastResult.EmbeddingMarc
-		case "prose":
-			searchType = SearchTypeEmbeddingProse
-			vector = lastResult.EmbeddingProse
-		case "json":
-			searchType = SearchTypeEmbeddingJSON
-			vector = lastResult.EmbeddingJson
-		default:
-			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Unknown search type %s", sType)); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+		if structured != nil {
+			logger.Debug().Msgf("structured query: %+v", structured)
+			newQuery = structured.Query
+			entry.MagicQuery = structured.String()
+			if sType == "" {
+				sType = structured.SearchType
 			}
-			return
-		}
-		stat.result = []*schema.UBSchema{}
-		stat.lastSearchType = searchType
-		stat.lastVector = vector
-
-		session := i.GetSession()
-		channel, err := session.State.Channel(i.ChannelID)
-		if err != nil {
-			cat.logger.Error().Msgf("Error getting channel: %v", err)
-			if err := i.SendChannelMessage(fmt.Sprintf("Error getting channel: %v", err)); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+			if err := i.SendChannelMessage(fmt.Sprintf("Magic query:\n%s", structured.String())); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
-			return
 		}
-		filter := FilterFromChannelTopic(channel.Topic)
+	}
+	if sType == "" {
+		sType = "simple"
+	}
+	// a question which is completely covered by filters has no free text to embed
+	embeddingQuery := newQuery
+	if embeddingQuery == "" {
+		embeddingQuery = query
+	}
 
-		msg := fmt.Sprintf("searching %s similarities for: %s", sType, lastResult.GetMainTitle())
-		msg += "\nFilter:\n"
-		for k, v := range filter {
-			msg += fmt.Sprintf("%s: %s\n", k, v)
+	var searchType SearchType
+	var embedding []float32
+	switch sType {
+	case "marc":
+		embedding, err = cat.GetEmbedding(ctx, embeddingQuery)
+		searchType = SearchTypeEmbeddingMARC
+	case "prose":
+		embedding, err = cat.GetEmbedding(ctx, embeddingQuery)
+		searchType = SearchTypeEmbeddingProse
+	case "json":
+		embedding, err = cat.GetEmbedding(ctx, embeddingQuery)
+		searchType = SearchTypeEmbeddingJSON
+	case "simple":
+		searchType = SearchTypeSimple
+	default:
+		entry.Error = fmt.Sprintf("unknown search type %s", sType)
+		if err := i.SendChannelMessage(fmt.Sprintf("Unknown search type %s", sType)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
 		}
-		if err := i.SendInteractionResponseMessage(msg); err != nil {
-			cat.logger.Error().Msgf("Error sending response: %v", err)
+		return
+	}
+	if errors.Is(err, llm.ErrCircuitOpen) {
+		// degrade to a simple query until the provider is available again
+		logger.Warn().Msgf("OpenAI unavailable, falling back to simple search: %v", err)
+		entry.Degraded = true
+		searchType = SearchTypeSimple
+		embedding = nil
+		err = nil
+		cmdName = cat.prefix + "search"
+		if err := i.SendChannelMessage(fmt.Sprintf("OpenAI is currently unavailable, falling back to simple search instead of %s vector search", sType)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
 		}
-		cat.logger.Debug().Msgf("searching %s similarities for: %s", sType, lastResult.GetMainTitle())
-		if cat.tryLock(i.ChannelID) == false {
-			if err := i.SendInteractionResponseMessage("Please wait for the previous search to finish"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-			}
-			return
+	}
+	entry.SearchType = searchTypeName(searchType)
+	if err != nil {
+		entry.Error = err.Error()
+		logger.Error().Msgf("Error getting embedding: %v", err)
+		if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error getting embedding", err)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
 		}
-		go func() {
-			defer cat.unlock(i.ChannelID)
+		return
+	}
 
-			result, err := cat.Search("", filter, vector, searchType, 0, stat.config.maxResults)
-			if err != nil {
-				cat.logger.Error().Msgf("Error searching: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error searching: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
+	stat := cat.channelStatus(i)
+	var result *index.Result
+	switch {
+	case structured != nil && cmdName == cat.prefix+"searchknn":
+		if structured.Sort != "relevance" {
+			// the knn search only returns the nearest neighbours, which sortDocs orders
+			if err := i.SendChannelMessage(fmt.Sprintf("Sort order %s is applied per page to the %d nearest neighbours, not to the whole catalogue", structured.Sort, stat.config.maxResults)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
-
-			embeds, err := cat.Result2MessageEmbed(result, stat)
-			if err != nil {
-				cat.logger.Error().Msgf("Error creating response: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error creating response: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			if err := i.SendChannelEmbeds(embeds); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error sending response: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-		}()
-	}
-	return
-}
-func (cat *Catalog) CommandSimilarKNN() (cmdFunc discord.CommandCreate, appCmd *discordgo.ApplicationCommand) {
-	appCmd = &discordgo.ApplicationCommand{
-		Name:        cat.prefix + "similarknn",
-		Description: "search similar object based on marc embedding",
-		Options: []*discordgo.ApplicationCommandOption{
-			{
-				Type: discordgo.ApplicationCommandOptionString,
-				Choices: []*discordgo.ApplicationCommandOptionChoice{
-					{
-						Name:  "Marc Vector",
-						Value: "marc",
-					},
-					{
-						Name:  "Prose Vector",
-						Value: "prose",
-					},
-					{
-						Name:  "JSON Vector",
-						Value: "json",
-					},
-				},
-				Name:        "querytype",
-				Description: "Query Type",
-				Required:    true,
-			},
-			{
-				Type:        discordgo.ApplicationCommandOptionString,
-				Name:        "resultid",
-				Description: "Result ID from previous search or full elastic id",
-				Required:    true,
-			},
-		},
+		}
+		result, err = cat.StructuredSearchKNN(ctx, structured, filter, embedding, searchType, stat.config.maxResults, stat.config.maxResults)
+	case structured != nil:
+		result, err = cat.StructuredSearch(ctx, structured, filter, embedding, searchType, 0, stat.config.maxResults)
+	case cmdName == cat.prefix+"searchknn":
+		result, err = cat.SearchKNN(ctx, filter, embedding, searchType, stat.config.maxResults, stat.config.maxResults)
+	default:
+		result, err = cat.Search(ctx, newQuery, filter, embedding, searchType, 0, stat.config.maxResults)
 	}
-	cmdFunc = func(i *discord.Interaction) {
-		data := i.ApplicationCommandData()
-		if len(data.Options) < 2 {
-			if err := i.SendInteractionResponseMessage("Please provide search type and result ID"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-			}
-			return
+	if err != nil {
+		entry.Error = err.Error()
+		logger.Error().Msgf("Error searching: %v", err)
+		if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error searching", err)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
 		}
-		sType := data.Options[0].StringValue()
-		resultIDStr := data.Options[1].StringValue()
-		resultID := -1
-		var err error
-		var searchType SearchType
-		var vector []float32
-		var lastResult *schema.UBSchema
-		stat := cat.status.Get(i.ChannelID)
-		if resultID, err = strconv.Atoi(resultIDStr); err == nil && resultID < 100 {
-			if len(stat.result) == 0 {
-				if err := i.SendInteractionResponseMessage("No search results available"); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			if resultID < 0 || int(resultID) >= len(stat.result) {
-				if err := i.SendInteractionResponseMessage("Invalid result ID"); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			lastResult = stat.result[resultID]
-			stat.lastQuery = fmt.Sprintf("similar:%d - %s", resultID, lastResult.GetMainTitle())
-			cat.logger.Debug().Msgf("result ID: %d", resultID)
-		} else {
-			docs, err := cat.GetDocuments(resultIDStr)
-			if err != nil {
-				cat.logger.Error().Msgf("Error getting document %s: %v", resultIDStr, err)
-				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error getting document %s: %v", resultIDStr, err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			if len(docs) != 1 {
-				cat.logger.Error().Msgf("Invalid document ID %s", resultIDStr)
-				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Invalid document ID %s", resultIDStr)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			var ok bool
-			lastResult, ok = docs[resultIDStr]
-			if !ok {
-				cat.logger.Error().Msgf("Document %s not found", resultIDStr)
-				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Document %s not found", resultIDStr)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			stat.lastQuery = fmt.Sprintf("similar:%s - %s", resultIDStr, lastResult.GetMainTitle())
+		return
+	}
+	entry.Total = result.Total
 
-			cat.logger.Debug().Msgf("result ID: %s", resultIDStr)
+	embeds, err := cat.storeResults(i.Channel(), resultDocs(result, structured), result.Total, func(stat *channelStatus) {
+		stat.result = []*schema.UBSchema{}
+		stat.lastQuery = newQuery
+		stat.lastSearchType = searchType
+		stat.lastVector = embedding
+		stat.lastStructured = structured
+		stat.lastMatch = nil
+		stat.searchFunc = cmdName
+	})
+	if err != nil {
+		entry.Error = err.Error()
+		logger.Error().Msgf("Error creating response: %v", err)
+		if err := i.SendChannelMessage(fmt.Sprintf("Error creating response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
 		}
-
-		if lastResult == nil {
-			cat.logger.Error().Msgf("No last result available")
-			if err := i.SendInteractionResponseMessage("No last result available"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-			}
-			return
+		return
+	}
+	logger.Info().Msgf("sending %d embeds", len(embeds))
+	if err := i.SendChannelCards(embeds); err != nil {
+		entry.Error = err.Error()
+		logger.Error().Msgf("Error sending response: %v", err)
+		if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error sending response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
 		}
+		return
+	}
+}
 
-		switch sType {
-		case "marc":
-			searchType = SearchTypeEmbeddingMARC
-			vector = lastResult.EmbeddingMarc
-		case "prose":
-			searchType = SearchTypeEmbeddingProse
-			vector = lastResult.EmbeddingProse
-		case "json":
-			searchType = SearchTypeEmbeddingJSON
-			vector = lastResult.EmbeddingJson
-		default:
-			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Unknown search type %s", sType)); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+func (cat *Catalog) searchCommandFunc(cmdName string) chat.Handler {
+	return func(i chat.Request) {
+		// get the search query from the user
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		logger.Debug().Msgf("command name: %s", i.CommandName())
+
+		var sType, query string
+		var magic bool
+		for _, opt := range i.Options() {
+			switch opt.Name {
+			case "querytype":
+				sType = opt.StringValue()
+			case "query":
+				query = opt.StringValue()
+			case "magic":
+				magic = opt.BoolValue()
 			}
-			return
 		}
-		stat.result = []*schema.UBSchema{}
-		stat.lastSearchType = searchType
-		stat.lastVector = vector
-
-		session := i.GetSession()
-		channel, err := session.State.Channel(i.ChannelID)
-		if err != nil {
-			cat.logger.Error().Msgf("Error getting channel: %v", err)
-			if err := i.SendChannelMessage(fmt.Sprintf("Error getting channel: %v", err)); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+		// magic uses the same OpenAI calls as /magic
+		if magic && !cat.permissions.Allowed(i.Guild(), i.Roles(), i.IsGuildAdmin(), cat.prefix+"magic") {
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("You are not allowed to use /%smagic", cat.prefix)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
+			cat.endCommand(ctx, entry)
 			return
 		}
-		filter := FilterFromChannelTopic(channel.Topic)
-
-		msg := fmt.Sprintf("searching %s similarities for: %s", sType, lastResult.GetMainTitle())
-		msg += "\nFilter:\n"
-		for k, v := range filter {
-			msg += fmt.Sprintf("%s: %s\n", k, v)
-		}
-		if err := i.SendInteractionResponseMessage(msg); err != nil {
-			cat.logger.Error().Msgf("Error sending response: %v", err)
-		}
-		cat.logger.Debug().Msgf("searching %s similarities for: %s", sType, lastResult.GetMainTitle())
-		if cat.tryLock(i.ChannelID) == false {
-			if err := i.SendInteractionResponseMessage("Please wait for the previous search to finish"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-			}
-			return
+		if !cat.enqueue(ctx, i, entry, func() {
+			defer cat.endCommand(ctx, entry)
+			cat.runSearch(ctx, i, entry, cmdName, sType, query, magic)
+		}) {
+			cat.endCommand(ctx, entry)
 		}
-		go func() {
-			defer cat.unlock(i.ChannelID)
+	}
+}
 
-			result, err := cat.SearchKNN(filter, vector, searchType, stat.config.maxResults, stat.config.maxResults)
-			if err != nil {
-				cat.logger.Error().Msgf("Error searching: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error searching: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
+func (cat *Catalog) CommandSearch() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "search",
+		Description: "Search the catalogue",
+		Options:     searchCommandOptions(),
+	}
+	cmdFunc = cat.searchCommandFunc(appCmd.Name)
+	return
+}
 
-			embeds, err := cat.Result2MessageEmbed(result, stat)
-			if err != nil {
-				cat.logger.Error().Msgf("Error creating response: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error creating response: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-			if err := i.SendChannelEmbeds(embeds); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error sending response: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
-				}
-				return
-			}
-		}()
+func (cat *Catalog) CommandSearchKNN() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "searchknn",
+		Description: "Search the catalogue",
+		Options:     searchCommandOptions(),
+	}
+	cmdFunc = cat.searchCommandFunc(appCmd.Name)
+	return
+}
+
+func (cat *Catalog) CommandSimilar() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "similar",
+		Description: "search objects similar to one or more results, and not similar to others",
+		Options:     similarCommandOptions(),
+	}
+	cmdFunc = cat.similarCommandFunc(appCmd.Name)
+	return
+}
+func (cat *Catalog) CommandSimilarKNN() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "similarknn",
+		Description: "search objects similar to one or more results, and not similar to others",
+		Options:     similarCommandOptions(),
 	}
+	cmdFunc = cat.similarCommandFunc(appCmd.Name)
 	return
 }
 
-func (cat *Catalog) CommandMagic() (cmdFunc discord.CommandCreate, appCmd *discordgo.ApplicationCommand) {
-	appCmd = &discordgo.ApplicationCommand{
+func (cat *Catalog) CommandMagic() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
 		Name:        cat.prefix + "magic",
 		Description: "Magic search",
-		Options: []*discordgo.ApplicationCommandOption{
+		Options: []*chat.OptionDefinition{
 			{
-				Type:        discordgo.ApplicationCommandOptionString,
+				Type:        chat.OptionString,
 				Name:        "query",
 				Description: "Query to do magic with",
 				Required:    true,
 			},
 		},
 	}
-	m := sync.Mutex{}
-	cmdFunc = func(i *discord.Interaction) {
-		data := i.ApplicationCommandData()
-		cat.logger.Debug().Msgf("command name: %s", data.Name)
-		if len(data.Options) < 1 {
-			if err := i.SendInteractionResponseMessage("Please provide query"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		logger.Debug().Msgf("command name: %s", i.CommandName())
+		async := false
+		defer func() {
+			if !async {
+				cat.endCommand(ctx, entry)
 			}
-			return
-		}
-		query := data.Options[0].StringValue()
-		cat.logger.Debug().Msgf("magic query: %s", query)
-		if m.TryLock() == false {
-			if err := i.SendInteractionResponseMessage("Please wait for the previous search to finish"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+		}()
+		if len(i.Options()) < 1 {
+			if err := i.SendInteractionResponseMessage("Please provide query"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
 			return
 		}
-		go func() {
-			defer m.Unlock()
-			newQuery, err := cat.Query2Embedding(query)
+		query := i.Options()[0].StringValue()
+		entry.Query = query
+		logger.Debug().Msgf("magic query: %s", query)
+		async = cat.enqueue(ctx, i, entry, func() {
+			defer cat.endCommand(ctx, entry)
+			ctx, release := cat.searchContext(ctx, i.Channel())
+			defer release()
+			structured, err := cat.Query2StructuredQuery(ctx, query)
 			if err != nil {
-				cat.logger.Error().Msgf("Error converting query: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error converting query: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error converting query: %v", err)
+				if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error converting query", err)); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
 				}
 				return
 			}
-			cat.logger.Debug().Msgf("new query: %s", newQuery)
-			if err := i.SendChannelMessage(newQuery); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+			logger.Debug().Msgf("structured query: %+v", structured)
+			entry.MagicQuery = structured.String()
+			if err := i.SendChannelMessage(structured.String()); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
-		}()
+		})
 	}
 	return
 }
 
-func (cat *Catalog) CommandText() (cmdFunc discord.CommandCreate, appCmd *discordgo.ApplicationCommand) {
-	appCmd = &discordgo.ApplicationCommand{
+func (cat *Catalog) CommandText() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
 		Name:        cat.prefix + "text",
-		Description: "show base text of prose embedding",
-		Options: []*discordgo.ApplicationCommandOption{
+		Description: "show base text of an embedding",
+		Options: []*chat.OptionDefinition{
 			{
-				Type:        discordgo.ApplicationCommandOptionString,
+				Type:        chat.OptionString,
 				Name:        "resultid",
 				Description: "Result ID from previous search or full elastic id",
 				Required:    true,
 			},
+			{
+				Type:        chat.OptionString,
+				Name:        "type",
+				Description: "Vector whose source text is shown (default prose)",
+				Required:    false,
+				Choices: []*chat.OptionChoice{
+					{
+						Name:  "prose",
+						Value: "prose",
+					},
+					{
+						Name:  "marc (approximation)",
+						Value: "marc",
+					},
+					{
+						Name:  "json",
+						Value: "json",
+					},
+				},
+			},
+			{
+				Type:        chat.OptionString,
+				Name:        "template",
+				Description: "Template of the text, instead of type",
+				Required:    false,
+				Choices:     cat.templateChoices(),
+			},
 		},
 	}
-	cmdFunc = func(i *discord.Interaction) {
-		data := i.ApplicationCommandData()
-		cat.logger.Debug().Msgf("command name: %s", data.Name)
-		if len(data.Options) < 1 {
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		logger.Debug().Msgf("command name: %s", i.CommandName())
+		defer cat.endCommand(ctx, entry)
+		if len(i.Options()) < 1 {
 			if err := i.SendInteractionResponseMessage("Please provide query"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
 			return
 		}
 
-		resultIDStr := data.Options[0].StringValue()
+		var resultIDStr, vectorType, templateName string
+		for _, opt := range i.Options() {
+			switch opt.Name {
+			case "resultid":
+				resultIDStr = opt.StringValue()
+			case "type":
+				vectorType = opt.StringValue()
+			case "template":
+				templateName = opt.StringValue()
+			}
+		}
+		if vectorType != "" && templateName != "" {
+			if err := i.SendInteractionResponseMessage("Please provide either type or template"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
 		resultID := -1
 		var err error
 		var lastResult *schema.UBSchema
-		stat := cat.status.Get(i.ChannelID)
+		stat := cat.channelStatus(i)
 		if resultID, err = strconv.Atoi(resultIDStr); err == nil && resultID < 100 {
 			if len(stat.result) == 0 {
 				if err := i.SendInteractionResponseMessage("No search results available"); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
+					logger.Error().Msgf("Error sending response: %v", err)
 				}
 				return
 			}
 			if resultID < 0 || int(resultID) >= len(stat.result) {
 				if err := i.SendInteractionResponseMessage("Invalid result ID"); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
+					logger.Error().Msgf("Error sending response: %v", err)
 				}
 				return
 			}
 			lastResult = stat.result[resultID]
-			stat.lastQuery = fmt.Sprintf("similar:%d - %s", resultID, lastResult.GetMainTitle())
-			cat.logger.Debug().Msgf("result ID: %d", resultID)
+			logger.Debug().Msgf("result ID: %d", resultID)
 		} else {
-			docs, err := cat.GetDocuments(resultIDStr)
+			docs, err := cat.GetDocuments(ctx, resultIDStr)
 			if err != nil {
-				cat.logger.Error().Msgf("Error getting document %s: %v", resultIDStr, err)
+				logger.Error().Msgf("Error getting document %s: %v", resultIDStr, err)
 				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error getting document %s: %v", resultIDStr, err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
+					logger.Error().Msgf("Error sending response: %v", err)
 				}
 				return
 			}
 			if len(docs) != 1 {
-				cat.logger.Error().Msgf("Invalid document ID %s", resultIDStr)
+				logger.Error().Msgf("Invalid document ID %s", resultIDStr)
 				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Invalid document ID %s", resultIDStr)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
+					logger.Error().Msgf("Error sending response: %v", err)
 				}
 				return
 			}
 			var ok bool
 			lastResult, ok = docs[resultIDStr]
 			if !ok {
-				cat.logger.Error().Msgf("Document %s not found", resultIDStr)
+				logger.Error().Msgf("Document %s not found", resultIDStr)
 				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Document %s not found", resultIDStr)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
+					logger.Error().Msgf("Error sending response: %v", err)
 				}
 				return
 			}
 
-			cat.logger.Debug().Msgf("result ID: %s", resultIDStr)
+			logger.Debug().Msgf("result ID: %s", resultIDStr)
 		}
 		if lastResult == nil {
-			cat.logger.Error().Msgf("No last result available")
+			logger.Error().Msgf("No last result available")
 			if err := i.SendInteractionResponseMessage("No last result available"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
 			return
 		}
 
-		buf := bytes.NewBuffer(nil)
-		if err := cat.tmpl.Execute(buf, lastResult); err != nil {
-			cat.logger.Error().Msgf("Error executing template: %v", err)
-			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error executing template: %v", err)); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+		var text, source string
+		if templateName != "" {
+			tmpl, err := cat.templates.Get(templateName)
+			if err != nil {
+				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Unknown template %s", templateName)); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			source = tmpl.ID()
+			text, err = tmpl.Execute(lastResult)
+		} else {
+			if vectorType == "" {
+				vectorType = "prose"
+			}
+			text, source, err = cat.EmbeddingSource(lastResult, vectorType)
+		}
+		entry.Template = source
+		if err != nil {
+			logger.Error().Msgf("Error executing template: %v", err)
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error executing template: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
 			return
 		}
-		if err := i.SendInteractionResponseMessage(buf.String()); err != nil {
-			cat.logger.Error().Msgf("Error sending response: %v", err)
+		msg := fmt.Sprintf("%s\n\nsource %s", text, source)
+		if utf8.RuneCountInString(msg) <= maxMessageLength {
+			if err := i.SendInteractionResponseMessage(msg); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		if err := i.SendInteractionResponseMessage(fmt.Sprintf("Text of %s (source %s) is attached", lastResult.Id_, source)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+		if err := i.SendChannelCardsWithFiles(nil, []*chat.File{
+			{
+				Name:        fmt.Sprintf("text-%s-%s.txt", lastResult.Id_, strings.NewReplacer("@", "-", " ", "-").Replace(source)),
+				ContentType: "text/plain; charset=utf-8",
+				Reader:      strings.NewReader(text),
+			},
+		}); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+			if err := i.SendChannelMessage(fmt.Sprintf("Error sending response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
 		}
 	}
 	return
 }
 
-func (cat *Catalog) CommandMore() (cmdFunc discord.CommandCreate, appCmd *discordgo.ApplicationCommand) {
-	appCmd = &discordgo.ApplicationCommand{
+func (cat *Catalog) CommandMore() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
 		Name:        cat.prefix + "more",
 		Description: "use last search and get next result page",
-		Options:     []*discordgo.ApplicationCommandOption{},
+		Options:     []*chat.OptionDefinition{},
 	}
-	cmdFunc = func(i *discord.Interaction) {
-		stat := cat.status.Get(i.ChannelID)
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		async := false
+		defer func() {
+			if !async {
+				cat.endCommand(ctx, entry)
+			}
+		}()
+		stat := cat.channelStatus(i)
 		if stat.searchFunc != cat.prefix+"search" {
 			if err := i.SendInteractionResponseMessage(fmt.Sprintf("search \"%s\" not supported", stat.searchFunc)); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
 			return
 		}
-		if len(stat.result) == 0 || stat.lastQuery == "" {
+		if len(stat.result) == 0 || (stat.lastQuery == "" && stat.lastStructured == nil) {
 			if err := i.SendInteractionResponseMessage("No search results available"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-			}
-			return
-		}
-		if cat.tryLock(i.ChannelID) == false {
-			if err := i.SendInteractionResponseMessage("Please wait for the previous search to finish"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
 			return
 		}
-		session := i.GetSession()
-		channel, err := session.State.Channel(i.ChannelID)
+		topic, err := i.ChannelTopic()
 		if err != nil {
-			cat.logger.Error().Msgf("Error getting channel: %v", err)
-			if err := i.SendChannelMessage(fmt.Sprintf("Error getting channel: %v", err)); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+			logger.Error().Msgf("Error getting channel: %v", err)
+			if err := i.SendChannelMessage(fmt.Sprintf("Error getting channel: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
 			return
 		}
-		filter := FilterFromChannelTopic(channel.Topic)
+		filter := FilterFromChannelTopic(topic)
+		entry.Filter = filter
+		entry.SearchType = searchTypeName(stat.lastSearchType)
 
 		if err := i.SendInteractionResponseMessage("Searching for more results"); err != nil {
-			cat.logger.Error().Msgf("Error sending response: %v", err)
+			logger.Error().Msgf("Error sending response: %v", err)
 		}
 
-		go func() {
-			defer cat.unlock(i.ChannelID)
+		async = cat.enqueue(ctx, i, entry, func() {
+			defer cat.endCommand(ctx, entry)
+			ctx, release := cat.searchContext(ctx, i.Channel())
+			defer release()
+			// the state may have changed while the command was queued
+			stat := cat.channelStatus(i)
 
 			var searchType SearchType
 			var vector []float32
@@ -1169,126 +919,135 @@ func (cat *Catalog) CommandMore() (cmdFunc discord.CommandCreate, appCmd *discor
 			var result *index.Result
 			var sErr error
 			if strings.HasPrefix(stat.lastQuery, "similar:") {
-				cat.logger.Debug().Msgf("searching %s similarities for: %s", stat.lastSearchType, stat.lastQuery)
-				result, sErr = cat.Search("", filter, vector, searchType, int64(len(stat.result)), stat.config.maxResults)
+				logger.Debug().Msgf("searching %v similarities for: %s", stat.lastSearchType, stat.lastQuery)
+				result, sErr = cat.Search(ctx, "", filter, vector, searchType, int64(len(stat.result)), stat.config.maxResults)
+			} else if stat.lastStructured != nil {
+				logger.Debug().Msgf("searching for: %+v", stat.lastStructured)
+				result, sErr = cat.StructuredSearch(ctx, stat.lastStructured, filter, stat.lastVector, stat.lastSearchType, int64(len(stat.result)), stat.config.maxResults)
 			} else {
-				cat.logger.Debug().Msgf("searching for: %s", stat.lastQuery)
-				result, sErr = cat.Search(stat.lastQuery, filter, stat.lastVector, stat.lastSearchType, int64(len(stat.result)), stat.config.maxResults)
+				logger.Debug().Msgf("searching for: %s", stat.lastQuery)
+				result, sErr = cat.Search(ctx, stat.lastQuery, filter, stat.lastVector, stat.lastSearchType, int64(len(stat.result)), stat.config.maxResults)
 			}
 			if sErr != nil {
-				cat.logger.Error().Msgf("Error searching: %v", sErr)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error searching: %v", sErr)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
+				entry.Error = sErr.Error()
+				logger.Error().Msgf("Error searching: %v", sErr)
+				if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error searching", sErr)); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
 				}
 				return
 			}
+			entry.Total = result.Total
 
-			embeds, err := cat.Result2MessageEmbed(result, stat)
+			embeds, err := cat.storeResults(i.Channel(), resultDocs(result, stat.lastStructured), result.Total, nil)
 			if err != nil {
-				cat.logger.Error().Msgf("Error creating response: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error creating response: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
+				logger.Error().Msgf("Error creating response: %v", err)
+				if err := i.SendChannelMessage(fmt.Sprintf("Error creating response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
 				}
 				return
 			}
-			if stat.result == nil {
-				stat.result = []*schema.UBSchema{}
-			}
-			for _, entry := range result.Docs {
-				stat.result = append(stat.result, entry)
-			}
-			if err := i.SendChannelEmbeds(embeds); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
-				if err := i.SendChannelMessage(fmt.Sprintf("Error sending response: %v", err)); err != nil {
-					cat.logger.Error().Msgf("Error sending response: %v", err)
+			if err := i.SendChannelCards(embeds); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+				if err := i.SendChannelMessage(fmt.Sprintf("Error sending response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
 				}
 				return
 			}
-		}()
+		})
 	}
 	return
 }
 
-func (cat *Catalog) CommandResultSize() (cmdFunc discord.CommandCreate, appCmd *discordgo.ApplicationCommand) {
-	appCmd = &discordgo.ApplicationCommand{
+func (cat *Catalog) CommandResultSize() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
 		Name:        cat.prefix + "resultsize",
 		Description: "number of items in search result set",
-		Options: []*discordgo.ApplicationCommandOption{
+		Options: []*chat.OptionDefinition{
 			{
-				Type:        discordgo.ApplicationCommandOptionInteger,
+				Type:        chat.OptionInteger,
 				Name:        "size",
 				Description: "Size of search result set",
 				Required:    true,
 			},
 		},
 	}
-	cmdFunc = func(i *discord.Interaction) {
-		data := i.ApplicationCommandData()
-		if len(data.Options) < 1 {
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		defer cat.endCommand(ctx, entry)
+		if len(i.Options()) < 1 {
 			if err := i.SendInteractionResponseMessage("Please provide result size"); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
 			return
 		}
-		size := data.Options[0].IntValue()
+		size := i.Options()[0].IntValue()
 		if size < 1 || size > maxResultSize {
 			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Invalid result size %d. must be in (0,%d]", size, maxResultSize)); err != nil {
-				cat.logger.Error().Msgf("Error sending response: %v", err)
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		if eff := cat.permissions.Effective(i.Guild(), i.Roles(), i.IsGuildAdmin()); !eff.Admin && eff.MaxResults > 0 && size > eff.MaxResults {
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Your roles allow a result size of at most %d", eff.MaxResults)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
 			}
 			return
 		}
-		stat := cat.status.Get(i.ChannelID)
-		stat.config.maxResults = size
+		cat.status.Update(i.Channel(), func(stat *channelStatus) {
+			stat.config.maxResults = size
+		})
 
 		if err := i.SendInteractionResponseMessage(fmt.Sprintf("Result size set to %d", size)); err != nil {
-			cat.logger.Error().Msgf("Error sending response: %v", err)
+			logger.Error().Msgf("Error sending response: %v", err)
 		}
 	}
 	return
 }
 
-func (cat *Catalog) InitCommands(session *discord.Session) error {
-	var cmdFunc discord.CommandCreate
-	var appCmd *discordgo.ApplicationCommand
-
-	cmdFunc, appCmd = cat.CommandResultSize()
-	if err := session.ApplicationCommandCreate(cmdFunc, appCmd); err != nil {
-		return errors.Wrap(err, "cannot create resultsize command")
-	}
-
-	cmdFunc, appCmd = cat.CommandMagic()
-	if err := session.ApplicationCommandCreate(cmdFunc, appCmd); err != nil {
-		return errors.Wrap(err, "cannot create magic command")
-	}
-
-	cmdFunc, appCmd = cat.CommandSearch()
-	if err := session.ApplicationCommandCreate(cmdFunc, appCmd); err != nil {
-		return errors.Wrap(err, "cannot create search command")
-	}
-
-	cmdFunc, appCmd = cat.CommandSearchKNN()
-	if err := session.ApplicationCommandCreate(cmdFunc, appCmd); err != nil {
-		return errors.Wrap(err, "cannot create search command")
-	}
-
-	cmdFunc, appCmd = cat.CommandSimilar()
-	if err := session.ApplicationCommandCreate(cmdFunc, appCmd); err != nil {
-		return errors.Wrap(err, "cannot create similar command")
-	}
-
-	cmdFunc, appCmd = cat.CommandSimilarKNN()
-	if err := session.ApplicationCommandCreate(cmdFunc, appCmd); err != nil {
-		return errors.Wrap(err, "cannot create similar command")
+func (cat *Catalog) declareCommands() []*chat.Command {
+	commands := []*chat.Command{}
+	for _, command := range []func() (chat.Handler, *chat.CommandDefinition){
+		cat.CommandResultSize,
+		cat.CommandLayout,
+		cat.CommandMagic,
+		cat.CommandSearch,
+		cat.CommandSearchKNN,
+		cat.CommandSimilar,
+		cat.CommandSimilarKNN,
+		cat.CommandMore,
+		cat.CommandText,
+		cat.CommandExplain,
+		cat.CommandResearch,
+		cat.CommandSummarize,
+		cat.CommandList,
+		cat.CommandHistory,
+		cat.CommandCancel,
+		cat.CommandCache,
+		cat.CommandReload,
+		cat.CommandRawQuery,
+		cat.CommandHelp,
+	} {
+		cmdFunc, appCmd := command()
+		commands = append(commands, &chat.Command{
+			Definition: appCmd,
+			Handler:    cmdFunc,
+			Help:       commandHelps[strings.TrimPrefix(appCmd.Name, cat.prefix)],
+		})
 	}
+	return commands
+}
 
-	cmdFunc, appCmd = cat.CommandMore()
-	if err := session.ApplicationCommandCreate(cmdFunc, appCmd); err != nil {
-		return errors.Wrap(err, "cannot create more command")
-	}
+func (cat *Catalog) Commands() []*chat.Command {
+	return slices.Clone(cat.commands)
+}
 
-	cmdFunc, appCmd = cat.CommandText()
-	if err := session.ApplicationCommandCreate(cmdFunc, appCmd); err != nil {
-		return errors.Wrap(err, "cannot create text command")
+// Command returns the command with the given name, the prefix is optional
+func (cat *Catalog) Command(name string) *chat.Command {
+	for _, cmd := range cat.commands {
+		if cmd.Definition.Name == name || cmd.Definition.Name == cat.prefix+name {
+			return cmd
+		}
 	}
 	return nil
 }
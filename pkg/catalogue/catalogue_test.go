@@ -0,0 +1,230 @@
+package catalogue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/permission"
+	"github.com/je4/ub-bot/v2/pkg/queue"
+	"github.com/je4/ub-bot/v2/pkg/templates"
+	"github.com/je4/ubcat/v2/pkg/index"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+const testTotal = 1000
+
+// fakeRequest is a chat request which records the answers
+type fakeRequest struct {
+	command string
+	options []*chat.Option
+	channel string
+	sync.Mutex
+	messages []string
+	cards    [][]*chat.Card
+}
+
+func (r *fakeRequest) Context() context.Context      { return context.Background() }
+func (r *fakeRequest) CommandName() string           { return r.command }
+func (r *fakeRequest) Options() []*chat.Option       { return r.options }
+func (r *fakeRequest) Channel() string               { return r.channel }
+func (r *fakeRequest) Guild() string                 { return "guild" }
+func (r *fakeRequest) UserID() string                { return "user" }
+func (r *fakeRequest) UserName() string              { return "user" }
+func (r *fakeRequest) Roles() []string               { return nil }
+func (r *fakeRequest) IsGuildAdmin() bool            { return false }
+func (r *fakeRequest) ChannelTopic() (string, error) { return "", nil }
+
+func (r *fakeRequest) SendInteractionResponseMessage(msg string) error {
+	return r.SendChannelMessage(msg)
+}
+
+func (r *fakeRequest) SendInteractionResponseCards(cards []*chat.Card) error {
+	return r.SendChannelCards(cards)
+}
+
+func (r *fakeRequest) SendChannelMessage(msg string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.messages = append(r.messages, msg)
+	return nil
+}
+
+func (r *fakeRequest) SendChannelCards(cards []*chat.Card) error {
+	r.Lock()
+	defer r.Unlock()
+	r.cards = append(r.cards, cards)
+	return nil
+}
+
+func (r *fakeRequest) SendChannelCardsWithFiles(cards []*chat.Card, files []*chat.File) error {
+	return r.SendChannelCards(cards)
+}
+
+// elasticStub answers searches with the hits <query>-<position> of a result of testTotal hits
+func elasticStub(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			From  int `json:"from"`
+			Size  int `json:"size"`
+			Query struct {
+				Bool struct {
+					Must []struct {
+						SimpleQueryString struct {
+							Query string `json:"query"`
+						} `json:"simple_query_string"`
+					} `json:"must"`
+				} `json:"bool"`
+			} `json:"query"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || len(body.Query.Bool.Must) != 1 {
+			t.Errorf("unexpected search request: %v", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query := body.Query.Bool.Must[0].SimpleQueryString.Query
+		// searches overlap with the commands sent meanwhile
+		time.Sleep(time.Millisecond)
+		hits := []map[string]any{}
+		for pos := body.From; pos < min(body.From+body.Size, testTotal); pos++ {
+			hits = append(hits, map[string]any{
+				"_index":  "test",
+				"_id":     fmt.Sprintf("%s-%d", query, pos),
+				"_score":  testTotal - pos,
+				"_source": map[string]any{},
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		if err := json.NewEncoder(w).Encode(map[string]any{
+			"took":      1,
+			"timed_out": false,
+			"_shards":   map[string]any{"total": 1, "successful": 1, "skipped": 0, "failed": 0},
+			"hits": map[string]any{
+				"total": map[string]any{"value": testTotal, "relation": "eq"},
+				"hits":  hits,
+			},
+		}); err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func newTestCatalog(t *testing.T, elasticURL string) *Catalog {
+	t.Helper()
+	elastic, err := elasticsearch.NewTypedClient(elasticsearch.Config{Addresses: []string{elasticURL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zerolog.Nop()
+	cards, err := templates.NewRegistry(fstest.MapFS{
+		"card.gotmpl": {Data: []byte("{{.Num}} {{.ID}}")},
+	}, "card", &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	perms, err := permission.NewPermissions("", "ub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := queue.NewQueue(4, 0)
+	t.Cleanup(q.Close)
+	return &Catalog{
+		elastic:      elastic,
+		elasticIndex: "test",
+		ubClient:     index.NewClient("test", elastic),
+		logger:       &logger,
+		status:       newStatusStore(maxChannelStates, channelStateTTL),
+		prefix:       "ub",
+		cards:        cards,
+		permissions:  perms,
+		queue:        q,
+	}
+}
+
+func TestPagingConcurrent(t *testing.T) {
+	srv := elasticStub(t)
+	defer srv.Close()
+	cat := newTestCatalog(t, srv.URL)
+	search, _ := cat.CommandSearch()
+	more, _ := cat.CommandMore()
+	resultSize, _ := cat.CommandResultSize()
+
+	const channels = 3
+	const rounds = 20
+	requests := []*fakeRequest{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	run := func(handler chat.Handler, r *fakeRequest) {
+		mutex.Lock()
+		requests = append(requests, r)
+		mutex.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler(r)
+		}()
+	}
+	searchRequest := func(channelID, query string) *fakeRequest {
+		return &fakeRequest{command: "ubsearch", channel: channelID, options: []*chat.Option{{Name: "query", Value: query}, {Name: "querytype", Value: "simple"}}}
+	}
+	// every channel starts with a search, so that /more finds results
+	for c := 0; c < channels; c++ {
+		run(search, searchRequest(fmt.Sprintf("channel-%d", c), "start"))
+	}
+	wg.Wait()
+	cat.inFlight.Wait()
+	for n := 0; n < rounds; n++ {
+		for c := 0; c < channels; c++ {
+			channelID := fmt.Sprintf("channel-%d", c)
+			run(resultSize, &fakeRequest{command: "ubresultsize", channel: channelID, options: []*chat.Option{{Name: "size", Value: int64(n%7 + 1)}}})
+			if n%5 == 4 {
+				run(search, searchRequest(channelID, fmt.Sprintf("q%d", n)))
+			}
+			run(more, &fakeRequest{command: "ubmore", channel: channelID})
+		}
+	}
+	wg.Wait()
+	cat.inFlight.Wait()
+
+	for c := 0; c < channels; c++ {
+		stat := cat.status.Get(fmt.Sprintf("channel-%d", c))
+		if stat.lastQuery == "" || len(stat.result) == 0 {
+			t.Fatalf("channel-%d: no search results", c)
+		}
+		// the results of the channel are the consecutive pages of its last search
+		for pos, doc := range stat.result {
+			if want := fmt.Sprintf("%s-%d", stat.lastQuery, pos); doc.Id_ != want {
+				t.Fatalf("channel-%d: result %d is %s, want %s", c, pos, doc.Id_, want)
+			}
+		}
+	}
+	for _, r := range requests {
+		for _, msg := range r.messages {
+			if strings.HasPrefix(msg, "Error") {
+				t.Errorf("%s in %s: %s", r.command, r.channel, msg)
+			}
+		}
+		// every result is numbered with its position in the result list of its search
+		for _, cards := range r.cards {
+			for _, card := range cards[1:] {
+				var num int
+				var id string
+				if _, err := fmt.Sscanf(card.Description, "%d %s", &num, &id); err != nil {
+					t.Fatalf("unexpected card %q", card.Description)
+				}
+				if !strings.HasSuffix(id, fmt.Sprintf("-%d", num)) {
+					t.Errorf("%s in %s: result %s numbered %d", r.command, r.channel, id, num)
+				}
+			}
+		}
+	}
+}
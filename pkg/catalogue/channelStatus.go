@@ -1,11 +1,24 @@
 package catalogue
 
 import (
+	"container/list"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/llm"
 	"github.com/je4/ubcat/v2/pkg/schema"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	maxChannelStates = 1000
+	channelStateTTL  = 24 * time.Hour
 )
 
 type channelConfig struct {
 	maxResults int64
+	// compact lists the results instead of one card per result
+	compact bool
 }
 type channelStatus struct {
 	config         channelConfig
@@ -13,22 +26,136 @@ type channelStatus struct {
 	lastQuery      string
 	lastSearchType SearchType
 	lastVector     []float32
-	searchFunc     string
+	// lastStructured is the structured query of the last magic search
+	lastStructured *llm.StructuredQuery
+	// lastMatch are the keyword options of the last similarity search
+	lastMatch  *similarMatch
+	searchFunc string
+}
+
+func newChannelStatus() *channelStatus {
+	return &channelStatus{
+		config: channelConfig{
+			maxResults: defaultResultSize,
+		},
+		result: []*schema.UBSchema{},
+	}
+}
+
+// clone copies the status, so that it can be read without holding the store lock
+func (stat *channelStatus) clone() *channelStatus {
+	c := *stat
+	c.result = slices.Clone(stat.result)
+	return &c
+}
+
+// channelStatus returns a copy of the channel state of the interaction.
+// the result size is limited to the maximum allowed by the user's roles
+func (cat *Catalog) channelStatus(i chat.Request) *channelStatus {
+	stat := cat.status.Get(i.Channel())
+	if eff := cat.permissions.Effective(i.Guild(), i.Roles(), i.IsGuildAdmin()); !eff.Admin && eff.MaxResults > 0 && stat.config.maxResults > eff.MaxResults {
+		stat.config.maxResults = eff.MaxResults
+	}
+	return stat
+}
+
+type statusEntry struct {
+	channelID string
+	stat      *channelStatus
+	lastUsed  time.Time
 }
 
-type cStatus map[string]*channelStatus
+// newStatusStore creates a concurrency-safe store for the channel states.
+// the least recently used states are evicted if there are more than maxEntries
+// or if they have not been used for ttl
+func newStatusStore(maxEntries int, ttl time.Duration) *statusStore {
+	return &statusStore{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+type statusStore struct {
+	sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	// lru holds the *statusEntry, most recently used first
+	lru *list.List
+}
 
-func (c cStatus) Get(channelID string) *channelStatus {
-	if stat, ok := c[channelID]; !ok {
-		stat = &channelStatus{
-			config: channelConfig{
-				maxResults: defaultResultSize,
-			},
-			result: []*schema.UBSchema{},
+// Get returns a copy of the channel state. changes to the copy are not stored, use Update for that
+func (s *statusStore) Get(channelID string) *channelStatus {
+	s.Lock()
+	defer s.Unlock()
+	s.evict()
+	elem, ok := s.entries[channelID]
+	if !ok {
+		return newChannelStatus()
+	}
+	entry := elem.Value.(*statusEntry)
+	entry.lastUsed = time.Now()
+	s.lru.MoveToFront(elem)
+	return entry.stat.clone()
+}
+
+// Update atomically modifies the channel state with f and returns a copy of the result.
+// f must not call other methods of the store
+func (s *statusStore) Update(channelID string, f func(stat *channelStatus)) *channelStatus {
+	s.Lock()
+	defer s.Unlock()
+	s.evict()
+	elem, ok := s.entries[channelID]
+	if !ok {
+		elem = s.lru.PushFront(&statusEntry{
+			channelID: channelID,
+			stat:      newChannelStatus(),
+		})
+		s.entries[channelID] = elem
+	}
+	entry := elem.Value.(*statusEntry)
+	entry.lastUsed = time.Now()
+	s.lru.MoveToFront(elem)
+	f(entry.stat)
+	// make room after the insert, but never evict the updated channel
+	for s.maxEntries > 0 && s.lru.Len() > s.maxEntries && s.lru.Back() != elem {
+		s.remove(s.lru.Back())
+	}
+	return entry.stat.clone()
+}
+
+func (s *statusStore) Delete(channelID string) {
+	s.Lock()
+	defer s.Unlock()
+	if elem, ok := s.entries[channelID]; ok {
+		s.remove(elem)
+	}
+}
+
+func (s *statusStore) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	s.evict()
+	return s.lru.Len()
+}
+
+// evict removes expired states. the lock must be held by the caller
+func (s *statusStore) evict() {
+	if s.ttl <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-s.ttl)
+	for elem := s.lru.Back(); elem != nil; elem = s.lru.Back() {
+		if elem.Value.(*statusEntry).lastUsed.After(deadline) {
+			return
 		}
-		c[channelID] = stat
-		return stat
-	} else {
-		return stat
+		s.remove(elem)
 	}
 }
+
+func (s *statusStore) remove(elem *list.Element) {
+	s.lru.Remove(elem)
+	delete(s.entries, elem.Value.(*statusEntry).channelID)
+}
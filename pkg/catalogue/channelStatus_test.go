@@ -0,0 +1,122 @@
+package catalogue
+
+import (
+	"fmt"
+	"github.com/je4/ubcat/v2/pkg/schema"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatusStoreConcurrentUpdate(t *testing.T) {
+	s := newStatusStore(10, time.Hour)
+	const workers = 8
+	const updates = 100
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			channelID := fmt.Sprintf("channel-%d", w%2)
+			for n := 0; n < updates; n++ {
+				s.Update(channelID, func(stat *channelStatus) {
+					stat.result = append(stat.result, &schema.UBSchema{})
+					stat.lastQuery = fmt.Sprintf("query %d", n)
+				})
+				stat := s.Get(channelID)
+				// the copy may be modified without affecting the store
+				stat.result = append(stat.result, &schema.UBSchema{})
+				stat.config.maxResults = 1
+			}
+		}(w)
+	}
+	wg.Wait()
+	for c := 0; c < 2; c++ {
+		stat := s.Get(fmt.Sprintf("channel-%d", c))
+		if got, want := len(stat.result), workers/2*updates; got != want {
+			t.Errorf("channel-%d: %d results, want %d", c, got, want)
+		}
+		if stat.config.maxResults != defaultResultSize {
+			t.Errorf("channel-%d: changed copy modified the store", c)
+		}
+	}
+}
+
+func TestStatusStoreGetUnknown(t *testing.T) {
+	s := newStatusStore(10, time.Hour)
+	stat := s.Get("unknown")
+	if stat.config.maxResults != defaultResultSize || len(stat.result) != 0 {
+		t.Errorf("unexpected default state %+v", stat)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Get stored a state, %d entries", s.Len())
+	}
+}
+
+func TestStatusStoreTTL(t *testing.T) {
+	s := newStatusStore(10, 200*time.Millisecond)
+	s.Update("old", func(stat *channelStatus) {
+		stat.lastQuery = "old"
+	})
+	time.Sleep(120 * time.Millisecond)
+	s.Update("new", func(stat *channelStatus) {
+		stat.lastQuery = "new"
+	})
+	time.Sleep(120 * time.Millisecond)
+	if got := s.Len(); got != 1 {
+		t.Fatalf("%d entries after ttl of one entry, want 1", got)
+	}
+	if got := s.Get("old").lastQuery; got != "" {
+		t.Errorf("expired state still available: %s", got)
+	}
+	if got := s.Get("new").lastQuery; got != "new" {
+		t.Errorf("state not expired yet is missing: %s", got)
+	}
+}
+
+func TestStatusStoreLRU(t *testing.T) {
+	s := newStatusStore(3, time.Hour)
+	for _, channelID := range []string{"a", "b", "c"} {
+		s.Update(channelID, func(stat *channelStatus) {
+			stat.lastQuery = channelID
+		})
+	}
+	// a becomes the most recently used, b is evicted next
+	s.Get("a")
+	s.Update("d", func(stat *channelStatus) {
+		stat.lastQuery = "d"
+	})
+	if got := s.Len(); got != 3 {
+		t.Fatalf("%d entries, want 3", got)
+	}
+	for channelID, want := range map[string]string{"a": "a", "b": "", "c": "c", "d": "d"} {
+		if got := s.Get(channelID).lastQuery; got != want {
+			t.Errorf("channel %s: last query %q, want %q", channelID, got, want)
+		}
+	}
+}
+
+func TestStatusStoreConcurrentEviction(t *testing.T) {
+	s := newStatusStore(5, time.Millisecond)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				channelID := fmt.Sprintf("channel-%d", (w+n)%20)
+				s.Update(channelID, func(stat *channelStatus) {
+					stat.lastQuery = channelID
+				})
+				if stat := s.Get(channelID); stat.lastQuery != "" && stat.lastQuery != channelID {
+					t.Errorf("channel %s has state of %s", channelID, stat.lastQuery)
+				}
+				s.Len()
+			}
+		}(w)
+	}
+	wg.Wait()
+	if got := s.Len(); got > 5 {
+		t.Errorf("%d entries, at most 5 allowed", got)
+	}
+}
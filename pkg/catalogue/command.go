@@ -0,0 +1,135 @@
+package catalogue
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/analytics"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/queue"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// beginCommand registers the invocation as in-flight and starts its span and analytics entry.
+// every beginCommand must be finished by endCommand
+func (cat *Catalog) beginCommand(i chat.Request) (context.Context, *analytics.Entry) {
+	cat.inFlight.Add(1)
+	ctx, span := tracing.Start(i.Context(), "command "+i.CommandName())
+	span.SetAttributes(attribute.String("discord.channel_id", i.Channel()))
+	entry := &analytics.Entry{
+		Time:      time.Now(),
+		Command:   i.CommandName(),
+		Options:   map[string]string{},
+		GuildID:   i.Guild(),
+		ChannelID: i.Channel(),
+		TraceID:   tracing.TraceID(ctx),
+	}
+	for _, opt := range i.Options() {
+		entry.Options[opt.Name] = fmt.Sprintf("%v", opt.Value)
+	}
+	entry.UserID = i.UserID()
+	entry.UserName = i.UserName()
+	return ctx, entry
+}
+
+func (cat *Catalog) endCommand(ctx context.Context, entry *analytics.Entry) {
+	defer cat.inFlight.Done()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("search.type", entry.SearchType),
+		attribute.Int64("search.total", entry.Total),
+	)
+	if entry.Error != "" {
+		span.SetStatus(codes.Error, entry.Error)
+	}
+	span.End()
+	latency := time.Since(entry.Time)
+	cat.metrics.ObserveCommand(entry.Command, entry.SearchType, entry.Error != "", latency)
+	if cat.analytics == nil {
+		return
+	}
+	entry.LatencyMS = latency.Milliseconds()
+	if err := cat.analytics.Add(entry); err != nil {
+		tracing.Logger(ctx, cat.logger).Error().Msgf("Error writing analytics entry: %v", err)
+	}
+}
+
+// enqueue schedules job in the queue of the channel. the job must finish the command with endCommand.
+// if the job has to wait, the interaction is answered with the queue position.
+// returns false if the queue is full, the command is not finished then
+func (cat *Catalog) enqueue(ctx context.Context, i chat.Request, entry *analytics.Entry, job func()) bool {
+	logger := tracing.Logger(ctx, cat.logger)
+	position, err := cat.queue.Submit(i.Channel(), job, func() {
+		entry.Error = "removed from queue"
+		if err := i.SendChannelMessage(fmt.Sprintf("Queued /%s removed", entry.Command)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+		cat.endCommand(ctx, entry)
+	})
+	if err != nil {
+		entry.Error = err.Error()
+		logger.Warn().Msgf("Cannot queue command: %v", err)
+		msg := fmt.Sprintf("Cannot queue command: %v", err)
+		if errors.Is(err, queue.ErrQueueFull) {
+			msg = fmt.Sprintf("Too many searches waiting in this channel, please try again later or use /%scancel", cat.prefix)
+		}
+		if err := i.SendInteractionResponseMessage(msg); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+		return false
+	}
+	if position > 0 {
+		logger.Debug().Msgf("command queued at position %d", position)
+		if err := i.SendInteractionResponseMessage(fmt.Sprintf("Queued at position %d, use /%scancel to abort", position, cat.prefix)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+	}
+	return true
+}
+
+// Drain waits for all in-flight commands to finish or for ctx to be done.
+// afterwards the queue is closed, commands still waiting are removed and their users informed
+func (cat *Catalog) Drain(ctx context.Context) error {
+	defer cat.queue.Close()
+	done := make(chan struct{})
+	go func() {
+		cat.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "cannot drain in-flight commands")
+	}
+}
+
+func (cat *Catalog) Ping(ctx context.Context) error {
+	ok, err := cat.elastic.Ping().Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot ping elastic")
+	}
+	if !ok {
+		return errors.New("elastic ping failed")
+	}
+	return nil
+}
+
+func searchTypeName(searchType SearchType) string {
+	switch searchType {
+	case SearchTypeSimple:
+		return "simple"
+	case SearchTypeEmbeddingMARC:
+		return "marc"
+	case SearchTypeEmbeddingProse:
+		return "prose"
+	case SearchTypeEmbeddingJSON:
+		return "json"
+	default:
+		return fmt.Sprintf("unknown(%d)", searchType)
+	}
+}
@@ -0,0 +1,370 @@
+package catalogue
+
+import (
+	"bytes"
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"github.com/je4/ubcat/v2/pkg/schema"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// explainRequest rebuilds the last search of the channel, restricted to a single document
+func (cat *Catalog) explainRequest(stat *channelStatus, filter map[string]string, docID string) (*search.Request, error) {
+	idsQuery := types.Query{
+		Ids: &types.IdsQuery{
+			Values: []string{docID},
+		},
+	}
+	if stat.lastStructured != nil {
+		return cat.explainStructuredRequest(stat, filter, idsQuery)
+	}
+	if stat.lastMatch != nil {
+		return cat.explainSimilarRequest(stat, filter, docID)
+	}
+	searchRequest := &search.Request{}
+	switch stat.searchFunc {
+	case cat.prefix + "searchknn":
+		field, err := vectorField(stat.lastSearchType)
+		if err != nil {
+			return nil, err
+		}
+		if stat.lastVector == nil {
+			return nil, errors.Errorf("no vector available for last search")
+		}
+		searchRequest.Knn = []types.KnnQuery{{
+			Field:         field,
+			QueryVector:   stat.lastVector,
+			K:             stat.config.maxResults,
+			NumCandidates: stat.config.maxResults,
+			Filter:        append(wildcardFilter(filter), idsQuery),
+		}}
+	case cat.prefix + "search":
+		esMust := []types.Query{}
+		if stat.lastSearchType != SearchTypeSimple {
+			field, err := vectorField(stat.lastSearchType)
+			if err != nil {
+				return nil, err
+			}
+			if stat.lastVector == nil {
+				return nil, errors.Errorf("no vector available for last search")
+			}
+			vQuery, err := vectorQuery(stat.lastVector, field)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot create vector query")
+			}
+			esMust = append(esMust, *vQuery)
+		}
+		esMust = append(esMust, wildcardFilter(filter)...)
+		if stat.lastQuery != "" && len(esMust) == 0 {
+			esMust = append(esMust, types.Query{
+				SimpleQueryString: &types.SimpleQueryStringQuery{
+					Query: stat.lastQuery,
+				},
+			})
+		}
+		searchRequest.Query = &types.Query{
+			Bool: &types.BoolQuery{
+				Filter: []types.Query{idsQuery},
+				Must:   esMust,
+			},
+		}
+	default:
+		return nil, errors.Errorf("search \"%s\" cannot be explained", stat.searchFunc)
+	}
+	return searchRequest, nil
+}
+
+// explainStructuredRequest rebuilds the last magic search of the channel, restricted by idsQuery
+func (cat *Catalog) explainStructuredRequest(stat *channelStatus, filter map[string]string, idsQuery types.Query) (*search.Request, error) {
+	switch stat.searchFunc {
+	case cat.prefix + "searchknn":
+		searchRequest, err := structuredKNNRequest(stat.lastStructured, filter, stat.lastVector, stat.lastSearchType, stat.config.maxResults, stat.config.maxResults)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create structured knn request")
+		}
+		searchRequest.Knn[0].Filter = append(searchRequest.Knn[0].Filter, idsQuery)
+		return searchRequest, nil
+	case cat.prefix + "search":
+		searchRequest, err := structuredRequest(stat.lastStructured, filter, stat.lastVector, stat.lastSearchType)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create structured request")
+		}
+		// a single document needs no sort
+		searchRequest.Sort = nil
+		searchRequest.Query.Bool.Filter = append(searchRequest.Query.Bool.Filter, idsQuery)
+		return searchRequest, nil
+	default:
+		return nil, errors.Errorf("search \"%s\" cannot be explained", stat.searchFunc)
+	}
+}
+
+// explainSimilarRequest rebuilds the last similarity search of the channel, restricted to a single document.
+// the boost of a knn search is explained by the request which rescores the neighbours
+func (cat *Catalog) explainSimilarRequest(stat *channelStatus, filter map[string]string, docID string) (*search.Request, error) {
+	match := stat.lastMatch
+	if stat.searchFunc == cat.prefix+"similarknn" && (match.query == "" || match.restrict) {
+		searchRequest, err := similarKNNRequest(match, filter, stat.lastVector, stat.lastSearchType, stat.config.maxResults, stat.config.maxResults)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create similar knn request")
+		}
+		searchRequest.Knn[0].Filter = append(searchRequest.Knn[0].Filter, types.Query{
+			Ids: &types.IdsQuery{Values: []string{docID}},
+		})
+		return searchRequest, nil
+	}
+	searchRequest, err := similarBoostRequest(match, filter, stat.lastVector, stat.lastSearchType, []string{docID})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create similar request")
+	}
+	return searchRequest, nil
+}
+
+func (cat *Catalog) Explain(ctx context.Context, stat *channelStatus, filter map[string]string, docID string) (result *types.Explanation, resultErr error) {
+	ctx, span := tracing.Start(ctx, "elastic.Explain")
+	defer func() { tracing.End(span, resultErr) }()
+	searchRequest, err := cat.explainRequest(stat, filter, docID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create explain request")
+	}
+	if err := cat.elasticLimit.Acquire(ctx); err != nil {
+		return nil, errors.Wrap(err, "cannot query elastic")
+	}
+	start := time.Now()
+	res, err := cat.elastic.Search().
+		Index(cat.elasticIndex).
+		SourceExcludes_("embedding_marc", "embedding_json", "embedding_prose").
+		Request(searchRequest).
+		Explain(true).
+		Size(1).
+		Do(ctx)
+	cat.elasticLimit.Release()
+	if err != nil {
+		cat.metrics.ObserveElastic("explain", err, 0, time.Since(start))
+		return nil, errors.Wrap(err, "cannot search")
+	}
+	cat.metrics.ObserveElastic("explain", nil, int64(len(res.Hits.Hits)), time.Since(start))
+	if len(res.Hits.Hits) == 0 {
+		return nil, errors.Errorf("document %s does not match the last search", docID)
+	}
+	if res.Hits.Hits[0].Explanation_ == nil {
+		return nil, errors.Errorf("no explanation returned for document %s", docID)
+	}
+	return res.Hits.Hits[0].Explanation_, nil
+}
+
+type explainContribution struct {
+	description string
+	value       float32
+}
+
+type explainSummary struct {
+	terms   []explainContribution
+	vectors []explainContribution
+	filters []explainContribution
+}
+
+var explainTermRegexp = regexp.MustCompile(`^weight\((.+?) in \d+\)`)
+var explainFilterRegexp = regexp.MustCompile(`^ConstantScore\((.+)\)`)
+
+func (s *explainSummary) walk(description string, value float32, details []types.ExplanationDetail) {
+	switch {
+	case explainTermRegexp.MatchString(description):
+		s.terms = append(s.terms, explainContribution{
+			description: explainTermRegexp.FindStringSubmatch(description)[1],
+			value:       value,
+		})
+		// the details only contain the bm25 computation
+		return
+	case strings.Contains(description, "cosineSimilarity") || strings.Contains(description, "script score function") || strings.Contains(description, "within top k"):
+		s.vectors = append(s.vectors, explainContribution{
+			description: description,
+			value:       value,
+		})
+		return
+	case explainFilterRegexp.MatchString(description):
+		s.filters = append(s.filters, explainContribution{
+			description: explainFilterRegexp.FindStringSubmatch(description)[1],
+			value:       value,
+		})
+		return
+	case strings.HasPrefix(description, "#") || strings.HasPrefix(description, "*:*"):
+		s.filters = append(s.filters, explainContribution{
+			description: description,
+			value:       value,
+		})
+		return
+	}
+	for _, detail := range details {
+		s.walk(detail.Description, detail.Value, detail.Details)
+	}
+}
+
+func summarizeExplanation(explanation *types.Explanation) *explainSummary {
+	summary := &explainSummary{}
+	summary.walk(explanation.Description, explanation.Value, explanation.Details)
+	sort.Slice(summary.terms, func(i, j int) bool {
+		return summary.terms[i].value > summary.terms[j].value
+	})
+	return summary
+}
+
+func contributionField(name string, contributions []explainContribution, empty string) *chat.CardField {
+	lines := []string{}
+	for _, c := range contributions {
+		line := fmt.Sprintf("`%s` %.4f", c.description, c.value)
+		lines = append(lines, chat.Truncate(line, 200))
+	}
+	value := strings.Join(lines, "\n")
+	if value == "" {
+		value = empty
+	}
+	return &chat.CardField{
+		Name:  name,
+		Value: chat.Truncate(value, 1024),
+	}
+}
+
+func (cat *Catalog) Explanation2MessageEmbed(entry *schema.UBSchema, resultID string, explanation *types.Explanation) *chat.Card {
+	summary := summarizeExplanation(explanation)
+	embed := &chat.Card{
+		Author: &chat.CardAuthor{
+			Name: fmt.Sprintf("%s - %f - %s", resultID, entry.Score_, entry.Id_),
+		},
+		Title: entry.GetMainTitle(),
+		Fields: []*chat.CardField{
+			{
+				Name:  "Score",
+				Value: fmt.Sprintf("%f", explanation.Value),
+			},
+			contributionField("Term Contributions (BM25)", summary.terms, "no term matches"),
+			contributionField("Vector Similarity", summary.vectors, "no vector similarity"),
+			contributionField("Filter Matches", summary.filters, "no filters"),
+		},
+	}
+	return embed
+}
+
+func (cat *Catalog) CommandExplain() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "explain",
+		Description: "explain the score of a result from the last search",
+		Options: []*chat.OptionDefinition{
+			{
+				Type:        chat.OptionString,
+				Name:        "resultid",
+				Description: "Result ID from previous search or full elastic id",
+				Required:    true,
+			},
+		},
+	}
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		logger.Debug().Msgf("command name: %s", i.CommandName())
+		async := false
+		defer func() {
+			if !async {
+				cat.endCommand(ctx, entry)
+			}
+		}()
+		if len(i.Options()) < 1 {
+			if err := i.SendInteractionResponseMessage("Please provide result ID"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+
+		resultIDStr := i.Options()[0].StringValue()
+		stat := cat.channelStatus(i)
+		if stat.searchFunc == "" {
+			if err := i.SendInteractionResponseMessage("No search available"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		var lastResult *schema.UBSchema
+		if resultID, err := strconv.Atoi(resultIDStr); err == nil && resultID < 100 {
+			if resultID < 0 || resultID >= len(stat.result) {
+				if err := i.SendInteractionResponseMessage("Invalid result ID"); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			lastResult = stat.result[resultID]
+		} else {
+			for _, entry := range stat.result {
+				if entry.Id_ == resultIDStr {
+					lastResult = entry
+					break
+				}
+			}
+			if lastResult == nil {
+				lastResult = &schema.UBSchema{Id_: resultIDStr}
+			}
+		}
+
+		topic, err := i.ChannelTopic()
+		if err != nil {
+			logger.Error().Msgf("Error getting channel: %v", err)
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error getting channel: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		filter := FilterFromChannelTopic(topic)
+		entry.Filter = filter
+		entry.SearchType = searchTypeName(stat.lastSearchType)
+
+		if err := i.SendInteractionResponseMessage(fmt.Sprintf("Explaining score of %s for: %s", lastResult.Id_, stat.lastQuery)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+		async = cat.enqueue(ctx, i, entry, func() {
+			defer cat.endCommand(ctx, entry)
+			ctx, release := cat.searchContext(ctx, i.Channel())
+			defer release()
+
+			explanation, err := cat.Explain(ctx, stat, filter, lastResult.Id_)
+			if err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error explaining: %v", err)
+				if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error explaining", err)); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			rawJSON, err := json.MarshalIndent(explanation, "", "  ")
+			if err != nil {
+				logger.Error().Msgf("Error marshalling explanation: %v", err)
+				if err := i.SendChannelMessage(fmt.Sprintf("Error marshalling explanation: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			embed := cat.Explanation2MessageEmbed(lastResult, resultIDStr, explanation)
+			if err := i.SendChannelCardsWithFiles([]*chat.Card{embed}, []*chat.File{
+				{
+					Name:        fmt.Sprintf("explain-%s.json", lastResult.Id_),
+					ContentType: "application/json",
+					Reader:      bytes.NewReader(rawJSON),
+				},
+			}); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+				if err := i.SendChannelMessage(fmt.Sprintf("Error sending response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+		})
+	}
+	return
+}
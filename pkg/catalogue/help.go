@@ -0,0 +1,250 @@
+package catalogue
+
+import (
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"sort"
+	"strings"
+)
+
+const helpConcepts = `**querytype** selects how the query is matched:
+• *simple*: keyword search in the catalogue records
+• *marc vector*, *prose vector*, *json vector*: semantic search with embeddings of the MARC record, a prose description or the JSON record
+**magic** lets the AI translate your question into a query with filters (years, resource type, language, person, subject), a sort order and a suggested query type
+**resultid** is the number in front of a result of the last search (0, 1, 2...) or a full record id`
+
+const helpFilters = "Each line `field:pattern` of the channel topic restricts all searches in the channel, e.g. `category:books*`"
+
+// commandHelps documents the commands by name without prefix
+var commandHelps = map[string]*chat.CommandHelp{
+	"search": {
+		Long:     "Searches the catalogue and shows the first results. Use the result numbers with /similar, /text or /explain. With a vector query type, records with a similar meaning are found even if the words differ.",
+		Examples: []string{"search querytype:simple query:Basler Mission", "search querytype:prose query:history of printing in Basel magic:true", "search query:German maps of Basel before 1800 magic:true"},
+	},
+	"searchknn": {
+		Long:     "Like /search, but uses the approximate nearest neighbour search of Elasticsearch. Faster for vector queries, keyword matches are not combined.",
+		Examples: []string{"searchknn querytype:marc query:maps of Switzerland"},
+	},
+	"similar": {
+		Long:     "Searches records similar to a result of the last search or to a record id, using the stored vector of the record. With positive and negative, the vectors of several records are combined: records similar to the positive and unlike the negative results are found. A modifier text like \"but for children\" is blended into the vector to steer the similarity, weight sets its share. Keywords in query rank matching records higher, or with restrict only matching records are shown. minsimilarity cuts off records with a lower cosine similarity.",
+		Examples: []string{"similar querytype:prose resultid:3", "similar querytype:prose positive:1,4,7 negative:3", "similar querytype:prose resultid:5 modifier:\"but for children\" weight:0.4", "similar querytype:marc resultid:2 query:Basel restrict:true minsimilarity:0.8"},
+	},
+	"similarknn": {
+		Long:     "Like /similar, but uses the approximate nearest neighbour search. Keywords in query only change the ranking of the nearest neighbours.",
+		Examples: []string{"similarknn querytype:json resultid:0"},
+	},
+	"more": {
+		Long:     "Shows the next page of the last /search.",
+		Examples: []string{"more"},
+	},
+	"magic": {
+		Long:     "Shows how the AI would translate your question into a search query with filters, sort order and query type, without searching.",
+		Examples: []string{"magic query:which books about alchemy were printed in Basel?"},
+	},
+	"research": {
+		Long:     "Lets the AI research a question in several steps: it searches the catalogue, reads records and explores similar records, then answers with the records it used. All steps are attached as research-trace.txt. The records can be used with /similar or /text like search results.",
+		Examples: []string{"research question:which early printed books about alchemy does the library hold?"},
+	},
+	"summarize": {
+		Long:     "Lets the AI write an overview of all results loaded so far (including /more pages): main themes, time span, notable authors and gaps. Large result sets are summarized in parts first.",
+		Examples: []string{"summarize"},
+	},
+	"list": {
+		Long:     "Keeps a reading list of records. add and remove take a result number or a full record id, show lists the records as search results, export attaches the records rendered with a template. Personal lists belong to you, with shared:true the list of the channel is used.",
+		Examples: []string{"list action:add resultid:3", "list action:show", "list action:add resultid:5 shared:true", "list action:export format:marc shared:true"},
+	},
+	"text": {
+		Long:     "Shows the source text of the prose or json vector of a record, or the record rendered with any template. The marc text is only an approximation, the MARC serialisation of the indexer is not available. The source and template version are shown below the text, long texts are attached as a file.",
+		Examples: []string{"text resultid:2", "text resultid:2 type:json", "text resultid:2 template:short"},
+	},
+	"explain": {
+		Long:     "Explains the score of a result of the last search: keyword contributions, vector similarity and filter matches.",
+		Examples: []string{"explain resultid:1"},
+	},
+	"history": {
+		Long:     "Lists the last commands of this channel. Searches can be run again by their number.",
+		Examples: []string{"history", "history rerun:2"},
+	},
+	"resultsize": {
+		Long:     "Sets the number of results per page for this channel.",
+		Examples: []string{"resultsize size:20"},
+	},
+	"layout": {
+		Long:     "Shows one card per result with type, date, place, publisher, series, language and subjects, or a compact list of ten results per card. The cards are rendered with editable templates.",
+		Examples: []string{"layout mode:compact", "layout mode:cards"},
+	},
+	"cancel": {
+		Long:     "Aborts the running search of this channel and removes queued searches.",
+		Examples: []string{"cancel"},
+	},
+	"help": {
+		Long:     "Shows an overview of all commands or the details of a single command.",
+		Examples: []string{"help", "help command:search"},
+	},
+	"cache": {
+		Long:     "Shows statistics of the embedding cache or clears it. Administrators only.",
+		Examples: []string{"cache action:stats"},
+	},
+	"reload": {
+		Long:     "Reloads the configuration files. Administrators only.",
+		Examples: []string{"reload"},
+	},
+	"rawquery": {
+		Long:     "Runs an Elasticsearch search request body against the catalogue index. Administrators only.",
+		Examples: []string{`rawquery query:{"query":{"match":{"title":"Basel"}},"size":5}`},
+	},
+}
+
+func optionHelp(opt *chat.OptionDefinition) string {
+	text := opt.Description
+	if opt.Required {
+		text += " (required)"
+	}
+	if len(opt.Choices) > 0 {
+		choices := []string{}
+		for _, choice := range opt.Choices {
+			choices = append(choices, fmt.Sprintf("`%v` (%s)", choice.Value, choice.Name))
+		}
+		text += "\nChoices: " + strings.Join(choices, ", ")
+	}
+	return text
+}
+
+func filterHelp(filter map[string]string) string {
+	if len(filter) == 0 {
+		return "no filters active\n" + helpFilters
+	}
+	keys := []string{}
+	for k := range filter {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := []string{}
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("`%s: %s`", k, filter[k]))
+	}
+	return strings.Join(lines, "\n") + "\n" + helpFilters
+}
+
+func (cat *Catalog) commandHelpEmbed(cmd *chat.Command) *chat.Card {
+	embed := &chat.Card{
+		Author: &chat.CardAuthor{
+			Name: "ub-bot",
+		},
+		Title:       "/" + cmd.Definition.Name,
+		Description: cmd.Definition.Description,
+		Fields:      []*chat.CardField{},
+	}
+	if cmd.Help != nil && cmd.Help.Long != "" {
+		embed.Description = cmd.Help.Long
+	}
+	for _, opt := range cmd.Definition.Options {
+		embed.Fields = append(embed.Fields, &chat.CardField{
+			Name:  opt.Name,
+			Value: optionHelp(opt),
+		})
+	}
+	if cmd.Help != nil && len(cmd.Help.Examples) > 0 {
+		examples := []string{}
+		for _, example := range cmd.Help.Examples {
+			examples = append(examples, fmt.Sprintf("`/%s%s`", cat.prefix, example))
+		}
+		embed.Fields = append(embed.Fields, &chat.CardField{
+			Name:  "Examples",
+			Value: strings.Join(examples, "\n"),
+		})
+	}
+	return embed
+}
+
+func (cat *Catalog) CommandHelp() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "help",
+		Description: "show help for all commands or a single command",
+		Options: []*chat.OptionDefinition{
+			{
+				Type:        chat.OptionString,
+				Name:        "command",
+				Description: "Command to show help for",
+				Required:    false,
+			},
+		},
+	}
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		defer cat.endCommand(ctx, entry)
+
+		var filter map[string]string
+		if topic, err := i.ChannelTopic(); err != nil {
+			logger.Warn().Msgf("Cannot get channel: %v", err)
+		} else {
+			filter = FilterFromChannelTopic(topic)
+		}
+
+		var name string
+		for _, opt := range i.Options() {
+			switch opt.Name {
+			case "command":
+				name = strings.TrimPrefix(strings.TrimSpace(opt.StringValue()), "/")
+			}
+		}
+		commands := []*chat.Command{}
+		for _, cmd := range cat.commands {
+			if cat.permissions.Allowed(i.Guild(), i.Roles(), i.IsGuildAdmin(), cmd.Definition.Name) {
+				commands = append(commands, cmd)
+			}
+		}
+
+		if name == "" {
+			lines := []string{}
+			for _, cmd := range commands {
+				lines = append(lines, fmt.Sprintf("`/%s` %s", cmd.Definition.Name, cmd.Definition.Description))
+			}
+			embed := &chat.Card{
+				Author: &chat.CardAuthor{
+					Name: "ub-bot",
+				},
+				Title:       "Commands",
+				Description: strings.Join(lines, "\n"),
+				Fields: []*chat.CardField{
+					{
+						Name:  "Concepts",
+						Value: helpConcepts,
+					},
+					{
+						Name:  "Active Filters",
+						Value: filterHelp(filter),
+					},
+				},
+				Footer: &chat.CardFooter{
+					Text: fmt.Sprintf("use /%s command:<name> for details", appCmd.Name),
+				},
+			}
+			if err := i.SendInteractionResponseCards([]*chat.Card{embed}); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+
+		for _, cmd := range commands {
+			if cmd.Definition.Name != name && cmd.Definition.Name != cat.prefix+name {
+				continue
+			}
+			embed := cat.commandHelpEmbed(cmd)
+			embed.Fields = append(embed.Fields, &chat.CardField{
+				Name:  "Active Filters",
+				Value: filterHelp(filter),
+			})
+			if err := i.SendInteractionResponseCards([]*chat.Card{embed}); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		if err := i.SendInteractionResponseMessage(fmt.Sprintf("Unknown command %s", name)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+	}
+	return
+}
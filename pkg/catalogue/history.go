@@ -0,0 +1,137 @@
+package catalogue
+
+import (
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/analytics"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"strconv"
+	"strings"
+)
+
+const historySize = 10
+
+func historyLine(num int, entry *analytics.Entry) string {
+	opts := []string{}
+	for _, name := range []string{"querytype", "query", "magic", "resultid", "size"} {
+		if val, ok := entry.Options[name]; ok {
+			opts = append(opts, fmt.Sprintf("%s:%s", name, val))
+		}
+	}
+	line := fmt.Sprintf("**%d** `%s` /%s %s", num, entry.Time.Format("2006-01-02 15:04"), entry.Command, strings.Join(opts, " "))
+	if entry.MagicQuery != "" {
+		line += fmt.Sprintf(" → %s", entry.MagicQuery)
+	}
+	if entry.Error != "" {
+		line += fmt.Sprintf(" [error: %s]", entry.Error)
+	} else if entry.SearchType != "" {
+		line += fmt.Sprintf(" [%d hits, %s]", entry.Total, entry.Latency())
+	}
+	return chat.Truncate(line, 300)
+}
+
+func (cat *Catalog) CommandHistory() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "history",
+		Description: "show the last commands of this channel",
+		Options: []*chat.OptionDefinition{
+			{
+				Type:        chat.OptionInteger,
+				Name:        "rerun",
+				Description: "number of history entry to run again",
+				Required:    false,
+			},
+		},
+	}
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		logger.Debug().Msgf("command name: %s", i.CommandName())
+		defer cat.endCommand(ctx, entry)
+
+		if cat.analytics == nil {
+			if err := i.SendInteractionResponseMessage("Query history not available"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		history, err := cat.analytics.ChannelHistory(i.Channel(), historySize, appCmd.Name)
+		if err != nil {
+			entry.Error = err.Error()
+			logger.Error().Msgf("Error reading history: %v", err)
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error reading history: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+
+		rerun := -1
+		for _, opt := range i.Options() {
+			switch opt.Name {
+			case "rerun":
+				rerun = int(opt.IntValue())
+			}
+		}
+		if rerun < 0 {
+			lines := []string{}
+			for num, hEntry := range history {
+				lines = append(lines, historyLine(num, hEntry))
+			}
+			if len(lines) == 0 {
+				lines = append(lines, "no history available")
+			}
+			embed := &chat.Card{
+				Author: &chat.CardAuthor{
+					Name: "ub-bot",
+				},
+				Title:       "Query History",
+				Description: strings.Join(lines, "\n"),
+				Footer: &chat.CardFooter{
+					Text: fmt.Sprintf("use /%s rerun:<number> to run an entry again", appCmd.Name),
+				},
+			}
+			if err := i.SendInteractionResponseCards([]*chat.Card{embed}); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+
+		if rerun >= len(history) {
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Invalid history entry %d", rerun)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		hEntry := history[rerun]
+		if hEntry.Command != cat.prefix+"search" && hEntry.Command != cat.prefix+"searchknn" {
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Command /%s cannot be run again", hEntry.Command)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		// the rerun is subject to the same permissions and quota as running the command directly
+		if err := cat.permissions.Authorize(i.Guild(), i.UserID(), i.Roles(), i.IsGuildAdmin(), hEntry.Command); err != nil {
+			if err := i.SendInteractionResponseMessage(err.Error()); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		magic, _ := strconv.ParseBool(hEntry.Options["magic"])
+		if magic && !cat.permissions.Allowed(i.Guild(), i.Roles(), i.IsGuildAdmin(), cat.prefix+"magic") {
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("You are not allowed to use /%smagic", cat.prefix)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		rerunCtx, rerunEntry := cat.beginCommand(i)
+		rerunEntry.Command = hEntry.Command
+		rerunEntry.Options = hEntry.Options
+		if !cat.enqueue(rerunCtx, i, rerunEntry, func() {
+			defer cat.endCommand(rerunCtx, rerunEntry)
+			cat.runSearch(rerunCtx, i, rerunEntry, hEntry.Command, hEntry.Options["querytype"], hEntry.Options["query"], magic)
+		}) {
+			cat.endCommand(rerunCtx, rerunEntry)
+		}
+	}
+	return
+}
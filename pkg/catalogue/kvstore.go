@@ -0,0 +1,26 @@
+package catalogue
+
+import (
+	"emperror.dev/errors"
+	"github.com/je4/ub-bot/v2/pkg/metrics"
+	"github.com/je4/utils/v2/pkg/openai"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// kvMetrics counts hits and misses of the embedding cache
+type kvMetrics struct {
+	openai.KVStore
+	metrics *metrics.Metrics
+}
+
+func (kv *kvMetrics) Get(key string) (*oai.Embedding, error) {
+	result, err := kv.KVStore.Get(key)
+	if err == nil {
+		kv.metrics.EmbeddingCache(true)
+	} else if errors.Is(err, openai.ErrNotExists) {
+		kv.metrics.EmbeddingCache(false)
+	}
+	return result, err
+}
+
+var _ openai.KVStore = (*kvMetrics)(nil)
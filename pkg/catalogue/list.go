@@ -0,0 +1,391 @@
+package catalogue
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"github.com/je4/ubcat/v2/pkg/schema"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxListEntries = 500
+
+// listEntry references a record of a reading list by its elastic id
+type listEntry struct {
+	ID      string    `json:"id"`
+	Title   string    `json:"title"`
+	AddedBy string    `json:"addedBy"`
+	Added   time.Time `json:"added"`
+}
+
+// listScope is user for the personal list and channel for the shared list
+func listScope(shared bool) string {
+	if shared {
+		return "channel"
+	}
+	return "user"
+}
+
+func listKey(i chat.Request, shared bool) string {
+	if shared {
+		return fmt.Sprintf("list-channel-%s", i.Channel())
+	}
+	return fmt.Sprintf("list-user-%s", i.UserID())
+}
+
+func listName(shared bool) string {
+	if shared {
+		return "channel list"
+	}
+	return "your list"
+}
+
+func (cat *Catalog) readList(key string) ([]*listEntry, error) {
+	entries := []*listEntry{}
+	if err := cat.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &entries)
+		})
+	}); err != nil {
+		return nil, errors.Wrapf(err, "cannot read list %s", key)
+	}
+	return entries, nil
+}
+
+// updateList reads, modifies and writes the list in one transaction
+func (cat *Catalog) updateList(key string, update func(entries []*listEntry) ([]*listEntry, error)) ([]*listEntry, error) {
+	var result []*listEntry
+	err := cat.db.Update(func(txn *badger.Txn) error {
+		entries := []*listEntry{}
+		item, err := txn.Get([]byte(key))
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+		case err != nil:
+			return errors.WithStack(err)
+		default:
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &entries)
+			}); err != nil {
+				return errors.Wrap(err, "cannot unmarshal list")
+			}
+		}
+		if result, err = update(entries); err != nil {
+			return err
+		}
+		if len(result) == 0 {
+			return txn.Delete([]byte(key))
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			return errors.Wrap(err, "cannot marshal list")
+		}
+		return txn.Set([]byte(key), data)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot update list %s", key)
+	}
+	return result, nil
+}
+
+// listDocuments fetches the records of the list in list order. missing records are returned by id
+func (cat *Catalog) listDocuments(ctx context.Context, entries []*listEntry) ([]*schema.UBSchema, []string, error) {
+	ids := []string{}
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	found, err := cat.GetDocuments(ctx, ids...)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot get list documents")
+	}
+	docs := []*schema.UBSchema{}
+	missing := []string{}
+	for _, id := range ids {
+		if doc, ok := found[id]; ok {
+			docs = append(docs, doc)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return docs, missing, nil
+}
+
+func (cat *Catalog) CommandList() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "list",
+		Description: "reading list of records",
+		Options: []*chat.OptionDefinition{
+			{
+				Type:        chat.OptionString,
+				Name:        "action",
+				Description: "List action",
+				Required:    true,
+				Choices: []*chat.OptionChoice{
+					{
+						Name:  "Add",
+						Value: "add",
+					},
+					{
+						Name:  "Remove",
+						Value: "remove",
+					},
+					{
+						Name:  "Show",
+						Value: "show",
+					},
+					{
+						Name:  "Export",
+						Value: "export",
+					},
+				},
+			},
+			{
+				Type:        chat.OptionString,
+				Name:        "resultid",
+				Description: "Result ID from previous search or full elastic id (add and remove)",
+				Required:    false,
+			},
+			{
+				Type:        chat.OptionBoolean,
+				Name:        "shared",
+				Description: "Use the list shared in this channel instead of your personal list",
+				Required:    false,
+			},
+			{
+				Type:        chat.OptionString,
+				Name:        "format",
+				Description: "Template of the export (default prose)",
+				Required:    false,
+				Choices:     cat.templateChoices(),
+			},
+		},
+	}
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		async := false
+		defer func() {
+			if !async {
+				cat.endCommand(ctx, entry)
+			}
+		}()
+		var action, resultIDStr, format string
+		var shared bool
+		for _, opt := range i.Options() {
+			switch opt.Name {
+			case "action":
+				action = opt.StringValue()
+			case "resultid":
+				resultIDStr = strings.TrimSpace(opt.StringValue())
+			case "shared":
+				shared = opt.BoolValue()
+			case "format":
+				format = opt.StringValue()
+			}
+		}
+		key := listKey(i, shared)
+		name := listName(shared)
+		scope := listScope(shared)
+
+		switch action {
+		case "add", "remove":
+			if resultIDStr == "" {
+				if err := i.SendInteractionResponseMessage("Please provide resultid"); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			// update changes the list and reports the result with send
+			update := func(docID, title string, send func(msg string) error) {
+				entries, err := cat.updateList(key, func(entries []*listEntry) ([]*listEntry, error) {
+					for pos, e := range entries {
+						if e.ID != docID {
+							continue
+						}
+						if action == "add" {
+							return nil, errors.Errorf("%s is already on %s", title, name)
+						}
+						title = e.Title
+						return append(entries[:pos], entries[pos+1:]...), nil
+					}
+					if action == "remove" {
+						return nil, errors.Errorf("%s is not on %s", docID, name)
+					}
+					if len(entries) >= maxListEntries {
+						return nil, errors.Errorf("%s is full (%d entries)", name, maxListEntries)
+					}
+					return append(entries, &listEntry{
+						ID:      docID,
+						Title:   title,
+						AddedBy: i.UserName(),
+						Added:   time.Now(),
+					}), nil
+				})
+				if err != nil {
+					entry.Error = err.Error()
+					logger.Error().Msgf("Error updating list: %v", err)
+					if err := send(fmt.Sprintf("Cannot %s: %v", action, errors.Cause(err))); err != nil {
+						logger.Error().Msgf("Error sending response: %v", err)
+					}
+					return
+				}
+				msg := fmt.Sprintf("Added %s to %s (%d entries)", title, name, len(entries))
+				if action == "remove" {
+					msg = fmt.Sprintf("Removed %s from %s (%d entries)", title, name, len(entries))
+				}
+				if err := send(msg); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+			}
+			stat := cat.channelStatus(i)
+			// numbers of the last results, anything else is an elastic id
+			if resultID, err := strconv.Atoi(resultIDStr); err == nil && resultID >= 0 && resultID < len(stat.result) {
+				update(stat.result[resultID].Id_, stat.result[resultID].GetMainTitle(), i.SendInteractionResponseMessage)
+				return
+			}
+			if action == "remove" {
+				update(resultIDStr, "", i.SendInteractionResponseMessage)
+				return
+			}
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Loading %s", resultIDStr)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			async = cat.enqueue(ctx, i, entry, func() {
+				defer cat.endCommand(ctx, entry)
+				ctx, release := cat.searchContext(ctx, i.Channel())
+				defer release()
+				docs, err := cat.GetDocuments(ctx, resultIDStr)
+				if err != nil {
+					entry.Error = err.Error()
+					logger.Error().Msgf("Error getting document %s: %v", resultIDStr, err)
+					if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, fmt.Sprintf("Error getting document %s", resultIDStr), err)); err != nil {
+						logger.Error().Msgf("Error sending response: %v", err)
+					}
+					return
+				}
+				doc, ok := docs[resultIDStr]
+				if !ok {
+					if err := i.SendChannelMessage(fmt.Sprintf("Document %s not found", resultIDStr)); err != nil {
+						logger.Error().Msgf("Error sending response: %v", err)
+					}
+					return
+				}
+				update(doc.Id_, doc.GetMainTitle(), i.SendChannelMessage)
+			})
+		case "show", "export":
+			entries, err := cat.readList(key)
+			if err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error reading list: %v", err)
+				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error reading list: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			if len(entries) == 0 {
+				if err := i.SendInteractionResponseMessage(fmt.Sprintf("%s is empty", strings.ToUpper(name[:1])+name[1:])); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			if format == "" {
+				format = "prose"
+			}
+			tmpl, err := cat.templates.Get(format)
+			if err != nil {
+				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Unknown format %s", format)); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Loading %d entries of %s", len(entries), name)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			async = cat.enqueue(ctx, i, entry, func() {
+				defer cat.endCommand(ctx, entry)
+				ctx, release := cat.searchContext(ctx, i.Channel())
+				defer release()
+				docs, missing, err := cat.listDocuments(ctx, entries)
+				if err != nil {
+					entry.Error = err.Error()
+					logger.Error().Msgf("Error getting documents: %v", err)
+					if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error getting documents", err)); err != nil {
+						logger.Error().Msgf("Error sending response: %v", err)
+					}
+					return
+				}
+				entry.Total = int64(len(docs))
+				if len(missing) > 0 {
+					if err := i.SendChannelMessage(fmt.Sprintf("Records no longer in the catalogue: %s", strings.Join(missing, ", "))); err != nil {
+						logger.Error().Msgf("Error sending response: %v", err)
+					}
+				}
+				if action == "export" {
+					texts := []string{}
+					for num, doc := range docs {
+						text, err := tmpl.Execute(doc)
+						if err != nil {
+							entry.Error = err.Error()
+							logger.Error().Msgf("Error rendering %s: %v", doc.Id_, err)
+							if err := i.SendChannelMessage(fmt.Sprintf("Error rendering %s: %v%s", doc.Id_, err, tracing.ErrorSuffix(ctx))); err != nil {
+								logger.Error().Msgf("Error sending response: %v", err)
+							}
+							return
+						}
+						texts = append(texts, fmt.Sprintf("[%d] %s\n%s", num, doc.Id_, strings.TrimSpace(text)))
+					}
+					if err := i.SendChannelCardsWithFiles([]*chat.Card{{
+						Title:       fmt.Sprintf("Export of %s", name),
+						Description: fmt.Sprintf("%d records, template %s", len(docs), tmpl.ID()),
+					}}, []*chat.File{{
+						Name:        fmt.Sprintf("list-%s-%s.txt", scope, tmpl.Name),
+						ContentType: "text/plain; charset=utf-8",
+						Reader:      strings.NewReader(strings.Join(texts, "\n\n")),
+					}}); err != nil {
+						entry.Error = err.Error()
+						logger.Error().Msgf("Error sending response: %v", err)
+					}
+					return
+				}
+				cards, err := cat.storeResults(i.Channel(), docs, int64(len(docs)), func(stat *channelStatus) {
+					stat.result = []*schema.UBSchema{}
+					stat.lastQuery = "list:" + scope
+					stat.lastSearchType = SearchTypeSimple
+					stat.lastVector = nil
+					stat.lastStructured = nil
+					stat.lastMatch = nil
+					stat.searchFunc = appCmd.Name
+				})
+				if err != nil {
+					entry.Error = err.Error()
+					logger.Error().Msgf("Error creating response: %v", err)
+					if err := i.SendChannelMessage(fmt.Sprintf("Error creating response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+						logger.Error().Msgf("Error sending response: %v", err)
+					}
+					return
+				}
+				if err := i.SendChannelCards(cards); err != nil {
+					entry.Error = err.Error()
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+			})
+		default:
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Unknown action %s", action)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,390 @@
+package catalogue
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types/enums/operator"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types/enums/rangerelation"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types/enums/scriptsorttype"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types/enums/sortorder"
+	"github.com/je4/ub-bot/v2/pkg/llm"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"github.com/je4/ubcat/v2/pkg/index"
+	"github.com/je4/ubcat/v2/pkg/schema"
+	"go.opentelemetry.io/otel/attribute"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// elastic fields of the structured query filters
+const (
+	typeOfRecordField      = "LDR.leader_06_typeOfRecord"
+	bibliographicStatField = "LDR.leader_07_bibliographicStatus"
+	languageField          = "mapping.language"
+	dateField              = "mapping.date"
+)
+
+var personFields = []string{"mapping.name.personal.*.namePart", "mapping.name.corporate.*.namePart"}
+var subjectFields = []string{"mapping.subject.topic.*.namePart", "mapping.subject.geographic.*.namePart", "mapping.subject.name.*.namePart"}
+
+// resourceTypeFilters maps the resource types of schema.UBSchema001.GetResourceType to wildcard filters on the leader
+var resourceTypeFilters = map[string]map[string]string{
+	"Book, Monograph":            {typeOfRecordField: "a", bibliographicStatField: "m"},
+	"Journal, Serial":            {typeOfRecordField: "a", bibliographicStatField: "s"},
+	"Article":                    {typeOfRecordField: "a", bibliographicStatField: "a"},
+	"Collection of documents":    {typeOfRecordField: "a", bibliographicStatField: "c"},
+	"Sheet music":                {typeOfRecordField: "c"},
+	"Manuscript sheet music":     {typeOfRecordField: "d"},
+	"Map":                        {typeOfRecordField: "e"},
+	"Manuscript map":             {typeOfRecordField: "f"},
+	"Film":                       {typeOfRecordField: "g"},
+	"Text recording":             {typeOfRecordField: "i"},
+	"Music recording":            {typeOfRecordField: "j"},
+	"Image":                      {typeOfRecordField: "k"},
+	"Computer file":              {typeOfRecordField: "m"},
+	"Kit":                        {typeOfRecordField: "o"},
+	"Archive material":           {typeOfRecordField: "p"},
+	"Object":                     {typeOfRecordField: "r"},
+	"Manuscript":                 {typeOfRecordField: "t"},
+	"Manuscript Book, Monograph": {typeOfRecordField: "t", bibliographicStatField: "m"},
+	"Manuscript Journal, Serial": {typeOfRecordField: "t", bibliographicStatField: "s"},
+}
+
+var languageRegexp = regexp.MustCompile(`^[a-z]{3}$`)
+
+func resourceTypeNames() []string {
+	return sortedKeys(resourceTypeFilters)
+}
+
+// Query2StructuredQuery translates a question into a validated structured query
+func (cat *Catalog) Query2StructuredQuery(ctx context.Context, queryString string) (*llm.StructuredQuery, error) {
+	start := time.Now()
+	result, err := cat.client.Query2StructuredQuery(ctx, queryString, resourceTypeNames())
+	cat.metrics.ObserveOpenAI("query2structured", err, time.Since(start))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create structured query")
+	}
+	if err := validateStructuredQuery(result); err != nil {
+		return nil, errors.Wrapf(err, "invalid structured query %+v", result)
+	}
+	return result, nil
+}
+
+// validateStructuredQuery normalizes the query and checks that all values can be searched
+func validateStructuredQuery(q *llm.StructuredQuery) error {
+	q.Query = strings.TrimSpace(q.Query)
+	q.ResourceType = strings.TrimSpace(q.ResourceType)
+	q.Language = strings.ToLower(strings.TrimSpace(q.Language))
+	q.Person = strings.TrimSpace(q.Person)
+	q.Subject = strings.TrimSpace(q.Subject)
+	q.Sort = strings.ToLower(strings.TrimSpace(q.Sort))
+	q.SearchType = strings.ToLower(strings.TrimSpace(q.SearchType))
+
+	maxYear := time.Now().Year() + 1
+	if q.YearFrom < 0 || q.YearFrom > maxYear {
+		return errors.Errorf("year %d out of range", q.YearFrom)
+	}
+	if q.YearTo < 0 || q.YearTo > maxYear {
+		return errors.Errorf("year %d out of range", q.YearTo)
+	}
+	if q.YearFrom != 0 && q.YearTo != 0 && q.YearFrom > q.YearTo {
+		return errors.Errorf("year range %d-%d is empty", q.YearFrom, q.YearTo)
+	}
+	if _, ok := resourceTypeFilters[q.ResourceType]; q.ResourceType != "" && !ok {
+		return errors.Errorf("unknown resource type %s", q.ResourceType)
+	}
+	if q.Language != "" && !languageRegexp.MatchString(q.Language) {
+		return errors.Errorf("invalid language code %s", q.Language)
+	}
+	if q.Sort == "" {
+		q.Sort = "relevance"
+	}
+	if !slices.Contains(llm.Sorts, q.Sort) {
+		return errors.Errorf("unknown sort %s", q.Sort)
+	}
+	if q.SearchType != "" && !slices.Contains(llm.SearchTypes, q.SearchType) {
+		return errors.Errorf("unknown search type %s", q.SearchType)
+	}
+	if q.Query == "" && q.YearFrom == 0 && q.YearTo == 0 && q.ResourceType == "" && q.Language == "" && q.Person == "" && q.Subject == "" {
+		return errors.New("query is empty")
+	}
+	return nil
+}
+
+// structuredFilter merges the channel filter with the wildcard filters of the structured query
+func structuredFilter(q *llm.StructuredQuery, filter map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range filter {
+		result[k] = v
+	}
+	for k, v := range resourceTypeFilters[q.ResourceType] {
+		result[k] = v
+	}
+	if q.Language != "" {
+		result[languageField] = q.Language
+	}
+	return result
+}
+
+// structuredFilters builds the elastic filters of the structured query and the channel filter
+func structuredFilters(q *llm.StructuredQuery, filter map[string]string) []types.Query {
+	// elastic allows only one field per wildcard query
+	esFilter := []types.Query{}
+	merged := structuredFilter(q, filter)
+	for _, field := range sortedKeys(merged) {
+		esFilter = append(esFilter, wildcardFilter(map[string]string{field: merged[field]})...)
+	}
+	if q.YearFrom != 0 || q.YearTo != 0 {
+		dateRange := types.DateRangeQuery{
+			Format:   &yearFormat,
+			Relation: &rangerelation.Intersects,
+		}
+		if q.YearFrom != 0 {
+			from := yearString(q.YearFrom)
+			dateRange.Gte = &from
+		}
+		if q.YearTo != 0 {
+			to := yearString(q.YearTo)
+			dateRange.Lte = &to
+		}
+		esFilter = append(esFilter, types.Query{
+			Range: map[string]types.RangeQuery{dateField: dateRange},
+		})
+	}
+	for _, f := range []struct {
+		value  string
+		fields []string
+	}{{q.Person, personFields}, {q.Subject, subjectFields}} {
+		if f.value == "" {
+			continue
+		}
+		esFilter = append(esFilter, types.Query{
+			SimpleQueryString: &types.SimpleQueryStringQuery{
+				Query:           f.value,
+				Fields:          f.fields,
+				DefaultOperator: &operator.And,
+			},
+		})
+	}
+	return esFilter
+}
+
+// structuredRequest builds the elastic query of a structured query.
+// the free text is searched with the vector if the search type is a vector search
+func structuredRequest(q *llm.StructuredQuery, filter map[string]string, embedding []float32, searchType SearchType) (*search.Request, error) {
+	esMust := []types.Query{}
+	if searchType != SearchTypeSimple {
+		field, err := vectorField(searchType)
+		if err != nil {
+			return nil, err
+		}
+		if embedding == nil {
+			return nil, errors.Errorf("embedding is nil")
+		}
+		vQuery, err := vectorQuery(embedding, field)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create vector query")
+		}
+		esMust = append(esMust, *vQuery)
+	} else if q.Query != "" {
+		esMust = append(esMust, types.Query{
+			SimpleQueryString: &types.SimpleQueryStringQuery{
+				Query: q.Query,
+			},
+		})
+	}
+	if len(esMust) == 0 {
+		esMust = append(esMust, types.Query{MatchAll: &types.MatchAllQuery{}})
+	}
+	searchRequest := &search.Request{
+		Query: &types.Query{
+			Bool: &types.BoolQuery{
+				Filter: structuredFilters(q, filter),
+				Must:   esMust,
+			},
+		},
+	}
+	if dateSort := structuredSort(q); dateSort != nil {
+		searchRequest.Sort = dateSort
+		trackScores := true
+		searchRequest.TrackScores = &trackScores
+	}
+	return searchRequest, nil
+}
+
+// yearSortScript returns the year of the first date of the record like docYear.
+// mapping.date is a date range, which elastic cannot sort on
+const yearSortScript = `def mapping = params['_source']['mapping'];
+if (mapping != null && mapping['date'] instanceof List) {
+  for (def date : mapping['date']) {
+    if (date == null || date['gte'] == null) {
+      continue;
+    }
+    String gte = date['gte'].toString();
+    if (gte.length() < 4) {
+      return params.missing;
+    }
+    try {
+      int year = Integer.parseInt(gte.substring(0, 4));
+      return year > 0 ? year : params.missing;
+    } catch (NumberFormatException e) {
+      return params.missing;
+    }
+  }
+}
+return params.missing;`
+
+// structuredSort sorts the whole result by year, so that further pages continue the order.
+// nil for relevance, which is the default order of elastic
+func structuredSort(q *llm.StructuredQuery) []types.SortCombinations {
+	var order *sortorder.SortOrder
+	// records without year are listed last
+	var missing json.RawMessage
+	switch q.Sort {
+	case "newest":
+		order, missing = &sortorder.Desc, json.RawMessage("-1")
+	case "oldest":
+		order, missing = &sortorder.Asc, json.RawMessage("100000")
+	default:
+		return nil
+	}
+	return []types.SortCombinations{
+		types.SortOptions{Script_: &types.ScriptSort{
+			Order: order,
+			Type:  &scriptsorttype.Number,
+			Script: &types.InlineScript{
+				Source: yearSortScript,
+				Params: map[string]json.RawMessage{"missing": missing},
+			},
+		}},
+		types.SortOptions{Score_: &types.ScoreSort{Order: &sortorder.Desc}},
+	}
+}
+
+func structuredKNNRequest(q *llm.StructuredQuery, filter map[string]string, embedding []float32, searchType SearchType, k, numCandidates int64) (*search.Request, error) {
+	field, err := vectorField(searchType)
+	if err != nil {
+		return nil, err
+	}
+	if embedding == nil {
+		return nil, errors.Errorf("embedding is nil")
+	}
+	knnQuery := types.KnnQuery{
+		Field:         field,
+		QueryVector:   embedding,
+		K:             k,
+		NumCandidates: numCandidates,
+	}
+	if esFilter := structuredFilters(q, filter); len(esFilter) > 0 {
+		knnQuery.Filter = esFilter
+	}
+	return &search.Request{
+		Knn: []types.KnnQuery{knnQuery},
+	}, nil
+}
+
+var yearFormat = "yyyy"
+
+func yearString(year int) string {
+	return fmt.Sprintf("%04d", year)
+}
+
+func (cat *Catalog) StructuredSearch(ctx context.Context, q *llm.StructuredQuery, filter map[string]string, embedding []float32, searchType SearchType, from, num int64) (result *index.Result, resultErr error) {
+	ctx, span := tracing.Start(ctx, "elastic.StructuredSearch")
+	span.SetAttributes(
+		attribute.String("search.type", searchTypeName(searchType)),
+		attribute.Int64("search.from", from),
+		attribute.Int64("search.num", num),
+	)
+	defer func() { tracing.End(span, resultErr) }()
+	searchRequest, err := structuredRequest(q, filter, embedding, searchType)
+	if err != nil {
+		return nil, err
+	}
+	result, err = cat.runRequest(ctx, "structuredsearch", searchRequest, from, num)
+	if err != nil {
+		return nil, err
+	}
+	result.From = from
+	return result, nil
+}
+
+func (cat *Catalog) StructuredSearchKNN(ctx context.Context, q *llm.StructuredQuery, filter map[string]string, embedding []float32, searchType SearchType, k, numCandidates int64) (result *index.Result, resultErr error) {
+	ctx, span := tracing.Start(ctx, "elastic.StructuredSearchKNN")
+	span.SetAttributes(
+		attribute.String("search.type", searchTypeName(searchType)),
+		attribute.Int64("search.k", k),
+	)
+	defer func() { tracing.End(span, resultErr) }()
+	searchRequest, err := structuredKNNRequest(q, filter, embedding, searchType, k, numCandidates)
+	if err != nil {
+		return nil, err
+	}
+	return cat.runRequest(ctx, "structuredsearchknn", searchRequest, 0, k)
+}
+
+func (cat *Catalog) runRequest(ctx context.Context, op string, searchRequest *search.Request, from, num int64) (*index.Result, error) {
+	if err := cat.elasticLimit.Acquire(ctx); err != nil {
+		return nil, errors.Wrap(err, "cannot query elastic")
+	}
+	start := time.Now()
+	res, err := cat.elastic.Search().
+		Index(cat.elasticIndex).
+		Request(searchRequest).
+		From(int(from)).
+		Size(int(num)).
+		Do(ctx)
+	cat.elasticLimit.Release()
+	if err != nil {
+		cat.metrics.ObserveElastic(op, err, 0, time.Since(start))
+		return nil, errors.Wrap(err, "cannot search")
+	}
+	result, err := responseResult(res)
+	if err != nil {
+		return nil, err
+	}
+	cat.metrics.ObserveElastic(op, nil, result.Total, time.Since(start))
+	return result, nil
+}
+
+// docYear returns the first year of the record, 0 if unknown. yearSortScript has to match
+func docYear(doc *schema.UBSchema) int {
+	if doc.Mapping == nil {
+		return 0
+	}
+	for _, date := range doc.Mapping.Date {
+		if date != nil && !date.From.IsZero() {
+			return date.From.Year()
+		}
+	}
+	return 0
+}
+
+// sortDocs orders the documents of a result page like elastic did, see structuredSort.
+// records without year are listed last, records of the same year by score
+func sortDocs(docs []*schema.UBSchema, order string) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		switch order {
+		case "newest", "oldest":
+			yi, yj := docYear(docs[i]), docYear(docs[j])
+			if yi == 0 || yj == 0 {
+				if yi != yj {
+					return yj == 0
+				}
+			} else if yi != yj {
+				if order == "newest" {
+					return yi > yj
+				}
+				return yi < yj
+			}
+		}
+		return docs[i].Score_ > docs[j].Score_
+	})
+}
@@ -0,0 +1,104 @@
+package catalogue
+
+import (
+	"encoding/json"
+	"github.com/je4/ub-bot/v2/pkg/llm"
+	"github.com/je4/ubcat/v2/pkg/schema"
+	"strings"
+	"testing"
+)
+
+func TestStructuredRequestSort(t *testing.T) {
+	for _, test := range []struct {
+		sort    string
+		order   string
+		missing float64
+	}{
+		{"newest", "desc", -1},
+		{"oldest", "asc", 100000},
+	} {
+		req, err := structuredRequest(&llm.StructuredQuery{Query: "alchemy", Sort: test.sort}, nil, nil, SearchTypeSimple)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Sort []map[string]struct {
+				Order  string `json:"order"`
+				Type   string `json:"type"`
+				Script struct {
+					Source string             `json:"source"`
+					Params map[string]float64 `json:"params"`
+				} `json:"script"`
+			} `json:"sort"`
+			TrackScores bool `json:"track_scores"`
+		}
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Sort) != 2 || !body.TrackScores {
+			t.Fatalf("%s: unexpected sort %s", test.sort, data)
+		}
+		if _, ok := body.Sort[0][dateField]; ok {
+			t.Errorf("%s: sorts on the date range %s", test.sort, dateField)
+		}
+		script, ok := body.Sort[0]["_script"]
+		if !ok || script.Order != test.order || script.Type != "number" || script.Script.Params["missing"] != test.missing {
+			t.Errorf("%s: unexpected script sort %s", test.sort, data)
+		}
+		if !strings.Contains(script.Script.Source, "['gte']") {
+			t.Errorf("%s: script does not read the lower bound of the date range", test.sort)
+		}
+		if score, ok := body.Sort[1]["_score"]; !ok || score.Order != "desc" {
+			t.Errorf("%s: records of the same year are not sorted by score: %s", test.sort, data)
+		}
+	}
+
+	req, err := structuredRequest(&llm.StructuredQuery{Query: "alchemy", Sort: "relevance"}, nil, nil, SearchTypeSimple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Sort != nil || req.TrackScores != nil {
+		t.Errorf("relevance is sorted explicitly")
+	}
+}
+
+func testDoc(t *testing.T, id, source string) *schema.UBSchema {
+	t.Helper()
+	doc := &schema.UBSchema{}
+	if err := json.Unmarshal([]byte(source), doc); err != nil {
+		t.Fatal(err)
+	}
+	doc.Id_ = id
+	return doc
+}
+
+func TestSortDocs(t *testing.T) {
+	docs := func() []*schema.UBSchema {
+		return []*schema.UBSchema{
+			testDoc(t, "none", `{"score":5}`),
+			testDoc(t, "1990", `{"score":1,"mapping":{"date":[{"gte":"1990","lte":"1991"}]}}`),
+			testDoc(t, "2001", `{"score":1,"mapping":{"date":[{"gte":"2001-05"}]}}`),
+			testDoc(t, "1990b", `{"score":3,"mapping":{"date":[{"gte":"1990-01-01"}]}}`),
+			testDoc(t, "open", `{"score":2,"mapping":{"date":[{"lte":"1800"}]}}`),
+		}
+	}
+	for order, want := range map[string]string{
+		"newest":    "2001,1990b,1990,none,open",
+		"oldest":    "1990b,1990,2001,none,open",
+		"relevance": "none,1990b,open,1990,2001",
+	} {
+		result := docs()
+		sortDocs(result, order)
+		ids := []string{}
+		for _, doc := range result {
+			ids = append(ids, doc.Id_)
+		}
+		if got := strings.Join(ids, ","); got != want {
+			t.Errorf("%s: got %s, want %s", order, got, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package catalogue
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+	"github.com/je4/ubcat/v2/pkg/index"
+	"github.com/je4/ubcat/v2/pkg/schema"
+)
+
+func vectorField(searchType SearchType) (string, error) {
+	switch searchType {
+	case SearchTypeEmbeddingMARC:
+		return "embedding_marc", nil
+	case SearchTypeEmbeddingProse:
+		return "embedding_prose", nil
+	case SearchTypeEmbeddingJSON:
+		return "embedding_json", nil
+	default:
+		return "", errors.Errorf("unknown search type %v", searchType)
+	}
+}
+
+// vectorQuery builds the same script score query as index.Client.Search
+func vectorQuery(vector []float32, field string) (*types.Query, error) {
+	vectorBytes, err := json.Marshal(vector)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal params")
+	}
+	return &types.Query{
+		ScriptScore: &types.ScriptScoreQuery{
+			Query: &types.Query{
+				Exists: &types.ExistsQuery{
+					Field: field,
+				},
+			},
+			Script: &types.InlineScript{
+				Source: fmt.Sprintf("cosineSimilarity(params.queryVector, '%s') + 1.0", field),
+				Params: map[string]json.RawMessage{
+					"queryVector": vectorBytes,
+				},
+			},
+		},
+	}, nil
+}
+
+func wildcardFilter(filter map[string]string) []types.Query {
+	wildcardQuery := map[string]types.WildcardQuery{}
+	for k, v := range filter {
+		val := v
+		wildcardQuery[k] = types.WildcardQuery{Value: &val}
+	}
+	if len(wildcardQuery) == 0 {
+		return []types.Query{}
+	}
+	return []types.Query{{Wildcard: wildcardQuery}}
+}
+
+func responseResult(res *search.Response) (*index.Result, error) {
+	result := &index.Result{
+		Docs: map[string]*schema.UBSchema{},
+		Num:  int64(len(res.Hits.Hits)),
+	}
+	for _, hit := range res.Hits.Hits {
+		var doc = &schema.UBSchema{}
+		if err := json.Unmarshal(hit.Source_, doc); err != nil {
+			return nil, errors.Wrapf(err, "cannot unmarshal document %s", hit.Id_)
+		}
+		doc.Score_ = float64(hit.Score_)
+		doc.Id_ = hit.Id_
+		result.Docs[hit.Id_] = doc
+	}
+	if res.Hits.Total != nil {
+		result.Total = res.Hits.Total.Value
+	}
+	return result, nil
+}
@@ -0,0 +1,594 @@
+package catalogue
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/llm"
+	"github.com/je4/ub-bot/v2/pkg/metrics"
+	"github.com/je4/ub-bot/v2/pkg/templates"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"github.com/je4/ubcat/v2/pkg/index"
+	"github.com/je4/ubcat/v2/pkg/schema"
+	oai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxResearchSteps is the number of model turns of a research, the last turn has to answer
+const maxResearchSteps = 8
+
+const researchResultSize = 10
+
+const researchFacetSize = 20
+
+const researchSystemPrompt = `you are a research assistant of the University Library Basel.
+answer the question of the user with records of the library catalogue. use the tools to search the catalogue, to read records and to explore similar records.
+prefer several small searches over one large search. when you know enough, call the answer tool with a short answer and the ids of the records you used.`
+
+var facetFields = map[string]string{
+	"language":      languageField,
+	"resource_type": typeOfRecordField,
+}
+
+// SetChatProvider replaces the chat model of /research and /summarize, e.g. with a llm.FakeProvider
+func (cat *Catalog) SetChatProvider(provider llm.ChatProvider) {
+	cat.chatModel = provider
+}
+
+// chatMetrics observes the latency of each chat completion, so that tool calls are not counted
+type chatMetrics struct {
+	llm.ChatProvider
+	metrics *metrics.Metrics
+	op      string
+}
+
+func (c *chatMetrics) Chat(ctx context.Context, messages []oai.ChatCompletionMessage, tools []oai.Tool, toolChoice any) (oai.ChatCompletionMessage, error) {
+	start := time.Now()
+	msg, err := c.ChatProvider.Chat(ctx, messages, tools, toolChoice)
+	c.metrics.ObserveOpenAI(c.op, err, time.Since(start))
+	return msg, err
+}
+
+func (cat *Catalog) meteredChat(op string) llm.ChatProvider {
+	return &chatMetrics{
+		ChatProvider: cat.chatModel,
+		metrics:      cat.metrics,
+		op:           op,
+	}
+}
+
+type researchRecord struct {
+	ID      string   `json:"id"`
+	Title   string   `json:"title"`
+	Type    string   `json:"type,omitempty"`
+	Date    string   `json:"date,omitempty"`
+	Persons []string `json:"persons,omitempty"`
+	Score   float64  `json:"score,omitempty"`
+}
+
+func newResearchRecord(doc *schema.UBSchema) *researchRecord {
+	rec := &researchRecord{
+		ID:    doc.Id_,
+		Title: doc.GetMainTitle(),
+		Type:  doc.GetResourceType(),
+		Date:  doc.GetPublicationDate(),
+		Score: doc.Score_,
+	}
+	for _, persons := range doc.GetPersons() {
+		for _, p := range persons {
+			rec.Persons = append(rec.Persons, p.Name)
+		}
+	}
+	return rec
+}
+
+func researchResult(result *index.Result) (string, error) {
+	docs := []*schema.UBSchema{}
+	for _, doc := range result.Docs {
+		docs = append(docs, doc)
+	}
+	sortDocs(docs, "relevance")
+	records := []*researchRecord{}
+	for _, doc := range docs {
+		records = append(records, newResearchRecord(doc))
+	}
+	data, err := json.Marshal(struct {
+		Total   int64             `json:"total"`
+		Records []*researchRecord `json:"records"`
+	}{result.Total, records})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal result")
+	}
+	return string(data), nil
+}
+
+func researchSearchType(name string) (SearchType, error) {
+	switch name {
+	case "", "prose":
+		return SearchTypeEmbeddingProse, nil
+	case "marc":
+		return SearchTypeEmbeddingMARC, nil
+	case "json":
+		return SearchTypeEmbeddingJSON, nil
+	case "simple":
+		return SearchTypeSimple, nil
+	default:
+		return 0, errors.Errorf("unknown search type %s", name)
+	}
+}
+
+func (cat *Catalog) researchTools(filter map[string]string) []*llm.AgentTool {
+	searchParams := jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"query": {
+				Type:        jsonschema.String,
+				Description: "search query",
+			},
+			"search_type": {
+				Type:        jsonschema.String,
+				Description: "simple for keywords, names and titles, prose, marc or json for semantic search",
+				Enum:        llm.SearchTypes,
+			},
+		},
+		Required: []string{"query"},
+	}
+	type searchArgs struct {
+		Query      string `json:"query"`
+		SearchType string `json:"search_type"`
+	}
+	parseSearch := func(ctx context.Context, arguments string) (*searchArgs, SearchType, []float32, error) {
+		args := &searchArgs{}
+		if err := json.Unmarshal([]byte(arguments), args); err != nil {
+			return nil, 0, nil, errors.Wrap(err, "invalid arguments")
+		}
+		if strings.TrimSpace(args.Query) == "" {
+			return nil, 0, nil, errors.New("query is empty")
+		}
+		searchType, err := researchSearchType(args.SearchType)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		var embedding []float32
+		if searchType != SearchTypeSimple {
+			if embedding, err = cat.GetEmbedding(ctx, args.Query); err != nil {
+				return nil, 0, nil, errors.Wrap(err, "cannot get embedding")
+			}
+		}
+		return args, searchType, embedding, nil
+	}
+	return []*llm.AgentTool{
+		{
+			Name:        "search",
+			Description: "search the catalogue, combining keywords and semantic similarity",
+			Parameters:  searchParams,
+			Call: func(ctx context.Context, arguments string) (string, error) {
+				args, searchType, embedding, err := parseSearch(ctx, arguments)
+				if err != nil {
+					return "", err
+				}
+				result, err := cat.Search(ctx, args.Query, filter, embedding, searchType, 0, researchResultSize)
+				if err != nil {
+					return "", err
+				}
+				return researchResult(result)
+			},
+		},
+		{
+			Name:        "search_knn",
+			Description: "approximate nearest neighbour search of the catalogue, only for semantic search types",
+			Parameters:  searchParams,
+			Call: func(ctx context.Context, arguments string) (string, error) {
+				_, searchType, embedding, err := parseSearch(ctx, arguments)
+				if err != nil {
+					return "", err
+				}
+				if searchType == SearchTypeSimple {
+					return "", errors.New("search_knn needs a semantic search type")
+				}
+				result, err := cat.SearchKNN(ctx, filter, embedding, searchType, researchResultSize, researchResultSize*10)
+				if err != nil {
+					return "", err
+				}
+				return researchResult(result)
+			},
+		},
+		{
+			Name:        "get_documents",
+			Description: "read the full description of records",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"ids": {
+						Type:        jsonschema.Array,
+						Description: "record ids",
+						Items:       &jsonschema.Definition{Type: jsonschema.String},
+					},
+				},
+				Required: []string{"ids"},
+			},
+			Call: func(ctx context.Context, arguments string) (string, error) {
+				args := &struct {
+					IDs []string `json:"ids"`
+				}{}
+				if err := json.Unmarshal([]byte(arguments), args); err != nil {
+					return "", errors.Wrap(err, "invalid arguments")
+				}
+				if len(args.IDs) == 0 {
+					return "", errors.New("no ids given")
+				}
+				docs, err := cat.GetDocuments(ctx, args.IDs...)
+				if err != nil {
+					return "", err
+				}
+				texts := []string{}
+				for _, id := range args.IDs {
+					doc, ok := docs[id]
+					if !ok {
+						texts = append(texts, fmt.Sprintf("id: %s\nnot found", id))
+						continue
+					}
+					text, _, err := cat.EmbeddingSource(doc, "prose")
+					if err != nil {
+						return "", err
+					}
+					texts = append(texts, fmt.Sprintf("id: %s\n%s", id, text))
+				}
+				return strings.Join(texts, "\n\n"), nil
+			},
+		},
+		{
+			Name:        "similar",
+			Description: "find records similar to a record",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"id": {
+						Type:        jsonschema.String,
+						Description: "record id",
+					},
+					"search_type": {
+						Type:        jsonschema.String,
+						Description: "vector of the record to compare",
+						Enum:        []string{"prose", "marc", "json"},
+					},
+				},
+				Required: []string{"id"},
+			},
+			Call: func(ctx context.Context, arguments string) (string, error) {
+				args := &struct {
+					ID         string `json:"id"`
+					SearchType string `json:"search_type"`
+				}{}
+				if err := json.Unmarshal([]byte(arguments), args); err != nil {
+					return "", errors.Wrap(err, "invalid arguments")
+				}
+				searchType, err := researchSearchType(args.SearchType)
+				if err != nil {
+					return "", err
+				}
+				if searchType == SearchTypeSimple {
+					return "", errors.New("similar needs a vector search type")
+				}
+				docs, err := cat.GetDocuments(ctx, args.ID)
+				if err != nil {
+					return "", err
+				}
+				doc, ok := docs[args.ID]
+				if !ok {
+					return "", errors.Errorf("record %s not found", args.ID)
+				}
+				vector, _, err := cat.recordVector(ctx, doc, searchType)
+				if err != nil {
+					return "", err
+				}
+				result, err := cat.Search(ctx, "", filter, vector, searchType, 0, researchResultSize)
+				if err != nil {
+					return "", err
+				}
+				return researchResult(result)
+			},
+		},
+		{
+			Name:        "facets",
+			Description: "count the values of a field among the records matching a keyword query, e.g. to see which languages or resource types exist",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"query": {
+						Type:        jsonschema.String,
+						Description: "keyword query, empty for all records",
+					},
+					"field": {
+						Type:        jsonschema.String,
+						Description: "field to count",
+						Enum:        sortedKeys(facetFields),
+					},
+				},
+				Required: []string{"field"},
+			},
+			Call: func(ctx context.Context, arguments string) (string, error) {
+				args := &struct {
+					Query string `json:"query"`
+					Field string `json:"field"`
+				}{}
+				if err := json.Unmarshal([]byte(arguments), args); err != nil {
+					return "", errors.Wrap(err, "invalid arguments")
+				}
+				counts, err := cat.Facets(ctx, args.Query, filter, args.Field, researchFacetSize)
+				if err != nil {
+					return "", err
+				}
+				data, err := json.Marshal(counts)
+				if err != nil {
+					return "", errors.Wrap(err, "cannot marshal facets")
+				}
+				return string(data), nil
+			},
+		},
+	}
+}
+
+// recordVector returns the stored vector of the record, or computes it from the template of the same name.
+// the template is nil if the stored vector is used. a missing marc vector cannot be computed,
+// the marc template only approximates the text of the indexer
+func (cat *Catalog) recordVector(ctx context.Context, doc *schema.UBSchema, searchType SearchType) ([]float32, *templates.Template, error) {
+	var vector []float32
+	switch searchType {
+	case SearchTypeEmbeddingMARC:
+		vector = doc.EmbeddingMarc
+	case SearchTypeEmbeddingProse:
+		vector = doc.EmbeddingProse
+	case SearchTypeEmbeddingJSON:
+		vector = doc.EmbeddingJson
+	default:
+		return nil, nil, errors.Errorf("no vector for search type %v", searchType)
+	}
+	if len(vector) > 0 {
+		return vector, nil, nil
+	}
+	if searchType == SearchTypeEmbeddingMARC {
+		return nil, nil, errors.Errorf("record %s has no marc vector", doc.Id_)
+	}
+	vector, tmpl, err := cat.TemplateEmbedding(ctx, doc, searchTypeName(searchType))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot compute vector of %s", doc.Id_)
+	}
+	return vector, tmpl, nil
+}
+
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// Facets counts the most frequent values of a facet field among the records matching the keyword query
+func (cat *Catalog) Facets(ctx context.Context, query string, filter map[string]string, facet string, size int) (result []*FacetCount, resultErr error) {
+	ctx, span := tracing.Start(ctx, "elastic.Facets")
+	defer func() { tracing.End(span, resultErr) }()
+	field, ok := facetFields[facet]
+	if !ok {
+		return nil, errors.Errorf("unknown facet %s", facet)
+	}
+	esMust := wildcardFilter(filter)
+	if query != "" {
+		esMust = append(esMust, types.Query{
+			SimpleQueryString: &types.SimpleQueryStringQuery{
+				Query: query,
+			},
+		})
+	}
+	searchRequest := &search.Request{
+		Query: &types.Query{
+			Bool: &types.BoolQuery{
+				Must: esMust,
+			},
+		},
+		Aggregations: map[string]types.Aggregations{
+			facet: {
+				Terms: &types.TermsAggregation{
+					Field: &field,
+					Size:  &size,
+				},
+			},
+		},
+	}
+	if err := cat.elasticLimit.Acquire(ctx); err != nil {
+		return nil, errors.Wrap(err, "cannot query elastic")
+	}
+	start := time.Now()
+	res, err := cat.elastic.Search().
+		Index(cat.elasticIndex).
+		Request(searchRequest).
+		Size(0).
+		Do(ctx)
+	cat.elasticLimit.Release()
+	if err != nil {
+		cat.metrics.ObserveElastic("facets", err, 0, time.Since(start))
+		return nil, errors.Wrap(err, "cannot search")
+	}
+	cat.metrics.ObserveElastic("facets", nil, 0, time.Since(start))
+	terms, ok := res.Aggregations[facet].(*types.StringTermsAggregate)
+	if !ok {
+		return nil, errors.Errorf("unexpected aggregation %T", res.Aggregations[facet])
+	}
+	buckets, ok := terms.Buckets.([]types.StringTermsBucket)
+	if !ok {
+		return nil, errors.Errorf("unexpected buckets %T", terms.Buckets)
+	}
+	result = []*FacetCount{}
+	for _, bucket := range buckets {
+		result = append(result, &FacetCount{
+			Value: fmt.Sprintf("%v", bucket.Key),
+			Count: bucket.DocCount,
+		})
+	}
+	return result, nil
+}
+
+func researchTrace(question string, trace []*llm.TraceStep) string {
+	str := fmt.Sprintf("research: %s\n\n", question)
+	for _, step := range trace {
+		str += step.String() + "\n"
+	}
+	return str
+}
+
+func (cat *Catalog) CommandResearch() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "research",
+		Description: "let the AI research a question in the catalogue",
+		Options: []*chat.OptionDefinition{
+			{
+				Type:        chat.OptionString,
+				Name:        "question",
+				Description: "Question to research",
+				Required:    true,
+			},
+		},
+	}
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		async := false
+		defer func() {
+			if !async {
+				cat.endCommand(ctx, entry)
+			}
+		}()
+		var question string
+		for _, opt := range i.Options() {
+			switch opt.Name {
+			case "question":
+				question = strings.TrimSpace(opt.StringValue())
+			}
+		}
+		if question == "" {
+			if err := i.SendInteractionResponseMessage("Please provide a question"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		entry.Query = question
+		topic, err := i.ChannelTopic()
+		if err != nil {
+			entry.Error = err.Error()
+			logger.Error().Msgf("Error getting channel: %v", err)
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error getting channel: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		filter := FilterFromChannelTopic(topic)
+		entry.Filter = filter
+		if err := i.SendInteractionResponseMessage(fmt.Sprintf("Researching: %s", question)); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+		async = cat.enqueue(ctx, i, entry, func() {
+			defer cat.endCommand(ctx, entry)
+			ctx, release := cat.searchContext(ctx, i.Channel())
+			defer release()
+
+			agent := llm.NewAgent(cat.meteredChat("research"), cat.researchTools(filter), maxResearchSteps, cat.logger)
+			answer, trace, err := agent.Run(ctx, researchSystemPrompt, question)
+			traceFile := &chat.File{
+				Name:        "research-trace.txt",
+				ContentType: "text/plain; charset=utf-8",
+				Reader:      strings.NewReader(researchTrace(question, trace)),
+			}
+			if err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error researching: %v", err)
+				if err := i.SendChannelCardsWithFiles([]*chat.Card{{
+					Title:       "Research failed",
+					Description: cat.searchErrorMessage(ctx, "Error researching", err),
+				}}, []*chat.File{traceFile}); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+
+			ids := []string{}
+			for _, rec := range answer.Records {
+				ids = append(ids, rec.ID)
+			}
+			result := &index.Result{Docs: map[string]*schema.UBSchema{}}
+			if len(ids) > 0 {
+				docs, err := cat.GetDocuments(ctx, ids...)
+				if err != nil {
+					entry.Error = err.Error()
+					logger.Error().Msgf("Error getting documents: %v", err)
+					if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error getting documents", err)); err != nil {
+						logger.Error().Msgf("Error sending response: %v", err)
+					}
+					return
+				}
+				result.Docs = docs
+			}
+			result.Num = int64(len(result.Docs))
+			result.Total = result.Num
+			entry.Total = result.Total
+
+			answerCard := &chat.Card{
+				Author: &chat.CardAuthor{
+					Name: "ub-bot",
+				},
+				Title:       chat.Truncate(question, 200),
+				Description: answer.Answer,
+				Footer: &chat.CardFooter{
+					Text: fmt.Sprintf("%d tool calls, see research-trace.txt", len(trace)),
+				},
+			}
+			for _, rec := range answer.Records {
+				name := rec.ID
+				if doc, ok := result.Docs[rec.ID]; ok {
+					name = doc.GetMainTitle()
+				}
+				answerCard.Fields = append(answerCard.Fields, &chat.CardField{
+					Name:  name,
+					Value: rec.Reason,
+				})
+			}
+			// the records are listed in the order of the answer, GetDocuments returns no score to sort by
+			docs := []*schema.UBSchema{}
+			for _, rec := range answer.Records {
+				if doc, ok := result.Docs[rec.ID]; ok && !slices.Contains(docs, doc) {
+					docs = append(docs, doc)
+				}
+			}
+			cards, err := cat.storeResults(i.Channel(), docs, result.Total, func(stat *channelStatus) {
+				stat.result = []*schema.UBSchema{}
+				stat.lastQuery = "research:" + question
+				stat.lastSearchType = SearchTypeEmbeddingProse
+				stat.lastVector = nil
+				stat.lastStructured = nil
+				stat.lastMatch = nil
+				stat.searchFunc = appCmd.Name
+			})
+			if err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error creating response: %v", err)
+				if err := i.SendChannelMessage(fmt.Sprintf("Error creating response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			// the header card of the result list is replaced by the answer
+			if len(cards) > 0 {
+				cards = cards[1:]
+			}
+			if err := i.SendChannelCardsWithFiles(append([]*chat.Card{answerCard}, cards...), []*chat.File{traceFile}); err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+		})
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package catalogue
+
+import (
+	"context"
+	"github.com/je4/ub-bot/v2/pkg/llm"
+	"github.com/rs/zerolog"
+	oai "github.com/sashabaranov/go-openai"
+	"regexp"
+	"testing"
+)
+
+func TestResearchTrace(t *testing.T) {
+	provider := llm.NewFakeProvider(
+		oai.ChatCompletionMessage{ToolCalls: []oai.ToolCall{
+			{ID: "1", Type: oai.ToolTypeFunction, Function: oai.FunctionCall{Name: "search", Arguments: `{"query":"alchemy"}`}},
+			{ID: "2", Type: oai.ToolTypeFunction, Function: oai.FunctionCall{Name: "record", Arguments: `{"id":"x"}`}},
+		}},
+		oai.ChatCompletionMessage{ToolCalls: []oai.ToolCall{
+			{ID: "3", Type: oai.ToolTypeFunction, Function: oai.FunctionCall{Name: "answer", Arguments: `{"answer":"none","records":[]}`}},
+		}},
+	)
+	logger := zerolog.Nop()
+	agent := llm.NewAgent(provider, []*llm.AgentTool{{
+		Name: "search",
+		Call: func(ctx context.Context, arguments string) (string, error) {
+			return `{"total":0,"records":[]}`, nil
+		},
+	}}, 3, &logger)
+	_, trace, err := agent.Run(context.Background(), "system", "alchemy?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := regexp.MustCompile(`\[\d+m?s\]`).ReplaceAllString(researchTrace("alchemy?", trace), "[0s]")
+	want := "research: alchemy?\n\n" +
+		"#1 search({\"query\":\"alchemy\"}) [0s]\n{\"total\":0,\"records\":[]}\n\n" +
+		"#1 record({\"id\":\"x\"}) [0s]\nerror: unknown tool record\n\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
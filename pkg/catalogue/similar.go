@@ -0,0 +1,657 @@
+package catalogue
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+	"github.com/je4/ub-bot/v2/pkg/analytics"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"github.com/je4/ubcat/v2/pkg/index"
+	"github.com/je4/ubcat/v2/pkg/schema"
+	"go.opentelemetry.io/otel/attribute"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// the classic Rocchio weights of the relevant and the non relevant records
+const (
+	rocchioPositiveWeight = 0.75
+	rocchioNegativeWeight = 0.15
+)
+
+// defaultModifierWeight is the share of the modifier in the blended vector
+const defaultModifierWeight = 0.3
+
+func similarCommandOptions() []*chat.OptionDefinition {
+	return []*chat.OptionDefinition{
+		{
+			Type: chat.OptionString,
+			Choices: []*chat.OptionChoice{
+				{
+					Name:  "Marc Vector",
+					Value: "marc",
+				},
+				{
+					Name:  "Prose Vector",
+					Value: "prose",
+				},
+				{
+					Name:  "JSON Vector",
+					Value: "json",
+				},
+			},
+			Name:        "querytype",
+			Description: "Query Type",
+			Required:    true,
+		},
+		{
+			Type:        chat.OptionString,
+			Name:        "resultid",
+			Description: "Result ID from previous search or full elastic id",
+			Required:    false,
+		},
+		{
+			Type:        chat.OptionString,
+			Name:        "positive",
+			Description: "Comma separated result IDs or elastic ids to search similar records for",
+			Required:    false,
+		},
+		{
+			Type:        chat.OptionString,
+			Name:        "negative",
+			Description: "Comma separated result IDs or elastic ids to move away from",
+			Required:    false,
+		},
+		{
+			Type:        chat.OptionString,
+			Name:        "modifier",
+			Description: "Text to steer the similarity, e.g. \"but for children\" or \"in French\"",
+			Required:    false,
+		},
+		{
+			Type:        chat.OptionNumber,
+			Name:        "weight",
+			Description: fmt.Sprintf("Share of the modifier between 0 and 1, default %v", defaultModifierWeight),
+			Required:    false,
+		},
+		{
+			Type:        chat.OptionString,
+			Name:        "query",
+			Description: "Keywords, matching records are ranked higher",
+			Required:    false,
+		},
+		{
+			Type:        chat.OptionBoolean,
+			Name:        "restrict",
+			Description: "Only show records matching the keywords",
+			Required:    false,
+		},
+		{
+			Type:        chat.OptionNumber,
+			Name:        "minsimilarity",
+			Description: "Minimum cosine similarity between 0 and 1, less similar records are cut off",
+			Required:    false,
+		},
+	}
+}
+
+func splitIDs(str string) []string {
+	return strings.FieldsFunc(str, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// resultRecords resolves the result numbers of the last search. the records of elastic ids are nil, see loadRecords
+func resultRecords(stat *channelStatus, ids []string) []*schema.UBSchema {
+	records := make([]*schema.UBSchema, len(ids))
+	for num, id := range ids {
+		if resultID, err := strconv.Atoi(id); err == nil && resultID >= 0 && resultID < len(stat.result) {
+			records[num] = stat.result[resultID]
+		}
+	}
+	return records
+}
+
+// loadRecords gets the records of the elastic ids which resultRecords could not resolve
+func (cat *Catalog) loadRecords(ctx context.Context, ids []string, records []*schema.UBSchema) error {
+	elasticIDs := []string{}
+	for num, id := range ids {
+		if records[num] == nil {
+			elasticIDs = append(elasticIDs, id)
+		}
+	}
+	if len(elasticIDs) == 0 {
+		return nil
+	}
+	docs, err := cat.GetDocuments(ctx, elasticIDs...)
+	if err != nil {
+		return errors.Wrapf(err, "Error getting documents %v", elasticIDs)
+	}
+	for num, id := range ids {
+		if records[num] != nil {
+			continue
+		}
+		doc, ok := docs[id]
+		if !ok {
+			return errors.Errorf("Document %s not found", id)
+		}
+		records[num] = doc
+	}
+	return nil
+}
+
+// rocchio combines the vectors into one query vector: the weighted centroid of the positive vectors
+// minus the weighted centroid of the negative vectors, normalized to unit length
+func rocchio(positive, negative [][]float32) ([]float32, error) {
+	if len(positive) == 0 {
+		return nil, errors.New("no positive vectors")
+	}
+	dim := len(positive[0])
+	result := make([]float64, dim)
+	add := func(vectors [][]float32, weight float64) error {
+		for _, vector := range vectors {
+			if len(vector) != dim {
+				return errors.Errorf("vector dimension %d does not match %d", len(vector), dim)
+			}
+			for d, v := range vector {
+				result[d] += weight * float64(v) / float64(len(vectors))
+			}
+		}
+		return nil
+	}
+	if err := add(positive, rocchioPositiveWeight); err != nil {
+		return nil, err
+	}
+	if err := add(negative, -rocchioNegativeWeight); err != nil {
+		return nil, err
+	}
+	return normalize(result)
+}
+
+// blend mixes the modifier vector into the vector with the given weight, normalized to unit length
+func blend(vector, modifier []float32, weight float64) ([]float32, error) {
+	if len(vector) != len(modifier) {
+		return nil, errors.Errorf("modifier dimension %d does not match %d", len(modifier), len(vector))
+	}
+	result := make([]float64, len(vector))
+	for d := range vector {
+		result[d] = (1-weight)*float64(vector[d]) + weight*float64(modifier[d])
+	}
+	return normalize(result)
+}
+
+func normalize(vector []float64) ([]float32, error) {
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		return nil, errors.New("combined vector is zero")
+	}
+	result := make([]float32, len(vector))
+	for d, v := range vector {
+		result[d] = float32(v / norm)
+	}
+	return result, nil
+}
+
+// similarVector combines the vectors of the records. missing vectors are computed from the template of the search type
+func (cat *Catalog) similarVector(ctx context.Context, entry *analytics.Entry, positive, negative []*schema.UBSchema, searchType SearchType) ([]float32, error) {
+	vectors := func(docs []*schema.UBSchema) ([][]float32, error) {
+		result := [][]float32{}
+		for _, doc := range docs {
+			vector, tmpl, err := cat.recordVector(ctx, doc, searchType)
+			if err != nil {
+				return nil, err
+			}
+			if tmpl != nil {
+				entry.Template = tmpl.ID()
+			}
+			result = append(result, vector)
+		}
+		return result, nil
+	}
+	positiveVectors, err := vectors(positive)
+	if err != nil {
+		return nil, err
+	}
+	negativeVectors, err := vectors(negative)
+	if err != nil {
+		return nil, err
+	}
+	return rocchio(positiveVectors, negativeVectors)
+}
+
+// similarMatch restricts or boosts a similarity search by keywords and cuts off less similar records
+type similarMatch struct {
+	query    string
+	restrict bool
+	// minSimilarity is the minimum cosine similarity, 0 for no threshold
+	minSimilarity float64
+}
+
+// keywordQuery returns the keyword query, nil if there are no keywords
+func (m *similarMatch) keywordQuery() *types.Query {
+	if m.query == "" {
+		return nil
+	}
+	return &types.Query{
+		SimpleQueryString: &types.SimpleQueryStringQuery{
+			Query: m.query,
+		},
+	}
+}
+
+// similarRequest builds the script score query of a similarity search.
+// keywords restrict the results or are added to the score of matching records
+func similarRequest(match *similarMatch, filter map[string]string, vector []float32, searchType SearchType) (*search.Request, error) {
+	field, err := vectorField(searchType)
+	if err != nil {
+		return nil, err
+	}
+	if vector == nil {
+		return nil, errors.Errorf("embedding is nil")
+	}
+	vQuery, err := vectorQuery(vector, field)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create vector query")
+	}
+	if match.minSimilarity > 0 {
+		// the script score is the cosine similarity + 1
+		minScore := float32(match.minSimilarity + 1)
+		vQuery.ScriptScore.MinScore = &minScore
+	}
+	boolQuery := &types.BoolQuery{
+		Filter: wildcardFilter(filter),
+		Must:   []types.Query{*vQuery},
+	}
+	if kQuery := match.keywordQuery(); kQuery != nil {
+		if match.restrict {
+			boolQuery.Filter = append(boolQuery.Filter, *kQuery)
+		} else {
+			boolQuery.Should = []types.Query{*kQuery}
+		}
+	}
+	return &search.Request{
+		Query: &types.Query{Bool: boolQuery},
+	}, nil
+}
+
+// similarKNNRequest builds the approximate nearest neighbour query of a similarity search.
+// keywords which do not restrict the results only boost the neighbours, see SimilarSearchKNN
+func similarKNNRequest(match *similarMatch, filter map[string]string, vector []float32, searchType SearchType, k, numCandidates int64) (*search.Request, error) {
+	field, err := vectorField(searchType)
+	if err != nil {
+		return nil, err
+	}
+	if vector == nil {
+		return nil, errors.Errorf("embedding is nil")
+	}
+	knnQuery := types.KnnQuery{
+		Field:         field,
+		QueryVector:   vector,
+		K:             k,
+		NumCandidates: numCandidates,
+	}
+	if match.minSimilarity > 0 {
+		similarity := float32(match.minSimilarity)
+		knnQuery.Similarity = &similarity
+	}
+	esFilter := wildcardFilter(filter)
+	if kQuery := match.keywordQuery(); kQuery != nil && match.restrict {
+		esFilter = append(esFilter, *kQuery)
+	}
+	if len(esFilter) > 0 {
+		knnQuery.Filter = esFilter
+	}
+	return &search.Request{
+		Knn: []types.KnnQuery{knnQuery},
+	}, nil
+}
+
+// similarBoostRequest scores the nearest neighbours found by the knn search again, adding the score of the keywords.
+// the threshold of the script score query is the same as the similarity of the knn search
+func similarBoostRequest(match *similarMatch, filter map[string]string, vector []float32, searchType SearchType, ids []string) (*search.Request, error) {
+	searchRequest, err := similarRequest(match, filter, vector, searchType)
+	if err != nil {
+		return nil, err
+	}
+	searchRequest.Query.Bool.Filter = append(searchRequest.Query.Bool.Filter, types.Query{
+		Ids: &types.IdsQuery{Values: ids},
+	})
+	return searchRequest, nil
+}
+
+func (cat *Catalog) SimilarSearch(ctx context.Context, match *similarMatch, filter map[string]string, vector []float32, searchType SearchType, from, num int64) (result *index.Result, resultErr error) {
+	ctx, span := tracing.Start(ctx, "elastic.SimilarSearch")
+	span.SetAttributes(
+		attribute.String("search.type", searchTypeName(searchType)),
+		attribute.Int64("search.from", from),
+		attribute.Int64("search.num", num),
+	)
+	defer func() { tracing.End(span, resultErr) }()
+	searchRequest, err := similarRequest(match, filter, vector, searchType)
+	if err != nil {
+		return nil, err
+	}
+	result, err = cat.runRequest(ctx, "similarsearch", searchRequest, from, num)
+	if err != nil {
+		return nil, err
+	}
+	result.From = from
+	return result, nil
+}
+
+// SimilarSearchKNN searches the nearest neighbours of the vector, restricted or boosted by keywords.
+// boosting keywords need a second request, which rescores only the neighbours
+func (cat *Catalog) SimilarSearchKNN(ctx context.Context, match *similarMatch, filter map[string]string, vector []float32, searchType SearchType, k, numCandidates int64) (result *index.Result, resultErr error) {
+	ctx, span := tracing.Start(ctx, "elastic.SimilarSearchKNN")
+	span.SetAttributes(
+		attribute.String("search.type", searchTypeName(searchType)),
+		attribute.Int64("search.k", k),
+	)
+	defer func() { tracing.End(span, resultErr) }()
+	searchRequest, err := similarKNNRequest(match, filter, vector, searchType, k, numCandidates)
+	if err != nil {
+		return nil, err
+	}
+	result, err = cat.runRequest(ctx, "similarsearchknn", searchRequest, 0, k)
+	if err != nil || match.query == "" || match.restrict || len(result.Docs) == 0 {
+		return result, err
+	}
+	ids := []string{}
+	for id := range result.Docs {
+		ids = append(ids, id)
+	}
+	boostRequest, err := similarBoostRequest(match, filter, vector, searchType, ids)
+	if err != nil {
+		return nil, err
+	}
+	boosted, err := cat.runRequest(ctx, "similarsearchknnboost", boostRequest, 0, int64(len(ids)))
+	if err != nil {
+		return nil, err
+	}
+	boosted.Total = result.Total
+	return boosted, nil
+}
+
+func similarQuery(positiveIDs, negativeIDs []string, positive []*schema.UBSchema, modifier string, match *similarMatch) string {
+	var query string
+	if len(positiveIDs) == 1 && len(negativeIDs) == 0 {
+		query = fmt.Sprintf("similar:%s - %s", positiveIDs[0], positive[0].GetMainTitle())
+	} else {
+		query = "similar:+" + strings.Join(positiveIDs, ",")
+		if len(negativeIDs) > 0 {
+			query += " -" + strings.Join(negativeIDs, ",")
+		}
+	}
+	if modifier != "" {
+		query += fmt.Sprintf(" ~ %q", modifier)
+	}
+	if match.query != "" {
+		if match.restrict {
+			query += fmt.Sprintf(" & %q", match.query)
+		} else {
+			query += fmt.Sprintf(" + %q", match.query)
+		}
+	}
+	if match.minSimilarity > 0 {
+		query += fmt.Sprintf(" >= %v", match.minSimilarity)
+	}
+	return query
+}
+
+// recordTitles lists the titles of the records, or the ids of records not loaded yet
+func recordTitles(ids []string, docs []*schema.UBSchema) string {
+	titles := []string{}
+	for num, doc := range docs {
+		if doc == nil {
+			titles = append(titles, ids[num])
+			continue
+		}
+		titles = append(titles, doc.GetMainTitle())
+	}
+	return strings.Join(titles, "; ")
+}
+
+func (cat *Catalog) similarCommandFunc(cmdName string) chat.Handler {
+	return func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		async := false
+		defer func() {
+			if !async {
+				cat.endCommand(ctx, entry)
+			}
+		}()
+		var sType, modifier string
+		var positiveIDs, negativeIDs []string
+		weight := defaultModifierWeight
+		weightSet := false
+		match := &similarMatch{}
+		for _, opt := range i.Options() {
+			switch opt.Name {
+			case "querytype":
+				sType = opt.StringValue()
+			case "resultid", "positive":
+				positiveIDs = append(positiveIDs, splitIDs(opt.StringValue())...)
+			case "negative":
+				negativeIDs = append(negativeIDs, splitIDs(opt.StringValue())...)
+			case "modifier":
+				modifier = strings.TrimSpace(opt.StringValue())
+			case "weight":
+				weight = opt.FloatValue()
+				weightSet = true
+			case "query":
+				match.query = strings.TrimSpace(opt.StringValue())
+			case "restrict":
+				match.restrict = opt.BoolValue()
+			case "minsimilarity":
+				match.minSimilarity = opt.FloatValue()
+			}
+		}
+		if sType == "" || len(positiveIDs) == 0 {
+			if err := i.SendInteractionResponseMessage("Please provide search type and result ID"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		if weightSet && modifier == "" {
+			if err := i.SendInteractionResponseMessage("Please provide a modifier for the weight"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		if weight <= 0 || weight > 1 {
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Invalid weight %v, must be between 0 and 1", weight)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		if match.minSimilarity < 0 || match.minSimilarity > 1 {
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Invalid minimum similarity %v, must be between 0 and 1", match.minSimilarity)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		if match.restrict && match.query == "" {
+			if err := i.SendInteractionResponseMessage("Please provide a query to restrict the results"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		var searchType SearchType
+		switch sType {
+		case "marc":
+			searchType = SearchTypeEmbeddingMARC
+		case "prose":
+			searchType = SearchTypeEmbeddingProse
+		case "json":
+			searchType = SearchTypeEmbeddingJSON
+		default:
+			if err := i.SendInteractionResponseMessage(fmt.Sprintf("Unknown search type %s", sType)); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		entry.SearchType = searchTypeName(searchType)
+
+		stat := cat.channelStatus(i)
+		positive := resultRecords(stat, positiveIDs)
+		negative := resultRecords(stat, negativeIDs)
+		for _, p := range positiveIDs {
+			if slices.Contains(negativeIDs, p) {
+				if err := i.SendInteractionResponseMessage(fmt.Sprintf("%s is positive and negative", p)); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+		}
+
+		topic, err := i.ChannelTopic()
+		if err != nil {
+			entry.Error = err.Error()
+			logger.Error().Msgf("Error getting channel: %v", err)
+			if err := i.SendChannelMessage(fmt.Sprintf("Error getting channel: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		filter := FilterFromChannelTopic(topic)
+		entry.Filter = filter
+
+		msg := fmt.Sprintf("searching %s similarities for: %s", searchTypeName(searchType), recordTitles(positiveIDs, positive))
+		if len(negative) > 0 {
+			msg += fmt.Sprintf("\nand not for: %s", recordTitles(negativeIDs, negative))
+		}
+		if modifier != "" {
+			msg += fmt.Sprintf("\nmodified by: %s (weight %v)", modifier, weight)
+		}
+		if match.query != "" {
+			if match.restrict {
+				msg += fmt.Sprintf("\nmatching: %s", match.query)
+			} else {
+				msg += fmt.Sprintf("\nboosted by: %s", match.query)
+			}
+		}
+		if match.minSimilarity > 0 {
+			msg += fmt.Sprintf("\nminimum similarity: %v", match.minSimilarity)
+		}
+		msg += "\nFilter:\n"
+		for k, v := range filter {
+			msg += fmt.Sprintf("%s: %s\n", k, v)
+		}
+		if err := i.SendInteractionResponseMessage(msg); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+		async = cat.enqueue(ctx, i, entry, func() {
+			defer cat.endCommand(ctx, entry)
+			ctx, release := cat.searchContext(ctx, i.Channel())
+			defer release()
+			// the state may have changed while the command was queued
+			stat := cat.channelStatus(i)
+
+			for _, records := range []struct {
+				ids     []string
+				records []*schema.UBSchema
+			}{{positiveIDs, positive}, {negativeIDs, negative}} {
+				if err := cat.loadRecords(ctx, records.ids, records.records); err != nil {
+					entry.Error = err.Error()
+					logger.Error().Msgf("Error getting records: %v", err)
+					if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error getting records", err)); err != nil {
+						logger.Error().Msgf("Error sending response: %v", err)
+					}
+					return
+				}
+			}
+			for _, p := range positive {
+				for _, n := range negative {
+					if p.Id_ == n.Id_ {
+						if err := i.SendChannelMessage(fmt.Sprintf("%s is positive and negative", p.GetMainTitle())); err != nil {
+							logger.Error().Msgf("Error sending response: %v", err)
+						}
+						return
+					}
+				}
+			}
+			lastQuery := similarQuery(positiveIDs, negativeIDs, positive, modifier, match)
+			entry.Query = lastQuery
+			logger.Debug().Msgf("searching %s", lastQuery)
+
+			vector, err := cat.similarVector(ctx, entry, positive, negative, searchType)
+			if err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error computing embedding: %v", err)
+				if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error computing embedding", err)); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			if modifier != "" {
+				modifierVector, err := cat.GetEmbedding(ctx, modifier)
+				if err != nil {
+					entry.Error = err.Error()
+					logger.Error().Msgf("Error computing embedding of modifier: %v", err)
+					if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error computing embedding of modifier", err)); err != nil {
+						logger.Error().Msgf("Error sending response: %v", err)
+					}
+					return
+				}
+				if vector, err = blend(vector, modifierVector, weight); err != nil {
+					entry.Error = err.Error()
+					logger.Error().Msgf("Error blending modifier: %v", err)
+					if err := i.SendChannelMessage(fmt.Sprintf("Error blending modifier: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+						logger.Error().Msgf("Error sending response: %v", err)
+					}
+					return
+				}
+			}
+
+			var result *index.Result
+			if cmdName == cat.prefix+"similarknn" {
+				result, err = cat.SimilarSearchKNN(ctx, match, filter, vector, searchType, stat.config.maxResults, stat.config.maxResults)
+			} else {
+				result, err = cat.SimilarSearch(ctx, match, filter, vector, searchType, 0, stat.config.maxResults)
+			}
+			if err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error searching: %v", err)
+				if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error searching", err)); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			entry.Total = result.Total
+
+			embeds, err := cat.storeResults(i.Channel(), resultDocs(result, nil), result.Total, func(stat *channelStatus) {
+				stat.result = []*schema.UBSchema{}
+				stat.lastQuery = lastQuery
+				stat.lastSearchType = searchType
+				stat.lastVector = vector
+				stat.lastStructured = nil
+				stat.lastMatch = match
+				stat.searchFunc = cmdName
+			})
+			if err != nil {
+				logger.Error().Msgf("Error creating response: %v", err)
+				if err := i.SendChannelMessage(fmt.Sprintf("Error creating response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			if err := i.SendChannelCards(embeds); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+				if err := i.SendChannelMessage(fmt.Sprintf("Error sending response: %v%s", err, tracing.ErrorSuffix(ctx))); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+		})
+	}
+}
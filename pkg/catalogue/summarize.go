@@ -0,0 +1,84 @@
+package catalogue
+
+import (
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/llm"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+)
+
+// summaryChunkTokens is the token budget of the records summarized in one request
+const summaryChunkTokens = 5000
+
+func (cat *Catalog) CommandSummarize() (cmdFunc chat.Handler, appCmd *chat.CommandDefinition) {
+	appCmd = &chat.CommandDefinition{
+		Name:        cat.prefix + "summarize",
+		Description: "let the AI summarize the results of the last search",
+		Options:     []*chat.OptionDefinition{},
+	}
+	cmdFunc = func(i chat.Request) {
+		ctx, entry := cat.beginCommand(i)
+		logger := tracing.Logger(ctx, cat.logger)
+		async := false
+		defer func() {
+			if !async {
+				cat.endCommand(ctx, entry)
+			}
+		}()
+		stat := cat.channelStatus(i)
+		if len(stat.result) == 0 {
+			if err := i.SendInteractionResponseMessage("No search results available"); err != nil {
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+			return
+		}
+		entry.Query = stat.lastQuery
+		entry.SearchType = searchTypeName(stat.lastSearchType)
+		records := []string{}
+		for num, doc := range stat.result {
+			text, _, err := cat.EmbeddingSource(doc, "prose")
+			if err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error rendering result %d: %v", num, err)
+				if err := i.SendInteractionResponseMessage(fmt.Sprintf("Error rendering result %d: %v%s", num, err, tracing.ErrorSuffix(ctx))); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			records = append(records, fmt.Sprintf("[%d] %s", num, text))
+		}
+		if err := i.SendInteractionResponseMessage(fmt.Sprintf("Summarizing %d results", len(records))); err != nil {
+			logger.Error().Msgf("Error sending response: %v", err)
+		}
+		async = cat.enqueue(ctx, i, entry, func() {
+			defer cat.endCommand(ctx, entry)
+			ctx, release := cat.searchContext(ctx, i.Channel())
+			defer release()
+
+			summary, err := llm.Summarize(ctx, cat.meteredChat("summarize"), records, summaryChunkTokens)
+			if err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error summarizing: %v", err)
+				if err := i.SendChannelMessage(cat.searchErrorMessage(ctx, "Error summarizing", err)); err != nil {
+					logger.Error().Msgf("Error sending response: %v", err)
+				}
+				return
+			}
+			entry.Total = int64(len(records))
+			if err := i.SendChannelCards([]*chat.Card{{
+				Author: &chat.CardAuthor{
+					Name: "ub-bot",
+				},
+				Title:       fmt.Sprintf("Summary of %d results", len(records)),
+				Description: summary,
+				Footer: &chat.CardFooter{
+					Text: fmt.Sprintf("Query: %s", stat.lastQuery),
+				},
+			}}); err != nil {
+				entry.Error = err.Error()
+				logger.Error().Msgf("Error sending response: %v", err)
+			}
+		})
+	}
+	return
+}
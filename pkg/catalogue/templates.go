@@ -0,0 +1,117 @@
+package catalogue
+
+import (
+	"context"
+	"crypto/sha1"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/templates"
+	"github.com/je4/ubcat/v2/pkg/schema"
+	"sort"
+	"strings"
+	"time"
+)
+
+// embeddingVersion records which template version an embedding was computed from
+type embeddingVersion struct {
+	Template string    `json:"template"`
+	Version  string    `json:"version"`
+	Record   string    `json:"record"`
+	Time     time.Time `json:"time"`
+}
+
+// TemplateEmbedding renders the record with the named template and computes the embedding of the text.
+// the template version is stored next to the cached embedding
+func (cat *Catalog) TemplateEmbedding(ctx context.Context, doc *schema.UBSchema, name string) ([]float32, *templates.Template, error) {
+	tmpl, err := cat.templates.Get(name)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	text, err := tmpl.Execute(doc)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	embedding, err := cat.GetEmbedding(ctx, text)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot create embedding of %s", doc.Id_)
+	}
+	data, err := json.Marshal(&embeddingVersion{
+		Template: tmpl.Name,
+		Version:  tmpl.Version,
+		Record:   doc.Id_,
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot marshal embedding version")
+	}
+	key := fmt.Sprintf("embedding-version-%x", sha1.Sum([]byte(text)))
+	if err := cat.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), data)
+	}); err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot store embedding version %s", key)
+	}
+	return embedding, tmpl, nil
+}
+
+func (cat *Catalog) templateChoices() []*chat.OptionChoice {
+	choices := []*chat.OptionChoice{}
+	for _, name := range cat.templates.Names() {
+		choices = append(choices, &chat.OptionChoice{
+			Name:  name,
+			Value: name,
+		})
+	}
+	return choices
+}
+
+// EmbeddingSource returns the text from which the vector of the given type was computed and its source.
+// prose and json are the texts of the indexer. the marc serialisation of the indexer is not available,
+// the marc template with leader and control fields only approximates it
+func (cat *Catalog) EmbeddingSource(doc *schema.UBSchema, vectorType string) (text string, source string, err error) {
+	switch vectorType {
+	case "prose":
+		tmpl, err := cat.templates.Get("prose")
+		if err != nil {
+			return "", "", errors.WithStack(err)
+		}
+		text, err := tmpl.Execute(doc)
+		return text, tmpl.ID(), err
+	case "json":
+		return doc.GetAIJSON(), "ubcat GetAIJSON", nil
+	case "marc":
+		tmpl, err := cat.templates.Get("marc")
+		if err != nil {
+			return "", "", errors.WithStack(err)
+		}
+		fields, err := tmpl.Execute(doc)
+		if err != nil {
+			return "", "", err
+		}
+		lines := []string{}
+		if len(doc.Ldr) > 0 {
+			parts := []string{}
+			for _, key := range sortedKeys(doc.Ldr) {
+				parts = append(parts, fmt.Sprintf("%s=%s", key, doc.Ldr[key]))
+			}
+			lines = append(lines, "LDR "+strings.Join(parts, " "))
+		}
+		for _, tag := range sortedKeys(doc.Controlfield) {
+			lines = append(lines, fmt.Sprintf("%s %s", tag, doc.Controlfield[tag]))
+		}
+		return strings.TrimSpace(strings.Join(lines, "\n") + "\n" + fields), "approximation " + tmpl.ID(), nil
+	default:
+		return "", "", errors.Errorf("unknown vector type %s", vectorType)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
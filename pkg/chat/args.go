@@ -0,0 +1,93 @@
+package chat
+
+import (
+	"emperror.dev/errors"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SplitArgs splits a command line at whitespace, respecting double quotes
+func SplitArgs(line string) ([]string, error) {
+	args := []string{}
+	var current strings.Builder
+	inQuote := false
+	inArg := false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			inArg = true
+		case unicode.IsSpace(r) && !inQuote:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// ParseOptions converts arguments of the form name:value into the options of the command.
+// words without a known option name are appended to the previous value, so that "query:Basler Mission" works without quotes
+func ParseOptions(def *CommandDefinition, args []string) ([]*Option, error) {
+	values := map[string]string{}
+	var current string
+	for _, arg := range args {
+		name, value, found := strings.Cut(arg, ":")
+		if found && slices.ContainsFunc(def.Options, func(opt *OptionDefinition) bool { return opt.Name == name }) {
+			current = name
+			values[current] = value
+			continue
+		}
+		if current == "" {
+			return nil, errors.Errorf("unknown option %s", arg)
+		}
+		values[current] += " " + arg
+	}
+	// keep the order of the definition, handlers may rely on it
+	options := []*Option{}
+	for _, opt := range def.Options {
+		value, ok := values[opt.Name]
+		if !ok {
+			if opt.Required {
+				return nil, errors.Errorf("missing option %s", opt.Name)
+			}
+			continue
+		}
+		option := &Option{Name: opt.Name, Value: value}
+		switch opt.Type {
+		case OptionInteger:
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid integer %s for option %s", value, opt.Name)
+			}
+			option.Value = i
+		case OptionNumber:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid number %s for option %s", value, opt.Name)
+			}
+			option.Value = f
+		case OptionBoolean:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid boolean %s for option %s", value, opt.Name)
+			}
+			option.Value = b
+		}
+		options = append(options, option)
+	}
+	return options, nil
+}
@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+type Handler func(req Request)
+
+// Request is a command invocation together with the means to answer it, independent of the transport
+type Request interface {
+	// Context carries the span of the request
+	Context() context.Context
+	CommandName() string
+	Options() []*Option
+	// Channel identifies the conversation, the state of searches is kept per channel
+	Channel() string
+	Guild() string
+	UserID() string
+	UserName() string
+	Roles() []string
+	IsGuildAdmin() bool
+	// ChannelTopic returns the topic of the channel, which may contain filters
+	ChannelTopic() (string, error)
+
+	// SendInteractionResponseMessage answers the request
+	SendInteractionResponseMessage(msg string) error
+	// SendInteractionResponseCards answers the request with cards
+	SendInteractionResponseCards(cards []*Card) error
+	// SendChannelMessage sends a further message
+	SendChannelMessage(msg string) error
+	// SendChannelCards sends further cards
+	SendChannelCards(cards []*Card) error
+	// SendChannelCardsWithFiles sends further cards with attachments
+	SendChannelCardsWithFiles(cards []*Card, files []*File) error
+}
+
+// CommandHelp is the documentation of a command beyond its definition
+type CommandHelp struct {
+	// Long is a detailed description
+	Long string
+	// Examples are invocations without the leading slash and prefix
+	Examples []string
+}
+
+type Command struct {
+	Definition *CommandDefinition
+	Handler    Handler
+	Help       *CommandHelp
+}
+
+type Option struct {
+	Name  string
+	Value any
+}
+
+func (o *Option) StringValue() string {
+	if o == nil {
+		return ""
+	}
+	if s, ok := o.Value.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", o.Value)
+}
+
+func (o *Option) IntValue() int64 {
+	if o == nil {
+		return 0
+	}
+	switch v := o.Value.(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case string:
+		i, _ := strconv.ParseInt(v, 10, 64)
+		return i
+	default:
+		return 0
+	}
+}
+
+func (o *Option) FloatValue() float64 {
+	if o == nil {
+		return 0
+	}
+	switch v := o.Value.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	default:
+		return 0
+	}
+}
+
+func (o *Option) BoolValue() bool {
+	if o == nil {
+		return false
+	}
+	switch v := o.Value.(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	default:
+		return false
+	}
+}
@@ -0,0 +1,76 @@
+package chat
+
+import (
+	"io"
+)
+
+type OptionType int
+
+const (
+	OptionString OptionType = iota + 1
+	OptionInteger
+	OptionBoolean
+	OptionNumber
+)
+
+type CommandDefinition struct {
+	Name        string
+	Description string
+	Options     []*OptionDefinition
+}
+
+type OptionDefinition struct {
+	Type        OptionType
+	Name        string
+	Description string
+	Required    bool
+	Choices     []*OptionChoice
+}
+
+type OptionChoice struct {
+	Name  string
+	Value any
+}
+
+type Card struct {
+	Author      *CardAuthor
+	Title       string
+	URL         string
+	Description string
+	Fields      []*CardField
+	Footer      *CardFooter
+	// Color is an RGB value, 0 for the platform default
+	Color int
+	// Buttons are shown below the card, platforms without buttons render them as links
+	Buttons []*Button
+}
+
+type CardAuthor struct {
+	Name string
+}
+
+type CardField struct {
+	Name   string
+	Value  string
+	Inline bool
+}
+
+type CardFooter struct {
+	Text string
+}
+
+type Button struct {
+	Label string
+	URL   string
+}
+
+type File struct {
+	Name        string
+	ContentType string
+	Reader      io.Reader
+}
+
+// Authorizer decides whether a user may run a command. the error message is shown to the user
+type Authorizer interface {
+	Authorize(guildID, userID string, roles []string, guildAdmin bool, command string) error
+}
@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const ellipsis = "…"
+
+// Truncate shortens text to at most max runes. truncated text ends with an ellipsis
+func Truncate(text string, max int) string {
+	if max <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:max-1]) + ellipsis
+}
+
+// SplitText splits text into parts of at most max runes. it splits at line breaks if possible
+func SplitText(text string, max int) []string {
+	parts := []string{}
+	if max <= 0 {
+		return parts
+	}
+	var current strings.Builder
+	currentLen := 0
+	flush := func() {
+		if currentLen > 0 {
+			parts = append(parts, current.String())
+			current.Reset()
+			currentLen = 0
+		}
+	}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		lineLen := utf8.RuneCountInString(line)
+		if currentLen+lineLen <= max {
+			current.WriteString(line)
+			currentLen += lineLen
+			continue
+		}
+		flush()
+		// lines longer than max are split at rune boundaries
+		runes := []rune(line)
+		for len(runes) > max {
+			parts = append(parts, string(runes[:max]))
+			runes = runes[max:]
+		}
+		current.WriteString(string(runes))
+		currentLen = len(runes)
+	}
+	flush()
+	return parts
+}
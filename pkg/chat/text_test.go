@@ -0,0 +1,74 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		max  int
+		want string
+	}{
+		{"", 5, ""},
+		{"abc", 0, ""},
+		{"abc", -1, ""},
+		{"abc", 3, "abc"},
+		{"abcd", 3, "ab…"},
+		{"abc", 1, "…"},
+		{"äöü", 3, "äöü"},
+		{"äöüß", 3, "äö…"},
+		{"日本語のテキスト", 4, "日本語…"},
+		{"🙂🙂🙂", 2, "🙂…"},
+	} {
+		got := Truncate(test.text, test.max)
+		if got != test.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", test.text, test.max, got, test.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("Truncate(%q, %d) is no valid utf-8", test.text, test.max)
+		}
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		max  int
+		want []string
+	}{
+		{"", 5, []string{}},
+		{"abc", 0, []string{}},
+		{"abc", 3, []string{"abc"}},
+		{"ab\ncd\n", 3, []string{"ab\n", "cd\n"}},
+		{"ab\ncd", 5, []string{"ab\ncd"}},
+		{"a\nb\nc\n", 4, []string{"a\nb\n", "c\n"}},
+		{"abcdefg", 3, []string{"abc", "def", "g"}},
+		{"äöüäöü", 3, []string{"äöü", "äöü"}},
+		{"x\näöüäöüä", 3, []string{"x\n", "äöü", "äöü", "ä"}},
+		{"🙂🙂🙂\n🙂", 3, []string{"🙂🙂🙂", "\n🙂"}},
+	} {
+		got := SplitText(test.text, test.max)
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+			t.Errorf("SplitText(%q, %d) = %q, want %q", test.text, test.max, got, test.want)
+		}
+	}
+}
+
+func TestSplitTextLimits(t *testing.T) {
+	text := strings.Repeat("Zürich 日本 🙂\n", 50) + strings.Repeat("ß", 333)
+	for _, max := range []int{1, 7, 13, 100, 2000} {
+		parts := SplitText(text, max)
+		if strings.Join(parts, "") != text {
+			t.Errorf("max %d: parts do not add up to the text", max)
+		}
+		for _, part := range parts {
+			if part == "" || utf8.RuneCountInString(part) > max || !utf8.ValidString(part) {
+				t.Errorf("max %d: invalid part %q", max, part)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+)
+
+// discord allows 5 action rows with 5 buttons each per message
+const maxButtonRows = 5
+const maxButtonsPerRow = 5
+
+var optionTypes = map[chat.OptionType]discordgo.ApplicationCommandOptionType{
+	chat.OptionString:  discordgo.ApplicationCommandOptionString,
+	chat.OptionInteger: discordgo.ApplicationCommandOptionInteger,
+	chat.OptionBoolean: discordgo.ApplicationCommandOptionBoolean,
+	chat.OptionNumber:  discordgo.ApplicationCommandOptionNumber,
+}
+
+func ApplicationCommand(def *chat.CommandDefinition) *discordgo.ApplicationCommand {
+	cmd := &discordgo.ApplicationCommand{
+		Type:        discordgo.ChatApplicationCommand,
+		Name:        def.Name,
+		Description: def.Description,
+		Options:     []*discordgo.ApplicationCommandOption{},
+	}
+	for _, opt := range def.Options {
+		option := &discordgo.ApplicationCommandOption{
+			Type:        optionTypes[opt.Type],
+			Name:        opt.Name,
+			Description: opt.Description,
+			Required:    opt.Required,
+		}
+		for _, choice := range opt.Choices {
+			option.Choices = append(option.Choices, &discordgo.ApplicationCommandOptionChoice{
+				Name:  choice.Name,
+				Value: choice.Value,
+			})
+		}
+		cmd.Options = append(cmd.Options, option)
+	}
+	return cmd
+}
+
+// messageEmbed converts a card to an embed within the discord limits. the buttons are sent as message components
+func messageEmbed(card *chat.Card) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Title:       card.Title,
+		URL:         card.URL,
+		Description: card.Description,
+		Color:       card.Color,
+	}
+	if card.Author != nil {
+		embed.Author = &discordgo.MessageEmbedAuthor{Name: card.Author.Name}
+	}
+	for _, field := range card.Fields {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   field.Name,
+			Value:  field.Value,
+			Inline: field.Inline,
+		})
+	}
+	if card.Footer != nil {
+		embed.Footer = &discordgo.MessageEmbedFooter{Text: card.Footer.Text}
+	}
+	return fitEmbed(embed)
+}
+
+func messageEmbeds(cards []*chat.Card) []*discordgo.MessageEmbed {
+	embeds := []*discordgo.MessageEmbed{}
+	for _, card := range cards {
+		embeds = append(embeds, messageEmbed(card))
+	}
+	return embeds
+}
+
+// buttonComponents converts the buttons of the cards to link buttons. buttons beyond the discord limit are dropped
+func buttonComponents(cards []*chat.Card) []discordgo.MessageComponent {
+	rows := []discordgo.MessageComponent{}
+	row := discordgo.ActionsRow{}
+	for _, card := range cards {
+		for _, button := range card.Buttons {
+			if len(row.Components) == maxButtonsPerRow {
+				rows = append(rows, row)
+				row = discordgo.ActionsRow{}
+			}
+			if len(rows) == maxButtonRows {
+				return rows
+			}
+			row.Components = append(row.Components, discordgo.Button{
+				Label: button.Label,
+				Style: discordgo.LinkButton,
+				URL:   button.URL,
+			})
+		}
+	}
+	if len(row.Components) > 0 {
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func discordFiles(files []*chat.File) []*discordgo.File {
+	result := []*discordgo.File{}
+	for _, file := range files {
+		result = append(result, &discordgo.File{
+			Name:        file.Name,
+			ContentType: file.ContentType,
+			Reader:      file.Reader,
+		})
+	}
+	return result
+}
@@ -1,12 +1,16 @@
 package discord
 
 import (
+	"context"
 	"emperror.dev/errors"
 	"github.com/bwmarrin/discordgo"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"sync/atomic"
 )
 
-func (d *Session) NewInteraction(interaction *discordgo.Interaction) *Interaction {
+func (d *Session) NewInteraction(ctx context.Context, interaction *discordgo.Interaction) *Interaction {
 	return &Interaction{
+		ctx:         ctx,
 		session:     d.session,
 		Interaction: interaction,
 	}
@@ -14,49 +18,189 @@ func (d *Session) NewInteraction(interaction *discordgo.Interaction) *Interactio
 
 type Interaction struct {
 	*discordgo.Interaction
-	session *discordgo.Session
+	ctx       context.Context
+	session   *discordgo.Session
+	responded atomic.Bool
 }
 
 func (i *Interaction) GetSession() *discordgo.Session {
 	return i.session
 }
 
+func (i *Interaction) CommandName() string {
+	return i.ApplicationCommandData().Name
+}
+
+func (i *Interaction) Options() []*chat.Option {
+	options := []*chat.Option{}
+	for _, opt := range i.ApplicationCommandData().Options {
+		options = append(options, &chat.Option{
+			Name:  opt.Name,
+			Value: opt.Value,
+		})
+	}
+	return options
+}
+
+func (i *Interaction) Channel() string {
+	return i.ChannelID
+}
+
+func (i *Interaction) Guild() string {
+	return i.GuildID
+}
+
+// ChannelTopic returns the topic of the channel from the state cache
+func (i *Interaction) ChannelTopic() (string, error) {
+	channel, err := i.session.State.Channel(i.ChannelID)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get channel %s", i.ChannelID)
+	}
+	return channel.Topic, nil
+}
+
+func (i *Interaction) UserName() string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.Username
+	}
+	if i.User != nil {
+		return i.User.Username
+	}
+	return ""
+}
+
+func (i *Interaction) UserID() string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
+
+// Roles returns the IDs and, if known, the names of the member's roles
+func (i *Interaction) Roles() []string {
+	if i.Member == nil {
+		return nil
+	}
+	roles := []string{}
+	for _, roleID := range i.Member.Roles {
+		roles = append(roles, roleID)
+		if role, err := i.session.State.Role(i.GuildID, roleID); err == nil {
+			roles = append(roles, role.Name)
+		}
+	}
+	return roles
+}
+
+func (i *Interaction) IsGuildAdmin() bool {
+	return i.Member != nil && i.Member.Permissions&discordgo.PermissionAdministrator != 0
+}
+
+func (i *Interaction) Context() context.Context {
+	if i.ctx == nil {
+		return context.Background()
+	}
+	return i.ctx
+}
+
+// SendInteractionResponseMessage answers the interaction. long messages are split into several messages or attached as file.
+// if the interaction has already been answered, the message is sent to the channel
 func (i *Interaction) SendInteractionResponseMessage(msg string) error {
+	if !i.responded.CompareAndSwap(false, true) {
+		return i.SendChannelMessage(msg)
+	}
+	parts, file := splitMessage(msg)
+	data := &discordgo.InteractionResponseData{}
+	if file != nil {
+		data.Content = "The message is too long and attached as file"
+		data.Files = []*discordgo.File{file}
+	} else if len(parts) > 0 {
+		data.Content = parts[0]
+		parts = parts[1:]
+	}
 	if err := i.session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
-		Data: &discordgo.InteractionResponseData{
-			Content: msg,
-		},
+		Data: data,
 	}); err != nil {
 		return errors.Wrap(err, "cannot send interaction response")
 	}
+	for _, part := range parts {
+		if _, err := i.session.ChannelMessageSend(i.ChannelID, part); err != nil {
+			return errors.Wrap(err, "cannot send channel message")
+		}
+	}
 	return nil
 }
 
-func (i *Interaction) SendInteractionResponseEmbeds(embeds []*discordgo.MessageEmbed) error {
+// SendInteractionResponseCards answers the interaction with up to ten cards per message.
+// if the interaction has already been answered, the cards are sent to the channel
+func (i *Interaction) SendInteractionResponseCards(cards []*chat.Card) error {
+	if !i.responded.CompareAndSwap(false, true) {
+		return i.SendChannelCards(cards)
+	}
+	messages := packCards(cards)
+	if len(messages) == 0 {
+		return nil
+	}
 	if err := i.session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Embeds: embeds,
+			Embeds:     messageEmbeds(messages[0]),
+			Components: buttonComponents(messages[0]),
 		},
 	}); err != nil {
 		return errors.Wrap(err, "cannot send interaction response")
 	}
-	return nil
+	return i.sendCardMessages(messages[1:], nil)
 }
 
-func (i *Interaction) SendChannelEmbeds(embeds []*discordgo.MessageEmbed) error {
-	for _, embed := range embeds {
-		if _, err := i.session.ChannelMessageSendEmbed(i.ChannelID, embed); err != nil {
-			return errors.Wrap(err, "cannot send channel embeds")
+func (i *Interaction) SendChannelCards(cards []*chat.Card) error {
+	return i.sendCardMessages(packCards(cards), nil)
+}
+
+// SendChannelMessage sends the message to the channel. long messages are split into several messages or attached as file
+func (i *Interaction) SendChannelMessage(msg string) error {
+	parts, file := splitMessage(msg)
+	if file != nil {
+		if _, err := i.session.ChannelMessageSendComplex(i.ChannelID, &discordgo.MessageSend{
+			Content: "The message is too long and attached as file",
+			Files:   []*discordgo.File{file},
+		}); err != nil {
+			return errors.Wrap(err, "cannot send channel message")
+		}
+		return nil
+	}
+	for _, part := range parts {
+		if _, err := i.session.ChannelMessageSend(i.ChannelID, part); err != nil {
+			return errors.Wrap(err, "cannot send channel message")
 		}
 	}
 	return nil
 }
 
-func (i *Interaction) SendChannelMessage(msg string) error {
-	if _, err := i.session.ChannelMessageSend(i.ChannelID, msg); err != nil {
-		return errors.Wrap(err, "cannot send channel message")
+// SendChannelCardsWithFiles sends the cards with up to ten cards per message. the files are attached to the last message
+func (i *Interaction) SendChannelCardsWithFiles(cards []*chat.Card, files []*chat.File) error {
+	messages := packCards(cards)
+	if len(messages) == 0 {
+		messages = [][]*chat.Card{{}}
+	}
+	return i.sendCardMessages(messages, discordFiles(files))
+}
+
+func (i *Interaction) sendCardMessages(messages [][]*chat.Card, files []*discordgo.File) error {
+	for num, cards := range messages {
+		msg := &discordgo.MessageSend{
+			Embeds:     messageEmbeds(cards),
+			Components: buttonComponents(cards),
+		}
+		if num == len(messages)-1 {
+			msg.Files = files
+		}
+		if _, err := i.session.ChannelMessageSendComplex(i.ChannelID, msg); err != nil {
+			return errors.Wrap(err, "cannot send channel embeds")
+		}
 	}
 	return nil
 }
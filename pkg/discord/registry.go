@@ -0,0 +1,169 @@
+package discord
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"slices"
+)
+
+type Command struct {
+	Definition *discordgo.ApplicationCommand
+	Handler    CommandCreate
+	Help       *chat.CommandHelp
+}
+
+// CommandDiff lists the differences between the registered and the deployed commands
+type CommandDiff struct {
+	Added   []string
+	Changed []string
+	// Stale commands are deployed at discord but not registered
+	Stale     []string
+	Unchanged []string
+}
+
+// Register adds a command to the registry. the commands are deployed with SyncCommands.
+// help may be nil
+func (d *Session) Register(createFunc CommandCreate, cmd *discordgo.ApplicationCommand, help *chat.CommandHelp) error {
+	if _, ok := d.interactions[cmd.Name]; ok {
+		return errors.Errorf("command %s already registered", cmd.Name)
+	}
+	if cmd.Type == 0 {
+		cmd.Type = discordgo.ChatApplicationCommand
+	}
+	d.interactions[cmd.Name] = d.handler(cmd, createFunc)
+	d.commands = append(d.commands, &Command{
+		Definition: cmd,
+		Handler:    createFunc,
+		Help:       help,
+	})
+	return nil
+}
+
+func (d *Session) RegisterCommands(commands []*chat.Command) error {
+	for _, cmd := range commands {
+		handler := cmd.Handler
+		if err := d.Register(func(i *Interaction) { handler(i) }, ApplicationCommand(cmd.Definition), cmd.Help); err != nil {
+			return errors.Wrapf(err, "cannot register %s command", cmd.Definition.Name)
+		}
+	}
+	return nil
+}
+
+// Commands returns the registered commands in registration order
+func (d *Session) Commands() []*Command {
+	return slices.Clone(d.commands)
+}
+
+// commandSchema returns the comparable part of a command definition
+func commandSchema(cmd *discordgo.ApplicationCommand) (string, error) {
+	cmdType := cmd.Type
+	if cmdType == 0 {
+		cmdType = discordgo.ChatApplicationCommand
+	}
+	options := cmd.Options
+	if len(options) == 0 {
+		options = nil
+	}
+	data, err := json.Marshal(&discordgo.ApplicationCommand{
+		Type:        cmdType,
+		Name:        cmd.Name,
+		Description: cmd.Description,
+		Options:     options,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot marshal command %s", cmd.Name)
+	}
+	return string(data), nil
+}
+
+func (d *Session) DiffCommands() (*CommandDiff, []*discordgo.ApplicationCommand, error) {
+	deployed, err := d.session.ApplicationCommands(d.appID, d.guildID)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot get deployed commands")
+	}
+	deployedSchema := map[string]string{}
+	for _, cmd := range deployed {
+		if deployedSchema[cmd.Name], err = commandSchema(cmd); err != nil {
+			return nil, nil, err
+		}
+	}
+	diff := &CommandDiff{}
+	for _, cmd := range d.commands {
+		schema, err := commandSchema(cmd.Definition)
+		if err != nil {
+			return nil, nil, err
+		}
+		remote, ok := deployedSchema[cmd.Definition.Name]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, cmd.Definition.Name)
+		case remote != schema:
+			diff.Changed = append(diff.Changed, cmd.Definition.Name)
+		default:
+			diff.Unchanged = append(diff.Unchanged, cmd.Definition.Name)
+		}
+	}
+	for _, cmd := range deployed {
+		if _, ok := d.interactions[cmd.Name]; !ok {
+			diff.Stale = append(diff.Stale, cmd.Name)
+		}
+	}
+	return diff, deployed, nil
+}
+
+// SyncCommands deploys the registered commands with a single bulk overwrite.
+// stale commands are kept, they are only removed by PruneCommands
+func (d *Session) SyncCommands() (*CommandDiff, error) {
+	diff, deployed, err := d.DiffCommands()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range diff.Added {
+		d.logger.Info().Msgf("Command %s added", name)
+	}
+	for _, name := range diff.Changed {
+		d.logger.Info().Msgf("Command %s changed", name)
+	}
+	for _, name := range diff.Stale {
+		d.logger.Warn().Msgf("Command %s is not registered anymore, remove it with \"commands prune\"", name)
+	}
+	if len(diff.Added) == 0 && len(diff.Changed) == 0 {
+		d.logger.Info().Msgf("%d commands up to date", len(diff.Unchanged))
+		return diff, nil
+	}
+	cmds := []*discordgo.ApplicationCommand{}
+	for _, cmd := range d.commands {
+		cmds = append(cmds, cmd.Definition)
+	}
+	for _, cmd := range deployed {
+		if slices.Contains(diff.Stale, cmd.Name) {
+			cmds = append(cmds, cmd)
+		}
+	}
+	if _, err := d.session.ApplicationCommandBulkOverwrite(d.appID, d.guildID, cmds); err != nil {
+		return nil, errors.Wrap(err, "cannot overwrite application commands")
+	}
+	d.logger.Info().Msgf("%d commands deployed", len(cmds))
+	return diff, nil
+}
+
+// PruneCommands deploys only the registered commands and removes all others
+func (d *Session) PruneCommands() (*CommandDiff, error) {
+	diff, _, err := d.DiffCommands()
+	if err != nil {
+		return nil, err
+	}
+	cmds := []*discordgo.ApplicationCommand{}
+	for _, cmd := range d.commands {
+		cmds = append(cmds, cmd.Definition)
+	}
+	if _, err := d.session.ApplicationCommandBulkOverwrite(d.appID, d.guildID, cmds); err != nil {
+		return nil, errors.Wrap(err, "cannot overwrite application commands")
+	}
+	for _, name := range diff.Stale {
+		d.logger.Info().Msgf("Command %s removed", name)
+	}
+	return diff, nil
+}
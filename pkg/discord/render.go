@@ -0,0 +1,122 @@
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"strings"
+	"unicode/utf8"
+)
+
+// discord message limits, counted in characters
+const (
+	maxMessageLength     = 2000
+	maxEmbedsPerMessage  = 10
+	maxEmbedsSize        = 6000
+	maxTitleLength       = 256
+	maxDescriptionLength = 4096
+	maxFields            = 25
+	maxFieldNameLength   = 256
+	maxFieldValueLength  = 1024
+	maxFooterLength      = 2048
+	maxAuthorLength      = 256
+)
+
+// maxTextMessages is the number of messages a text may be split into, longer texts are attached as file
+const maxTextMessages = 3
+
+const textFileName = "message.txt"
+
+// emptyMessage is sent instead of a text without content, which discord rejects
+const emptyMessage = "(no content)"
+
+// fitEmbed truncates all parts of the embed to the discord limits
+func fitEmbed(embed *discordgo.MessageEmbed) *discordgo.MessageEmbed {
+	embed.Title = chat.Truncate(embed.Title, maxTitleLength)
+	embed.Description = chat.Truncate(embed.Description, maxDescriptionLength)
+	if embed.Author != nil {
+		embed.Author.Name = chat.Truncate(embed.Author.Name, maxAuthorLength)
+	}
+	if len(embed.Fields) > maxFields {
+		embed.Fields = embed.Fields[:maxFields]
+	}
+	for _, field := range embed.Fields {
+		field.Name = chat.Truncate(field.Name, maxFieldNameLength)
+		field.Value = chat.Truncate(field.Value, maxFieldValueLength)
+		// discord rejects empty field names and values
+		if field.Name == "" {
+			field.Name = "\u200b"
+		}
+		if field.Value == "" {
+			field.Value = "-"
+		}
+	}
+	if embed.Footer != nil {
+		embed.Footer.Text = chat.Truncate(embed.Footer.Text, maxFooterLength)
+	}
+	// drop fields from the end until the embed fits into a message
+	for embedSize(embed) > maxEmbedsSize && len(embed.Fields) > 0 {
+		embed.Fields = embed.Fields[:len(embed.Fields)-1]
+	}
+	if size := embedSize(embed); size > maxEmbedsSize {
+		embed.Description = chat.Truncate(embed.Description, utf8.RuneCountInString(embed.Description)-(size-maxEmbedsSize))
+	}
+	return embed
+}
+
+// embedSize counts the characters of the embed as discord does for the size limit
+func embedSize(embed *discordgo.MessageEmbed) int {
+	size := utf8.RuneCountInString(embed.Title) + utf8.RuneCountInString(embed.Description)
+	if embed.Author != nil {
+		size += utf8.RuneCountInString(embed.Author.Name)
+	}
+	for _, field := range embed.Fields {
+		size += utf8.RuneCountInString(field.Name) + utf8.RuneCountInString(field.Value)
+	}
+	if embed.Footer != nil {
+		size += utf8.RuneCountInString(embed.Footer.Text)
+	}
+	return size
+}
+
+// packCards groups the cards into messages of at most ten embeds and 6000 characters
+func packCards(cards []*chat.Card) [][]*chat.Card {
+	messages := [][]*chat.Card{}
+	current := []*chat.Card{}
+	currentSize := 0
+	for _, card := range cards {
+		size := embedSize(messageEmbed(card))
+		if len(current) > 0 && (len(current) == maxEmbedsPerMessage || currentSize+size > maxEmbedsSize) {
+			messages = append(messages, current)
+			current = []*chat.Card{}
+			currentSize = 0
+		}
+		current = append(current, card)
+		currentSize += size
+	}
+	if len(current) > 0 {
+		messages = append(messages, current)
+	}
+	return messages
+}
+
+// splitMessage splits text into messages at line boundaries.
+// if more than maxTextMessages would be needed, the text is returned as file
+func splitMessage(text string) ([]string, *discordgo.File) {
+	if strings.TrimSpace(text) == "" {
+		return []string{emptyMessage}, nil
+	}
+	parts := []string{}
+	for _, part := range chat.SplitText(text, maxMessageLength) {
+		if strings.TrimSpace(part) != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) <= maxTextMessages {
+		return parts, nil
+	}
+	return nil, &discordgo.File{
+		Name:        textFileName,
+		ContentType: "text/plain; charset=utf-8",
+		Reader:      strings.NewReader(text),
+	}
+}
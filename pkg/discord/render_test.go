@@ -0,0 +1,174 @@
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"io"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func checkEmbed(t *testing.T, embed *discordgo.MessageEmbed) {
+	t.Helper()
+	if size := embedSize(embed); size > maxEmbedsSize {
+		t.Errorf("embed of %d characters", size)
+	}
+	if utf8.RuneCountInString(embed.Title) > maxTitleLength || utf8.RuneCountInString(embed.Description) > maxDescriptionLength {
+		t.Errorf("title or description too long")
+	}
+	if embed.Author != nil && utf8.RuneCountInString(embed.Author.Name) > maxAuthorLength {
+		t.Errorf("author too long")
+	}
+	if embed.Footer != nil && utf8.RuneCountInString(embed.Footer.Text) > maxFooterLength {
+		t.Errorf("footer too long")
+	}
+	if len(embed.Fields) > maxFields {
+		t.Errorf("%d fields", len(embed.Fields))
+	}
+	for _, field := range embed.Fields {
+		if field.Name == "" || field.Value == "" || utf8.RuneCountInString(field.Name) > maxFieldNameLength || utf8.RuneCountInString(field.Value) > maxFieldValueLength {
+			t.Errorf("invalid field %q: %q", field.Name, field.Value)
+		}
+	}
+}
+
+func TestFitEmbed(t *testing.T) {
+	fields := []*discordgo.MessageEmbedField{}
+	for n := 0; n < 30; n++ {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  strings.Repeat("ä", 300),
+			Value: strings.Repeat("日", 2000),
+		})
+	}
+	embed := fitEmbed(&discordgo.MessageEmbed{
+		Title:       strings.Repeat("ö", 300),
+		Description: strings.Repeat("ü", 5000),
+		Author:      &discordgo.MessageEmbedAuthor{Name: strings.Repeat("a", 300)},
+		Fields:      fields,
+		Footer:      &discordgo.MessageEmbedFooter{Text: strings.Repeat("f", 3000)},
+	})
+	checkEmbed(t, embed)
+	if len(embed.Fields) != 0 {
+		t.Errorf("%d fields left in an embed with full description", len(embed.Fields))
+	}
+	if !strings.HasSuffix(embed.Description, "…") {
+		t.Errorf("description not truncated")
+	}
+
+	// fields are dropped from the end until the embed fits
+	fields = []*discordgo.MessageEmbedField{}
+	for n := 0; n < 30; n++ {
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "name", Value: strings.Repeat("🙂", 1024)})
+	}
+	embed = fitEmbed(&discordgo.MessageEmbed{Title: "title", Fields: fields})
+	checkEmbed(t, embed)
+	if len(embed.Fields) != 5 || embed.Fields[0] != fields[0] {
+		t.Errorf("%d fields left, want the first 5", len(embed.Fields))
+	}
+
+	// an embed at the limit is not changed
+	embed = fitEmbed(&discordgo.MessageEmbed{
+		Title:       strings.Repeat("ö", maxTitleLength),
+		Description: strings.Repeat("ü", maxDescriptionLength),
+		Footer:      &discordgo.MessageEmbedFooter{Text: strings.Repeat("f", maxEmbedsSize-maxTitleLength-maxDescriptionLength)},
+	})
+	if embedSize(embed) != maxEmbedsSize || strings.HasSuffix(embed.Description, "…") {
+		t.Errorf("embed at the limit changed")
+	}
+
+	embed = fitEmbed(&discordgo.MessageEmbed{Fields: []*discordgo.MessageEmbedField{{}}})
+	checkEmbed(t, embed)
+}
+
+func TestPackCards(t *testing.T) {
+	if messages := packCards(nil); len(messages) != 0 {
+		t.Errorf("%d messages without cards", len(messages))
+	}
+
+	small := []*chat.Card{}
+	for n := 0; n < 25; n++ {
+		small = append(small, &chat.Card{Title: "title", Description: "description"})
+	}
+	large := []*chat.Card{}
+	for n := 0; n < 5; n++ {
+		large = append(large, &chat.Card{Title: "title", Description: strings.Repeat("ä", 2500)})
+	}
+	full := []*chat.Card{}
+	for n := 0; n < 3; n++ {
+		full = append(full, &chat.Card{
+			Title:       strings.Repeat("t", maxTitleLength),
+			Description: strings.Repeat("ü", maxDescriptionLength),
+			Footer:      &chat.CardFooter{Text: strings.Repeat("f", maxFooterLength)},
+		})
+	}
+	for _, test := range []struct {
+		name  string
+		cards []*chat.Card
+		sizes []int
+	}{
+		{"embed count", small, []int{10, 10, 5}},
+		{"embed size", large, []int{2, 2, 1}},
+		{"embeds over the limit", full, []int{1, 1, 1}},
+	} {
+		messages := packCards(test.cards)
+		if len(messages) != len(test.sizes) {
+			t.Errorf("%s: %d messages, want %d", test.name, len(messages), len(test.sizes))
+			continue
+		}
+		for num, cards := range messages {
+			if len(cards) != test.sizes[num] {
+				t.Errorf("%s: message %d has %d cards, want %d", test.name, num, len(cards), test.sizes[num])
+			}
+			size := 0
+			for _, embed := range messageEmbeds(cards) {
+				checkEmbed(t, embed)
+				size += embedSize(embed)
+			}
+			if size > maxEmbedsSize {
+				t.Errorf("%s: message %d has %d characters", test.name, num, size)
+			}
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		text  string
+		parts int
+		file  bool
+	}{
+		{"empty", "", 1, false},
+		{"whitespace", " \n\n ", 1, false},
+		{"short", "text", 1, false},
+		{"exact limit", strings.Repeat("ä", maxMessageLength), 1, false},
+		{"over the limit", strings.Repeat("ä", maxMessageLength+1), 2, false},
+		{"maximum messages", strings.Repeat("🙂", maxTextMessages*maxMessageLength), maxTextMessages, false},
+		{"whitespace part", strings.Repeat("a", maxMessageLength) + "\n", 1, false},
+		{"file", strings.Repeat("日", maxTextMessages*maxMessageLength+1), 0, true},
+	} {
+		parts, file := splitMessage(test.text)
+		if len(parts) != test.parts || (file != nil) != test.file {
+			t.Errorf("%s: %d parts, file %v", test.name, len(parts), file != nil)
+			continue
+		}
+		for _, part := range parts {
+			if strings.TrimSpace(part) == "" || utf8.RuneCountInString(part) > maxMessageLength {
+				t.Errorf("%s: invalid part %q", test.name, part)
+			}
+		}
+		if file != nil {
+			data, err := io.ReadAll(file.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.text {
+				t.Errorf("%s: file does not contain the text", test.name)
+			}
+		}
+	}
+	if parts, _ := splitMessage(""); parts[0] != emptyMessage {
+		t.Errorf("empty text sent as %q", parts[0])
+	}
+}
@@ -1,9 +1,16 @@
 package discord
 
 import (
+	"context"
 	"emperror.dev/errors"
+	"fmt"
 	"github.com/bwmarrin/discordgo"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
 	"github.com/je4/utils/v2/pkg/zLogger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sync/atomic"
 )
 
 type InterActionsCreateFunc func(s *discordgo.Session, i *discordgo.InteractionCreate)
@@ -19,7 +26,6 @@ func NewSession(token string, appID, guildID string, logger zLogger.ZLogger) (*S
 		appID:        appID,
 		guildID:      guildID,
 		logger:       logger,
-		cmdIDs:       make(map[string]string),
 		interactions: map[string]InterActionsCreateFunc{},
 	}
 	return s, s.init()
@@ -31,7 +37,9 @@ type Session struct {
 	logger       zLogger.ZLogger
 	appID        string
 	guildID      string
-	cmdIDs       map[string]string
+	commands     []*Command
+	stopped      atomic.Bool
+	authorizer   chat.Authorizer
 }
 
 func (d *Session) init() error {
@@ -46,38 +54,79 @@ func (d *Session) init() error {
 	return nil
 }
 
+func (d *Session) AddHandler(handler interface{}) func() {
+	return d.session.AddHandler(handler)
+}
+
 func (d *Session) Open() error {
 	return errors.Wrap(d.session.Open(), "cannot open discord session")
 }
 
-func (d *Session) Close() error {
-	var errs []error
-	for id, name := range d.cmdIDs {
-		d.logger.Info().Msgf("Deleting command %s", name)
-		if err := d.session.ApplicationCommandDelete(d.appID, d.guildID, id); err != nil {
-			errs = append(errs, errors.Wrapf(err, "cannot delete command %s", name))
-			d.logger.Error().Err(err).Msgf("Cannot delete command %s", name)
-		}
-	}
-	if err := d.session.Close(); err != nil {
-		errs = append(errs, errors.Wrap(err, "cannot close discord session"))
-	}
-	return errors.Combine(errs...)
+func (d *Session) SetAuthorizer(authorizer chat.Authorizer) {
+	d.authorizer = authorizer
 }
 
-func (d *Session) ApplicationCommandCreate(createFunc CommandCreate, cmd *discordgo.ApplicationCommand, options ...discordgo.RequestOption) error {
-	d.interactions[cmd.Name] = func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		createFunc(d.NewInteraction(i.Interaction))
-	}
-	rCmd, err := d.session.ApplicationCommandCreate(d.appID, d.guildID, cmd, options...)
-	if err != nil {
-		return errors.Wrap(err, "cannot create application command")
+func (d *Session) StopCommands() {
+	d.stopped.Store(true)
+}
+
+func (d *Session) Ready(ctx context.Context) error {
+	d.session.RLock()
+	defer d.session.RUnlock()
+	if !d.session.DataReady {
+		return errors.New("discord gateway not connected")
 	}
-	d.cmdIDs[rCmd.ID] = rCmd.Name
-	d.logger.Info().Msgf("Command %s created", rCmd.Name)
 	return nil
 }
 
+// Close closes the gateway connection. the application commands stay registered at discord
+func (d *Session) Close() error {
+	return errors.Wrap(d.session.Close(), "cannot close discord session")
+}
+
+// handler wraps the command handler with tracing, shutdown and permission checks
+func (d *Session) handler(cmd *discordgo.ApplicationCommand, createFunc CommandCreate) InterActionsCreateFunc {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		ctx, span := tracing.Start(context.Background(), "discord.interaction "+cmd.Name, trace.WithSpanKind(trace.SpanKindServer))
+		span.SetAttributes(
+			attribute.String("discord.interaction_id", i.ID),
+			attribute.String("discord.guild_id", i.GuildID),
+			attribute.String("discord.channel_id", i.ChannelID),
+		)
+		defer span.End()
+		if d.stopped.Load() {
+			if err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "The bot is shutting down, please try again later",
+					Flags:   discordgo.MessageFlagsEphemeral,
+				},
+			}); err != nil {
+				d.logger.Error().Err(err).Msgf("Cannot send shutdown response for %s", cmd.Name)
+			}
+			return
+		}
+		interaction := d.NewInteraction(ctx, i.Interaction)
+		if d.authorizer != nil {
+			if err := d.authorizer.Authorize(i.GuildID, interaction.UserID(), interaction.Roles(), interaction.IsGuildAdmin(), cmd.Name); err != nil {
+				span.SetAttributes(attribute.Bool("discord.denied", true))
+				d.logger.Info().Msgf("Command %s denied for user %s: %v", cmd.Name, interaction.UserID(), err)
+				if err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Content: fmt.Sprintf("Permission denied: %v", err),
+						Flags:   discordgo.MessageFlagsEphemeral,
+					},
+				}); err != nil {
+					d.logger.Error().Err(err).Msgf("Cannot send denial response for %s", cmd.Name)
+				}
+				return
+			}
+		}
+		createFunc(interaction)
+	}
+}
+
 func (d *Session) ready(r *discordgo.Ready) {
 	d.logger.Info().Msg("Bot is up!")
 	for _, guild := range r.Guilds {
@@ -0,0 +1,100 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Check returns an error if the component is not healthy
+type Check func(ctx context.Context) error
+
+type check struct {
+	name  string
+	check Check
+	// liveness checks are also part of /healthz, all checks are part of /readyz
+	liveness bool
+}
+
+func NewHealth(timeout time.Duration) *Health {
+	return &Health{
+		timeout: timeout,
+		checks:  []check{},
+	}
+}
+
+type Health struct {
+	sync.Mutex
+	timeout      time.Duration
+	checks       []check
+	shuttingDown atomic.Bool
+}
+
+// AddCheck adds a readiness check. if liveness is true, the check is also used for /healthz
+func (h *Health) AddCheck(name string, liveness bool, c Check) {
+	h.Lock()
+	defer h.Unlock()
+	h.checks = append(h.checks, check{name: name, check: c, liveness: liveness})
+}
+
+// SetShuttingDown lets /readyz fail, so that no new work is routed to the bot
+func (h *Health) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+type report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func (h *Health) run(ctx context.Context, readiness bool) (report, bool) {
+	h.Lock()
+	checks := append([]check{}, h.checks...)
+	h.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	rep := report{Status: "ok", Checks: map[string]string{}}
+	healthy := true
+	if readiness && h.shuttingDown.Load() {
+		rep.Checks["shutdown"] = "shutting down"
+		healthy = false
+	}
+	for _, c := range checks {
+		if !readiness && !c.liveness {
+			continue
+		}
+		if err := c.check(ctx); err != nil {
+			rep.Checks[c.name] = err.Error()
+			healthy = false
+		} else {
+			rep.Checks[c.name] = "ok"
+		}
+	}
+	if !healthy {
+		rep.Status = "error"
+	}
+	return rep, healthy
+}
+
+func (h *Health) handler(readiness bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rep, healthy := h.run(r.Context(), readiness)
+		w.Header().Set("Content-Type", "application/json")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(rep)
+	})
+}
+
+func (h *Health) LivenessHandler() http.Handler {
+	return h.handler(false)
+}
+
+func (h *Health) ReadinessHandler() http.Handler {
+	return h.handler(true)
+}
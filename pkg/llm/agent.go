@@ -0,0 +1,242 @@
+package llm
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	oai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+	"go.opentelemetry.io/otel/attribute"
+	"time"
+	"unicode/utf8"
+)
+
+// answerFunction is the tool the model calls to finish
+const answerFunction = "answer"
+
+// maxToolResultLength limits the tool results sent back to the model, in characters
+const maxToolResultLength = 8000
+
+// ChatProvider generates the next assistant message of a conversation with tools.
+// toolChoice is "auto" or an oai.ToolChoice
+type ChatProvider interface {
+	Chat(ctx context.Context, messages []oai.ChatCompletionMessage, tools []oai.Tool, toolChoice any) (oai.ChatCompletionMessage, error)
+}
+
+func (c *Client) Chat(ctx context.Context, messages []oai.ChatCompletionMessage, tools []oai.Tool, toolChoice any) (result oai.ChatCompletionMessage, resultErr error) {
+	ctx, span := tracing.Start(ctx, "openai.Chat")
+	span.SetAttributes(attribute.String("openai.model", oai.GPT4))
+	defer func() { tracing.End(span, resultErr) }()
+
+	var resp oai.ChatCompletionResponse
+	if err := c.call(ctx, "CreateChatCompletion", func(ctx context.Context) error {
+		var err error
+		resp, err = c.client.CreateChatCompletion(ctx, oai.ChatCompletionRequest{
+			Model:      oai.GPT4,
+			Messages:   messages,
+			Tools:      tools,
+			ToolChoice: toolChoice,
+		})
+		return err
+	}); err != nil {
+		return oai.ChatCompletionMessage{}, errors.Wrap(err, "cannot create chat completion")
+	}
+	if len(resp.Choices) == 0 {
+		return oai.ChatCompletionMessage{}, errors.New("no completion returned")
+	}
+	return resp.Choices[0].Message, nil
+}
+
+// AgentTool is a function the model may call. Call gets the JSON arguments and returns the result for the model
+type AgentTool struct {
+	Name        string
+	Description string
+	Parameters  jsonschema.Definition
+	Call        func(ctx context.Context, arguments string) (string, error)
+}
+
+type TraceStep struct {
+	Step      int
+	Tool      string
+	Arguments string
+	Result    string
+	Error     string
+	Duration  time.Duration
+}
+
+func (s *TraceStep) String() string {
+	str := fmt.Sprintf("#%d %s(%s) [%v]\n", s.Step, s.Tool, s.Arguments, s.Duration.Round(time.Millisecond))
+	if s.Error != "" {
+		return str + "error: " + s.Error + "\n"
+	}
+	return str + s.Result + "\n"
+}
+
+type AgentAnswer struct {
+	Answer  string         `json:"answer"`
+	Records []*AgentRecord `json:"records"`
+}
+
+type AgentRecord struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+var answerTool = oai.Tool{
+	Type: oai.ToolTypeFunction,
+	Function: &oai.FunctionDefinition{
+		Name:        answerFunction,
+		Description: "give the final answer to the user",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"answer": {
+					Type:        jsonschema.String,
+					Description: "answer to the question, a few sentences",
+				},
+				"records": {
+					Type:        jsonschema.Array,
+					Description: "the records the answer is based on, most relevant first",
+					Items: &jsonschema.Definition{
+						Type: jsonschema.Object,
+						Properties: map[string]jsonschema.Definition{
+							"id": {
+								Type:        jsonschema.String,
+								Description: "record id as returned by the tools",
+							},
+							"reason": {
+								Type:        jsonschema.String,
+								Description: "why the record is relevant",
+							},
+						},
+						Required: []string{"id", "reason"},
+					},
+				},
+			},
+			Required: []string{"answer", "records"},
+		},
+	},
+}
+
+// NewAgent creates an agent which may call the tools for at most maxSteps model turns
+func NewAgent(provider ChatProvider, tools []*AgentTool, maxSteps int, logger zLogger.ZLogger) *Agent {
+	return &Agent{
+		provider: provider,
+		tools:    tools,
+		maxSteps: maxSteps,
+		logger:   logger,
+	}
+}
+
+type Agent struct {
+	provider ChatProvider
+	tools    []*AgentTool
+	maxSteps int
+	logger   zLogger.ZLogger
+}
+
+func (a *Agent) tool(name string) *AgentTool {
+	for _, t := range a.tools {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Run lets the model research the question. in the last step the model has to answer.
+// the trace contains all tool calls, also if an error is returned
+func (a *Agent) Run(ctx context.Context, system, question string) (answer *AgentAnswer, trace []*TraceStep, resultErr error) {
+	ctx, span := tracing.Start(ctx, "agent.Run")
+	defer func() {
+		span.SetAttributes(attribute.Int("agent.toolcalls", len(trace)))
+		tracing.End(span, resultErr)
+	}()
+	logger := tracing.Logger(ctx, a.logger)
+
+	tools := []oai.Tool{answerTool}
+	for _, t := range a.tools {
+		tools = append(tools, oai.Tool{
+			Type: oai.ToolTypeFunction,
+			Function: &oai.FunctionDefinition{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.Parameters,
+			},
+		})
+	}
+	messages := []oai.ChatCompletionMessage{
+		{Role: oai.ChatMessageRoleSystem, Content: system},
+		{Role: oai.ChatMessageRoleUser, Content: question},
+	}
+	for step := 1; step <= a.maxSteps; step++ {
+		var toolChoice any = "auto"
+		if step == a.maxSteps {
+			toolChoice = oai.ToolChoice{
+				Type:     oai.ToolTypeFunction,
+				Function: oai.ToolFunction{Name: answerFunction},
+			}
+		}
+		msg, err := a.provider.Chat(ctx, messages, tools, toolChoice)
+		if err != nil {
+			return nil, trace, errors.Wrapf(err, "step %d", step)
+		}
+		if len(msg.ToolCalls) == 0 {
+			// the model answered without the answer tool
+			return &AgentAnswer{Answer: msg.Content}, trace, nil
+		}
+		messages = append(messages, msg)
+		// the answer is handled after the other calls of the turn, so that all calls get a result
+		var answerCall *oai.ToolCall
+		for _, call := range msg.ToolCalls {
+			if call.Function.Name == answerFunction {
+				if answerCall == nil {
+					answerCall = &call
+				}
+				continue
+			}
+			ts := &TraceStep{
+				Step:      step,
+				Tool:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+			}
+			start := time.Now()
+			var result string
+			if t := a.tool(call.Function.Name); t != nil {
+				result, err = t.Call(ctx, call.Function.Arguments)
+			} else {
+				err = errors.Errorf("unknown tool %s", call.Function.Name)
+			}
+			ts.Duration = time.Since(start)
+			if err != nil {
+				// the model may recover from errors, e.g. invalid arguments
+				ts.Error = err.Error()
+				result = "error: " + err.Error()
+			} else {
+				ts.Result = result
+			}
+			logger.Info().Msgf("agent step %d: %s(%s) in %v, error: %s", step, ts.Tool, ts.Arguments, ts.Duration, ts.Error)
+			trace = append(trace, ts)
+			if utf8.RuneCountInString(result) > maxToolResultLength {
+				result = string([]rune(result)[:maxToolResultLength]) + "\n[truncated]"
+			}
+			messages = append(messages, oai.ChatCompletionMessage{
+				Role:       oai.ChatMessageRoleTool,
+				Content:    result,
+				Name:       call.Function.Name,
+				ToolCallID: call.ID,
+			})
+		}
+		if answerCall != nil {
+			answer = &AgentAnswer{}
+			if err := json.Unmarshal([]byte(answerCall.Function.Arguments), answer); err != nil {
+				return nil, trace, errors.Wrapf(err, "cannot unmarshal answer %s", answerCall.Function.Arguments)
+			}
+			return answer, trace, nil
+		}
+	}
+	return nil, trace, errors.Errorf("no answer after %d steps", a.maxSteps)
+}
@@ -0,0 +1,210 @@
+package llm
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	oai "github.com/sashabaranov/go-openai"
+	"strings"
+	"testing"
+)
+
+func testLogger() zLogger.ZLogger {
+	logger := zerolog.Nop()
+	return &logger
+}
+
+// choiceRecorder records the tool choice of each call
+type choiceRecorder struct {
+	ChatProvider
+	choices []any
+}
+
+func (c *choiceRecorder) Chat(ctx context.Context, messages []oai.ChatCompletionMessage, tools []oai.Tool, toolChoice any) (oai.ChatCompletionMessage, error) {
+	c.choices = append(c.choices, toolChoice)
+	return c.ChatProvider.Chat(ctx, messages, tools, toolChoice)
+}
+
+func toolCalls(calls ...oai.ToolCall) oai.ChatCompletionMessage {
+	return oai.ChatCompletionMessage{Role: oai.ChatMessageRoleAssistant, ToolCalls: calls}
+}
+
+func toolCall(id, name, arguments string) oai.ToolCall {
+	return oai.ToolCall{
+		ID:       id,
+		Type:     oai.ToolTypeFunction,
+		Function: oai.FunctionCall{Name: name, Arguments: arguments},
+	}
+}
+
+// echoTool returns its arguments and fails for arguments "fail"
+func echoTool(calls *[]string) *AgentTool {
+	return &AgentTool{
+		Name:        "echo",
+		Description: "returns its arguments",
+		Call: func(ctx context.Context, arguments string) (string, error) {
+			*calls = append(*calls, arguments)
+			if arguments == "fail" {
+				return "", errors.New("echo failed")
+			}
+			return "echo " + arguments, nil
+		},
+	}
+}
+
+func TestAgentToolDispatch(t *testing.T) {
+	provider := NewFakeProvider(
+		toolCalls(toolCall("1", "echo", "a"), toolCall("2", "unknown", "b")),
+		toolCalls(toolCall("3", "echo", "fail")),
+		toolCalls(toolCall("4", answerFunction, `{"answer":"done","records":[{"id":"r2","reason":"second"},{"id":"r1","reason":"first"}]}`)),
+	)
+	var calls []string
+	agent := NewAgent(provider, []*AgentTool{echoTool(&calls)}, 5, testLogger())
+	answer, trace, err := agent.Run(context.Background(), "system", "question")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Answer != "done" || len(answer.Records) != 2 || answer.Records[0].ID != "r2" || answer.Records[1].ID != "r1" {
+		t.Errorf("unexpected answer %+v", answer)
+	}
+	if strings.Join(calls, ",") != "a,fail" {
+		t.Errorf("tool called with %v", calls)
+	}
+	if len(trace) != 3 {
+		t.Fatalf("%d trace steps, want 3", len(trace))
+	}
+	if trace[0].Step != 1 || trace[0].Result != "echo a" || trace[0].Error != "" {
+		t.Errorf("unexpected step %+v", trace[0])
+	}
+	if trace[1].Step != 1 || trace[1].Error != "unknown tool unknown" {
+		t.Errorf("unexpected step %+v", trace[1])
+	}
+	if trace[2].Step != 2 || trace[2].Error != "echo failed" {
+		t.Errorf("unexpected step %+v", trace[2])
+	}
+
+	// the tool results are sent back to the model with the id of the call
+	last := provider.Requests[2]
+	results := map[string]string{}
+	for _, msg := range last {
+		if msg.Role == oai.ChatMessageRoleTool {
+			results[msg.ToolCallID] = msg.Content
+		}
+	}
+	want := map[string]string{"1": "echo a", "2": "error: unknown tool unknown", "3": "error: echo failed"}
+	if fmt.Sprint(results) != fmt.Sprint(want) {
+		t.Errorf("tool results %v, want %v", results, want)
+	}
+	if last[0].Role != oai.ChatMessageRoleSystem || last[1].Content != "question" {
+		t.Errorf("conversation does not start with system prompt and question")
+	}
+}
+
+func TestAgentAnswerWithOtherCalls(t *testing.T) {
+	provider := NewFakeProvider(
+		toolCalls(
+			toolCall("1", "echo", "a"),
+			toolCall("2", answerFunction, `{"answer":"done","records":[{"id":"r1","reason":"first"}]}`),
+			toolCall("3", "echo", "b"),
+		),
+	)
+	var calls []string
+	agent := NewAgent(provider, []*AgentTool{echoTool(&calls)}, 5, testLogger())
+	answer, trace, err := agent.Run(context.Background(), "system", "question")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Answer != "done" || len(answer.Records) != 1 {
+		t.Errorf("unexpected answer %+v", answer)
+	}
+	if strings.Join(calls, ",") != "a,b" {
+		t.Errorf("tool called with %v", calls)
+	}
+	if len(trace) != 2 || trace[0].Result != "echo a" || trace[1].Result != "echo b" {
+		t.Errorf("calls of the answer turn missing in the trace: %+v", trace)
+	}
+}
+
+func TestAgentMaxSteps(t *testing.T) {
+	provider := &choiceRecorder{ChatProvider: NewFakeProvider(
+		toolCalls(toolCall("1", "echo", "a")),
+		toolCalls(toolCall("2", "echo", "b")),
+		toolCalls(toolCall("3", "echo", "c")),
+		toolCalls(toolCall("4", "echo", "d")),
+	)}
+	var calls []string
+	agent := NewAgent(provider, []*AgentTool{echoTool(&calls)}, 3, testLogger())
+	answer, trace, err := agent.Run(context.Background(), "system", "question")
+	if err == nil || err.Error() != "no answer after 3 steps" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if answer != nil {
+		t.Errorf("unexpected answer %+v", answer)
+	}
+	if len(provider.choices) != 3 || len(trace) != 3 || len(calls) != 3 {
+		t.Errorf("%d model calls, %d trace steps, %d tool calls, want 3", len(provider.choices), len(trace), len(calls))
+	}
+}
+
+func TestAgentForcedAnswer(t *testing.T) {
+	provider := &choiceRecorder{ChatProvider: NewFakeProvider(
+		toolCalls(toolCall("1", "echo", "a")),
+		toolCalls(toolCall("2", answerFunction, `{"answer":"forced","records":[]}`)),
+	)}
+	var calls []string
+	agent := NewAgent(provider, []*AgentTool{echoTool(&calls)}, 2, testLogger())
+	answer, _, err := agent.Run(context.Background(), "system", "question")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Answer != "forced" {
+		t.Errorf("unexpected answer %+v", answer)
+	}
+	if len(provider.choices) != 2 || provider.choices[0] != "auto" {
+		t.Fatalf("unexpected tool choices %v", provider.choices)
+	}
+	choice, ok := provider.choices[1].(oai.ToolChoice)
+	if !ok || choice.Function.Name != answerFunction {
+		t.Errorf("last step does not force the answer: %v", provider.choices[1])
+	}
+}
+
+func TestAgentPlainAnswer(t *testing.T) {
+	provider := NewFakeProvider(oai.ChatCompletionMessage{Role: oai.ChatMessageRoleAssistant, Content: "plain"})
+	agent := NewAgent(provider, nil, 3, testLogger())
+	answer, trace, err := agent.Run(context.Background(), "system", "question")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Answer != "plain" || len(answer.Records) != 0 || len(trace) != 0 {
+		t.Errorf("unexpected answer %+v with %d trace steps", answer, len(trace))
+	}
+}
+
+func TestAgentErrors(t *testing.T) {
+	var calls []string
+	// the trace is returned together with the error
+	agent := NewAgent(NewFakeProvider(toolCalls(toolCall("1", "echo", "a"))), []*AgentTool{echoTool(&calls)}, 3, testLogger())
+	_, trace, err := agent.Run(context.Background(), "system", "question")
+	if err == nil || !strings.Contains(err.Error(), "step 2") || len(trace) != 1 {
+		t.Errorf("unexpected error %v with %d trace steps", err, len(trace))
+	}
+
+	agent = NewAgent(NewFakeProvider(toolCalls(toolCall("1", answerFunction, `{"answer":`))), nil, 3, testLogger())
+	if _, _, err := agent.Run(context.Background(), "system", "question"); err == nil || !strings.Contains(err.Error(), "cannot unmarshal answer") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestTraceStepString(t *testing.T) {
+	step := &TraceStep{Step: 2, Tool: "search", Arguments: `{"query":"alchemy"}`, Result: "[]", Duration: 1234567}
+	if got, want := step.String(), "#2 search({\"query\":\"alchemy\"}) [1ms]\n[]\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	step.Error = "timeout"
+	if got, want := step.String(), "#2 search({\"query\":\"alchemy\"}) [1ms]\nerror: timeout\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
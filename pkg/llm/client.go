@@ -0,0 +1,96 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha1"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/queue"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"github.com/je4/utils/v2/pkg/openai"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	oai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// NewClient creates an OpenAI client with an embedding cache.
+// the cache keys are compatible with openai.ClientV2. limit restricts the number of concurrent API calls
+func NewClient(apiKey string, kv openai.KVStore, limit *queue.Limiter, logger zLogger.ZLogger) *Client {
+	return &Client{
+		client: oai.NewClient(apiKey),
+		kv:     kv,
+		limit:  limit,
+		logger: logger,
+	}
+}
+
+type Client struct {
+	client  *oai.Client
+	kv      openai.KVStore
+	limit   *queue.Limiter
+	breaker breaker
+	logger  zLogger.ZLogger
+}
+
+func (c *Client) CreateEmbedding(ctx context.Context, input string, model oai.EmbeddingModel) (result *oai.Embedding, resultErr error) {
+	ctx, span := tracing.Start(ctx, "openai.CreateEmbedding")
+	span.SetAttributes(attribute.String("openai.model", string(model)))
+	defer func() { tracing.End(span, resultErr) }()
+	logger := tracing.Logger(ctx, c.logger)
+
+	var key = fmt.Sprintf("embedding-%x", sha1.Sum([]byte(input+string(model))))
+	result, err := c.kv.Get(key)
+	if err == nil {
+		logger.Info().Msgf("cache hit value for key %s", key)
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return result, nil
+	}
+	if !errors.Is(err, openai.ErrNotExists) {
+		return nil, errors.Wrapf(err, "cannot get cache value for key %s", key)
+	}
+	logger.Info().Msgf("cache miss value for key %s", key)
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+
+	var queryResponse oai.EmbeddingResponse
+	if err := c.call(ctx, "CreateEmbeddings", func(ctx context.Context) error {
+		var err error
+		queryResponse, err = c.client.CreateEmbeddings(ctx, oai.EmbeddingRequest{
+			Input: []string{input},
+			Model: model,
+		})
+		return err
+	}); err != nil {
+		return nil, errors.Wrap(err, "cannot create embedding")
+	}
+	if len(queryResponse.Data) == 0 {
+		return nil, errors.Errorf("no embedding returned")
+	}
+	result = &queryResponse.Data[0]
+	if err := c.kv.Set(key, result); err != nil {
+		return nil, errors.Wrapf(err, "cannot set value for key %s", key)
+	}
+	return result, nil
+}
+
+func (c *Client) Query2EmbeddingQuery(ctx context.Context, queryString string) (result string, resultErr error) {
+	ctx, span := tracing.Start(ctx, "openai.Query2EmbeddingQuery")
+	span.SetAttributes(attribute.String("openai.model", oai.GPT4))
+	defer func() { tracing.End(span, resultErr) }()
+
+	qStr := fmt.Sprintf("please create from the following question a query, which is optimized for vector search with embeddings. focus on the core of the question.\nquestion: %s", queryString)
+	var resp oai.ChatCompletionResponse
+	if err := c.call(ctx, "CreateChatCompletion", func(ctx context.Context) error {
+		var err error
+		resp, err = c.client.CreateChatCompletion(ctx, oai.ChatCompletionRequest{
+			Model:    oai.GPT4,
+			Messages: []oai.ChatCompletionMessage{{Role: oai.ChatMessageRoleSystem, Content: qStr}},
+		})
+		return err
+	}); err != nil {
+		return "", errors.Wrap(err, "cannot create chat completion")
+	}
+	if len(resp.Choices) == 0 {
+		return "", errors.New("no completion returned")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
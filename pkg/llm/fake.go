@@ -0,0 +1,49 @@
+package llm
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	oai "github.com/sashabaranov/go-openai"
+	"os"
+	"sync"
+)
+
+// NewFakeProvider creates a ChatProvider which replays the responses in order, for deterministic runs without OpenAI
+func NewFakeProvider(responses ...oai.ChatCompletionMessage) *FakeProvider {
+	return &FakeProvider{
+		responses: responses,
+	}
+}
+
+// LoadFakeProvider reads the responses of a FakeProvider from a JSON array of chat messages
+func LoadFakeProvider(path string) (*FakeProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read %s", path)
+	}
+	responses := []oai.ChatCompletionMessage{}
+	if err := json.Unmarshal(data, &responses); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal %s", path)
+	}
+	return NewFakeProvider(responses...), nil
+}
+
+type FakeProvider struct {
+	sync.Mutex
+	responses []oai.ChatCompletionMessage
+	// Requests are the conversations of all calls
+	Requests [][]oai.ChatCompletionMessage
+}
+
+func (f *FakeProvider) Chat(ctx context.Context, messages []oai.ChatCompletionMessage, tools []oai.Tool, toolChoice any) (oai.ChatCompletionMessage, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.Requests = append(f.Requests, append([]oai.ChatCompletionMessage{}, messages...))
+	if len(f.responses) == 0 {
+		return oai.ChatCompletionMessage{}, errors.New("no scripted response left")
+	}
+	msg := f.responses[0]
+	f.responses = f.responses[1:]
+	return msg, nil
+}
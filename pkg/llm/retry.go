@@ -0,0 +1,133 @@
+package llm
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	oai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling OpenAI while the provider is considered unavailable
+var ErrCircuitOpen = errors.New("openai circuit breaker open")
+
+const (
+	maxAttempts      = 4
+	baseBackoff      = 500 * time.Millisecond
+	maxBackoff       = 8 * time.Second
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *oai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == http.StatusTooManyRequests || apiErr.HTTPStatusCode >= 500
+	}
+	var reqErr *oai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode == http.StatusTooManyRequests || reqErr.HTTPStatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// backoff returns the jittered delay before the given retry (starting at 1)
+func backoff(retry int) time.Duration {
+	d := baseBackoff << (retry - 1)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	// full jitter in [d/2, d)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// breaker opens after breakerThreshold consecutive transient failures.
+// after breakerCooldown a single trial call is allowed, which closes it again on success
+type breaker struct {
+	sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func (b *breaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record counts the result of a call. changed is true if the breaker opened or closed
+func (b *breaker) record(err error) (changed bool, open bool) {
+	b.Lock()
+	defer b.Unlock()
+	wasOpen := b.failures >= breakerThreshold
+	b.trial = false
+	if isTransient(err) {
+		b.failures++
+		if b.failures >= breakerThreshold {
+			b.openUntil = time.Now().Add(breakerCooldown)
+		}
+	} else {
+		b.failures = 0
+	}
+	open = b.failures >= breakerThreshold
+	return open != wasOpen, open
+}
+
+// call runs f with retries on transient errors and through the circuit breaker
+func (c *Client) call(ctx context.Context, operation string, f func(ctx context.Context) error) error {
+	logger := tracing.Logger(ctx, c.logger)
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if !c.breaker.allow() {
+			return errors.WithStack(ErrCircuitOpen)
+		}
+		if err = c.limit.Acquire(ctx); err != nil {
+			return err
+		}
+		err = f(ctx)
+		c.limit.Release()
+		if changed, open := c.breaker.record(err); changed {
+			if open {
+				logger.Error().Msgf("OpenAI circuit breaker opened for %v after %s: %v", breakerCooldown, operation, err)
+			} else {
+				logger.Info().Msgf("OpenAI circuit breaker closed after %s", operation)
+			}
+		}
+		if !isTransient(err) || attempt == maxAttempts {
+			return err
+		}
+		delay := backoff(attempt)
+		logger.Warn().Msgf("%s failed (attempt %d/%d), retrying in %v: %v", operation, attempt, maxAttempts, delay, err)
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("retry.attempt", attempt),
+			attribute.String("retry.error", err.Error()),
+		))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "%s aborted during backoff", operation)
+		}
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+package llm
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	oai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+)
+
+const structuredQueryFunction = "search_catalogue"
+
+var Sorts = []string{"relevance", "newest", "oldest"}
+
+var SearchTypes = []string{"simple", "prose", "marc", "json"}
+
+// StructuredQuery is a catalogue search extracted from a natural language question.
+// zero values mean "no restriction"
+type StructuredQuery struct {
+	// Query is the free text part, without the parts covered by filters
+	Query        string `json:"query"`
+	YearFrom     int    `json:"year_from,omitempty"`
+	YearTo       int    `json:"year_to,omitempty"`
+	ResourceType string `json:"resource_type,omitempty"`
+	// Language is a three letter MARC language code
+	Language   string `json:"language,omitempty"`
+	Person     string `json:"person,omitempty"`
+	Subject    string `json:"subject,omitempty"`
+	Sort       string `json:"sort,omitempty"`
+	SearchType string `json:"search_type,omitempty"`
+}
+
+func (q *StructuredQuery) String() string {
+	parts := []string{}
+	if q.Query != "" {
+		parts = append(parts, fmt.Sprintf("query: %s", q.Query))
+	}
+	if q.YearFrom != 0 || q.YearTo != 0 {
+		from, to := "", ""
+		if q.YearFrom != 0 {
+			from = fmt.Sprintf("%d", q.YearFrom)
+		}
+		if q.YearTo != 0 {
+			to = fmt.Sprintf("%d", q.YearTo)
+		}
+		parts = append(parts, fmt.Sprintf("years: %s-%s", from, to))
+	}
+	for _, p := range [][2]string{
+		{"type", q.ResourceType},
+		{"language", q.Language},
+		{"person", q.Person},
+		{"subject", q.Subject},
+		{"sort", q.Sort},
+		{"search type", q.SearchType},
+	} {
+		if p[1] != "" {
+			parts = append(parts, fmt.Sprintf("%s: %s", p[0], p[1]))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// structuredQueryTool describes the search function. resourceTypes are the allowed resource types
+func structuredQueryTool(resourceTypes []string) oai.Tool {
+	return oai.Tool{
+		Type: oai.ToolTypeFunction,
+		Function: &oai.FunctionDefinition{
+			Name:        structuredQueryFunction,
+			Description: "search the library catalogue of the University Library Basel",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"query": {
+						Type:        jsonschema.String,
+						Description: "free text of the search, optimized for vector search with embeddings. leave out everything covered by the other parameters",
+					},
+					"year_from": {
+						Type:        jsonschema.Integer,
+						Description: "earliest year of publication",
+					},
+					"year_to": {
+						Type:        jsonschema.Integer,
+						Description: "latest year of publication",
+					},
+					"resource_type": {
+						Type:        jsonschema.String,
+						Description: "type of the resource",
+						Enum:        resourceTypes,
+					},
+					"language": {
+						Type:        jsonschema.String,
+						Description: "three letter MARC language code of the resource, e.g. ger, eng, fre, ita, lat",
+					},
+					"person": {
+						Type:        jsonschema.String,
+						Description: "name of an author or other person involved in the resource",
+					},
+					"subject": {
+						Type:        jsonschema.String,
+						Description: "subject heading, topic or place the resource is about",
+					},
+					"sort": {
+						Type:        jsonschema.String,
+						Description: "order of the results",
+						Enum:        Sorts,
+					},
+					"search_type": {
+						Type:        jsonschema.String,
+						Description: "simple for exact titles, names or identifiers, prose for descriptive questions, marc or json for bibliographic details",
+						Enum:        SearchTypes,
+					},
+				},
+				Required: []string{"query"},
+			},
+		},
+	}
+}
+
+// Query2StructuredQuery lets the chat model translate a question into a structured query.
+// the result is not validated
+func (c *Client) Query2StructuredQuery(ctx context.Context, queryString string, resourceTypes []string) (result *StructuredQuery, resultErr error) {
+	ctx, span := tracing.Start(ctx, "openai.Query2StructuredQuery")
+	span.SetAttributes(attribute.String("openai.model", oai.GPT4))
+	defer func() { tracing.End(span, resultErr) }()
+
+	qStr := "please translate the question of the user into a search of the library catalogue. use filters wherever the question restricts time, resource type, language, person or subject."
+	var resp oai.ChatCompletionResponse
+	if err := c.call(ctx, "CreateChatCompletion", func(ctx context.Context) error {
+		var err error
+		resp, err = c.client.CreateChatCompletion(ctx, oai.ChatCompletionRequest{
+			Model: oai.GPT4,
+			Messages: []oai.ChatCompletionMessage{
+				{Role: oai.ChatMessageRoleSystem, Content: qStr},
+				{Role: oai.ChatMessageRoleUser, Content: queryString},
+			},
+			Tools: []oai.Tool{structuredQueryTool(resourceTypes)},
+			ToolChoice: oai.ToolChoice{
+				Type:     oai.ToolTypeFunction,
+				Function: oai.ToolFunction{Name: structuredQueryFunction},
+			},
+		})
+		return err
+	}); err != nil {
+		return nil, errors.Wrap(err, "cannot create chat completion")
+	}
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("no completion returned")
+	}
+	for _, call := range resp.Choices[0].Message.ToolCalls {
+		if call.Function.Name != structuredQueryFunction {
+			continue
+		}
+		result = &StructuredQuery{}
+		if err := json.Unmarshal([]byte(call.Function.Arguments), result); err != nil {
+			return nil, errors.Wrapf(err, "cannot unmarshal arguments %s", call.Function.Arguments)
+		}
+		return result, nil
+	}
+	return nil, errors.Errorf("model did not call %s", structuredQueryFunction)
+}
@@ -0,0 +1,107 @@
+package llm
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	oai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+	"unicode/utf8"
+)
+
+// charsPerToken is a rough estimate of the characters per token
+const charsPerToken = 4
+
+// minTextTokens is the least budget of a text, even if the chat model gets more than maxTokens
+const minTextTokens = 100
+
+// separatorTokens are the tokens of the separator between the texts of a chunk
+const separatorTokens = 1
+
+const summarizeMapPrompt = `the user sends records of a search in a library catalogue. write a short overview of these records with the sections:
+themes: the main themes
+time span: the time span of publication
+authors: notable authors
+gaps: what is missing or underrepresented`
+
+const summarizeReducePrompt = `the user sends partial overviews of one search result in a library catalogue. combine them into one short overview with the sections:
+themes: the main themes
+time span: the time span of publication
+authors: notable authors
+gaps: what is missing or underrepresented`
+
+func EstimateTokens(text string) int {
+	return utf8.RuneCountInString(text)/charsPerToken + 1
+}
+
+// chunkTexts groups the texts into chunks of at most maxTokens. longer texts are truncated
+func chunkTexts(texts []string, maxTokens int) []string {
+	chunks := []string{}
+	current := []string{}
+	currentTokens := 0
+	for _, text := range texts {
+		if tokens := EstimateTokens(text); tokens > maxTokens {
+			text = string([]rune(text)[:(maxTokens-1)*charsPerToken])
+		}
+		tokens := EstimateTokens(text)
+		if len(current) > 0 && currentTokens+separatorTokens+tokens > maxTokens {
+			chunks = append(chunks, strings.Join(current, "\n\n"))
+			current = []string{}
+			currentTokens = 0
+		}
+		if len(current) > 0 {
+			currentTokens += separatorTokens
+		}
+		current = append(current, text)
+		currentTokens += tokens
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, strings.Join(current, "\n\n"))
+	}
+	return chunks
+}
+
+// Summarize writes an overview of the records with the chat model.
+// if the records exceed maxTokens, chunks of records are summarized first and the partial summaries combined
+func Summarize(ctx context.Context, provider ChatProvider, records []string, maxTokens int) (result string, resultErr error) {
+	ctx, span := tracing.Start(ctx, "llm.Summarize")
+	span.SetAttributes(attribute.Int("summarize.records", len(records)))
+	defer func() { tracing.End(span, resultErr) }()
+
+	if len(records) == 0 {
+		return "", errors.New("no records to summarize")
+	}
+	prompt := summarizeMapPrompt
+	texts := records
+	for round := 1; ; round++ {
+		budget := max(maxTokens-EstimateTokens(prompt), minTextTokens)
+		chunks := chunkTexts(texts, budget)
+		if round > 1 && len(chunks) == len(texts) {
+			// the partial summaries do not fit together. they are shortened and combined in pairs,
+			// so that their number halves in every round
+			perText := max((budget-separatorTokens)/2, minTextTokens)
+			chunks = []string{}
+			for n := 0; n < len(texts); n += 2 {
+				chunks = append(chunks, strings.Join(chunkTexts(texts[n:min(n+2, len(texts))], perText), "\n\n"))
+			}
+		}
+		summaries := []string{}
+		for _, chunk := range chunks {
+			msg, err := provider.Chat(ctx, []oai.ChatCompletionMessage{
+				{Role: oai.ChatMessageRoleSystem, Content: prompt},
+				{Role: oai.ChatMessageRoleUser, Content: chunk},
+			}, nil, nil)
+			if err != nil {
+				return "", errors.Wrapf(err, "cannot summarize chunk in round %d", round)
+			}
+			summaries = append(summaries, msg.Content)
+		}
+		if len(summaries) == 1 {
+			span.SetAttributes(attribute.Int("summarize.rounds", round))
+			return summaries[0], nil
+		}
+		prompt = summarizeReducePrompt
+		texts = summaries
+	}
+}
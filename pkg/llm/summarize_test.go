@@ -0,0 +1,62 @@
+package llm
+
+import (
+	"context"
+	oai "github.com/sashabaranov/go-openai"
+	"strings"
+	"testing"
+)
+
+// summaryProvider answers every chat with a long summary and records the texts sent
+type summaryProvider struct {
+	texts []string
+}
+
+func (p *summaryProvider) Chat(ctx context.Context, messages []oai.ChatCompletionMessage, tools []oai.Tool, toolChoice any) (oai.ChatCompletionMessage, error) {
+	p.texts = append(p.texts, messages[len(messages)-1].Content)
+	return oai.ChatCompletionMessage{Content: strings.Repeat("summary ", 250)}, nil
+}
+
+func TestSummarizeManyRecords(t *testing.T) {
+	records := []string{}
+	for n := 0; n < 50; n++ {
+		records = append(records, strings.Repeat("record ", 300))
+	}
+	for _, maxTokens := range []int{10, 600, 4000} {
+		provider := &summaryProvider{}
+		summary, err := Summarize(context.Background(), provider, records, maxTokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary == "" {
+			t.Errorf("%d tokens: empty summary", maxTokens)
+		}
+		limit := max(maxTokens, 2*minTextTokens+separatorTokens)
+		for _, text := range provider.texts {
+			if strings.TrimSpace(text) == "" {
+				t.Fatalf("%d tokens: empty text sent to the model", maxTokens)
+			}
+			if tokens := EstimateTokens(text); tokens > limit {
+				t.Errorf("%d tokens: text of %d tokens sent to the model", maxTokens, tokens)
+			}
+		}
+		if len(provider.texts) > 3*len(records) {
+			t.Errorf("%d tokens: %d chat calls for %d records", maxTokens, len(provider.texts), len(records))
+		}
+	}
+}
+
+func TestChunkTexts(t *testing.T) {
+	texts := []string{strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 400)}
+	chunks := chunkTexts(texts, 21)
+	if len(chunks) != 3 {
+		t.Fatalf("%d chunks, want 3", len(chunks))
+	}
+	chunks = chunkTexts(texts, 23)
+	if len(chunks) != 2 || chunks[0] != texts[0]+"\n\n"+texts[1] {
+		t.Errorf("texts fitting together are not combined: %q", chunks)
+	}
+	if got := EstimateTokens(chunks[1]); got > 23 {
+		t.Errorf("long text not truncated, %d tokens", got)
+	}
+}
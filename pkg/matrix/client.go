@@ -0,0 +1,278 @@
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/ub-bot/v2/pkg/tracing"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// commandPrefix starts a command in a room message, e.g. !search querytype:simple query:Basel
+const commandPrefix = "!"
+
+// syncTimeout is the long polling timeout of /sync
+const syncTimeout = 30 * time.Second
+
+const retryDelay = 5 * time.Second
+
+// NewClient creates a client for the client-server API of a matrix homeserver.
+// lookup returns the command for a name or nil if the name is unknown
+func NewClient(homeserver, userID, accessToken string, lookup func(name string) *chat.Command, logger zLogger.ZLogger) *Client {
+	return &Client{
+		homeserver:  strings.TrimRight(homeserver, "/"),
+		userID:      userID,
+		accessToken: accessToken,
+		httpClient:  &http.Client{Timeout: syncTimeout + 30*time.Second},
+		lookup:      lookup,
+		logger:      logger,
+	}
+}
+
+type Client struct {
+	homeserver  string
+	userID      string
+	accessToken string
+	httpClient  *http.Client
+	lookup      func(name string) *chat.Command
+	authorizer  chat.Authorizer
+	stopped     atomic.Bool
+	txnID       atomic.Int64
+	logger      zLogger.ZLogger
+}
+
+func (c *Client) SetAuthorizer(authorizer chat.Authorizer) {
+	c.authorizer = authorizer
+}
+
+func (c *Client) StopCommands() {
+	c.stopped.Store(true)
+}
+
+type matrixError struct {
+	ErrCode string `json:"errcode"`
+	Error   string `json:"error"`
+}
+
+var errNotFound = errors.New("not found")
+
+// do sends a request to the homeserver. body is sent as json unless it is an io.Reader
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, contentType string, body any, result any) error {
+	u := c.homeserver + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		if r, ok := body.(io.Reader); ok {
+			reader = r
+		} else {
+			data, err := json.Marshal(body)
+			if err != nil {
+				return errors.Wrapf(err, "cannot marshal body of %s", path)
+			}
+			reader = bytes.NewReader(data)
+			contentType = "application/json"
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create request %s %s", method, path)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "cannot %s %s", method, path)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.Wrapf(errNotFound, "%s %s", method, path)
+	}
+	if resp.StatusCode >= 300 {
+		var mErr matrixError
+		_ = json.NewDecoder(resp.Body).Decode(&mErr)
+		return errors.Errorf("%s %s: %s %s %s", method, path, resp.Status, mErr.ErrCode, mErr.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return errors.Wrapf(err, "cannot decode response of %s", path)
+	}
+	return nil
+}
+
+func (c *Client) Ready(ctx context.Context) error {
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/_matrix/client/v3/account/whoami", nil, "", nil, &whoami); err != nil {
+		return errors.Wrap(err, "matrix homeserver not reachable")
+	}
+	return nil
+}
+
+type event struct {
+	Type    string          `json:"type"`
+	EventID string          `json:"event_id"`
+	Sender  string          `json:"sender"`
+	Content json.RawMessage `json:"content"`
+}
+
+type syncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []*event `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]json.RawMessage `json:"invite"`
+	} `json:"rooms"`
+}
+
+// Run receives the room messages until ctx is cancelled. invitations are accepted.
+// messages sent before the start are ignored
+func (c *Client) Run(ctx context.Context) error {
+	var since string
+	for {
+		query := url.Values{"timeout": {fmt.Sprintf("%d", syncTimeout.Milliseconds())}}
+		if since != "" {
+			query.Set("since", since)
+		}
+		var resp syncResponse
+		if err := c.do(ctx, http.MethodGet, "/_matrix/client/v3/sync", query, "", nil, &resp); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			c.logger.Error().Msgf("Cannot sync with matrix homeserver: %v", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+		for roomID := range resp.Rooms.Invite {
+			if err := c.do(ctx, http.MethodPost, "/_matrix/client/v3/join/"+url.PathEscape(roomID), nil, "", map[string]any{}, nil); err != nil {
+				c.logger.Error().Msgf("Cannot join room %s: %v", roomID, err)
+			}
+		}
+		if since != "" {
+			for roomID, room := range resp.Rooms.Join {
+				for _, evt := range room.Timeline.Events {
+					c.handleEvent(roomID, evt)
+				}
+			}
+		}
+		since = resp.NextBatch
+	}
+}
+
+func (c *Client) handleEvent(roomID string, evt *event) {
+	if evt.Type != "m.room.message" || evt.Sender == c.userID {
+		return
+	}
+	var content struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+	}
+	if err := json.Unmarshal(evt.Content, &content); err != nil || content.MsgType != "m.text" {
+		return
+	}
+	if !strings.HasPrefix(content.Body, commandPrefix) {
+		return
+	}
+	args, err := chat.SplitArgs(strings.TrimPrefix(content.Body, commandPrefix))
+	if err != nil || len(args) == 0 {
+		return
+	}
+	cmd := c.lookup(args[0])
+	if cmd == nil {
+		return
+	}
+
+	ctx, span := tracing.Start(context.Background(), "matrix.message "+cmd.Definition.Name, trace.WithSpanKind(trace.SpanKindServer))
+	span.SetAttributes(
+		attribute.String("matrix.event_id", evt.EventID),
+		attribute.String("matrix.room_id", roomID),
+	)
+	req := &Request{
+		client:  c,
+		ctx:     ctx,
+		roomID:  roomID,
+		eventID: evt.EventID,
+		sender:  evt.Sender,
+		name:    cmd.Definition.Name,
+	}
+	go func() {
+		defer span.End()
+		if c.stopped.Load() {
+			if err := req.SendInteractionResponseMessage("The bot is shutting down, please try again later"); err != nil {
+				c.logger.Error().Err(err).Msgf("Cannot send shutdown response for %s", cmd.Definition.Name)
+			}
+			return
+		}
+		options, err := chat.ParseOptions(cmd.Definition, args[1:])
+		if err != nil {
+			if err := req.SendInteractionResponseMessage(fmt.Sprintf("Invalid command: %v", err)); err != nil {
+				c.logger.Error().Err(err).Msgf("Cannot send response for %s", cmd.Definition.Name)
+			}
+			return
+		}
+		req.options = options
+		if c.authorizer != nil {
+			if err := c.authorizer.Authorize(req.Guild(), req.UserID(), req.Roles(), req.IsGuildAdmin(), cmd.Definition.Name); err != nil {
+				span.SetAttributes(attribute.Bool("matrix.denied", true))
+				c.logger.Info().Msgf("Command %s denied for user %s: %v", cmd.Definition.Name, req.UserID(), err)
+				if err := req.SendInteractionResponseMessage(fmt.Sprintf("Permission denied: %v", err)); err != nil {
+					c.logger.Error().Err(err).Msgf("Cannot send denial response for %s", cmd.Definition.Name)
+				}
+				return
+			}
+		}
+		cmd.Handler(req)
+	}()
+}
+
+func (c *Client) sendEvent(ctx context.Context, roomID string, content map[string]any) error {
+	txnID := fmt.Sprintf("ub-bot-%d-%d", time.Now().UnixNano(), c.txnID.Add(1))
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%s", url.PathEscape(roomID), url.PathEscape(txnID))
+	if err := c.do(ctx, http.MethodPut, path, nil, "", content, nil); err != nil {
+		return errors.Wrapf(err, "cannot send message to room %s", roomID)
+	}
+	return nil
+}
+
+// upload stores a file in the media repository and returns its mxc uri
+func (c *Client) upload(ctx context.Context, file *chat.File) (string, int, error) {
+	data, err := io.ReadAll(file.Reader)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "cannot read file %s", file.Name)
+	}
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	var resp struct {
+		ContentURI string `json:"content_uri"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/_matrix/media/v3/upload", url.Values{"filename": {file.Name}}, contentType, bytes.NewReader(data), &resp); err != nil {
+		return "", 0, errors.Wrapf(err, "cannot upload file %s", file.Name)
+	}
+	return resp.ContentURI, len(data), nil
+}
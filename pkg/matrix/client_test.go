@@ -0,0 +1,400 @@
+package matrix
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testRoom  = "!room:example.org"
+	testBot   = "@bot:example.org"
+	testUser  = "@alice:example.org"
+	testToken = "secret"
+)
+
+// stubServer is a minimal homeserver which records the requests of the client
+type stubServer struct {
+	*httptest.Server
+	t          *testing.T
+	mutex      sync.Mutex
+	syncs      [][]byte
+	syncCalls  int
+	joined     []string
+	sent       chan map[string]any
+	uploads    map[string]string
+	topic      string
+	powerLevel int
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	s := &stubServer{
+		t:       t,
+		sent:    make(chan map[string]any, 10),
+		uploads: map[string]string{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_matrix/client/v3/sync", s.sync)
+	mux.HandleFunc("POST /_matrix/client/v3/join/{room}", func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.joined = append(s.joined, r.PathValue("room"))
+		s.mutex.Unlock()
+		w.Write([]byte(`{}`))
+	})
+	mux.HandleFunc("PUT /_matrix/client/v3/rooms/{room}/send/m.room.message/{txn}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("room") != testRoom {
+			t.Errorf("message sent to room %s", r.PathValue("room"))
+		}
+		content := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+			t.Errorf("cannot decode message: %v", err)
+		}
+		s.sent <- content
+		w.Write([]byte(`{"event_id":"$reply"}`))
+	})
+	mux.HandleFunc("GET /_matrix/client/v3/rooms/{room}/state/m.room.topic", func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		topic := s.topic
+		s.mutex.Unlock()
+		if topic == "" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"no topic"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"topic": topic})
+	})
+	mux.HandleFunc("GET /_matrix/client/v3/rooms/{room}/state/m.room.power_levels", func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		powerLevel := s.powerLevel
+		s.mutex.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"users": map[string]int{testUser: powerLevel}})
+	})
+	mux.HandleFunc("POST /_matrix/media/v3/upload", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		s.mutex.Lock()
+		s.uploads[r.URL.Query().Get("filename")] = string(data)
+		s.mutex.Unlock()
+		w.Write([]byte(`{"content_uri":"mxc://example.org/file"}`))
+	})
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"invalid token"}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// sync returns the scripted responses one after another, then waits for the client to give up
+func (s *stubServer) sync(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	call := s.syncCalls
+	s.syncCalls++
+	s.mutex.Unlock()
+	if call >= len(s.syncs) {
+		<-r.Context().Done()
+		return
+	}
+	if call > 0 && r.URL.Query().Get("since") == "" {
+		s.t.Errorf("sync %d without since", call)
+	}
+	w.Write(s.syncs[call])
+}
+
+func (s *stubServer) nextMessage(t *testing.T) map[string]any {
+	t.Helper()
+	select {
+	case content := <-s.sent:
+		return content
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message sent")
+		return nil
+	}
+}
+
+func testLogger() zLogger.ZLogger {
+	logger := zerolog.Nop()
+	return &logger
+}
+
+func messageEvent(eventID, sender, body string) map[string]any {
+	return map[string]any{
+		"type":     "m.room.message",
+		"event_id": eventID,
+		"sender":   sender,
+		"content":  map[string]any{"msgtype": "m.text", "body": body},
+	}
+}
+
+func syncBody(t *testing.T, nextBatch string, invite bool, events ...map[string]any) []byte {
+	t.Helper()
+	rooms := map[string]any{
+		"join": map[string]any{
+			testRoom: map[string]any{"timeline": map[string]any{"events": events}},
+		},
+	}
+	if invite {
+		rooms["invite"] = map[string]any{"!invite:example.org": map[string]any{}}
+	}
+	data, err := json.Marshal(map[string]any{"next_batch": nextBatch, "rooms": rooms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+var searchDefinition = &chat.CommandDefinition{
+	Name: "search",
+	Options: []*chat.OptionDefinition{
+		{Type: chat.OptionString, Name: "query", Required: true},
+		{Type: chat.OptionString, Name: "querytype"},
+		{Type: chat.OptionBoolean, Name: "magic"},
+	},
+}
+
+func lookup(handler chat.Handler) func(name string) *chat.Command {
+	return func(name string) *chat.Command {
+		if name != searchDefinition.Name {
+			return nil
+		}
+		return &chat.Command{Definition: searchDefinition, Handler: handler}
+	}
+}
+
+func TestSync(t *testing.T) {
+	s := newStubServer(t)
+	s.syncs = [][]byte{
+		// messages of the initial sync were sent before the start and are ignored
+		syncBody(t, "s1", true, messageEvent("$old", testUser, "!search query:old")),
+		syncBody(t, "s2", false,
+			messageEvent("$own", testBot, "!search query:own"),
+			messageEvent("$chat", testUser, "hello"),
+			messageEvent("$unknown", testUser, "!unknown query:x"),
+			messageEvent("$cmd", testUser, `!search querytype:simple query:"Basler Mission" magic:true`),
+		),
+	}
+	requests := make(chan chat.Request, 10)
+	c := NewClient(s.URL+"/", testBot, testToken, lookup(func(req chat.Request) {
+		requests <- req
+	}), testLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+
+	var req chat.Request
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command not received")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+	if len(requests) > 0 {
+		t.Errorf("%d further commands received", len(requests))
+	}
+
+	s.mutex.Lock()
+	joined := s.joined
+	s.mutex.Unlock()
+	if len(joined) != 1 || joined[0] != "!invite:example.org" {
+		t.Errorf("joined %v", joined)
+	}
+	if req.CommandName() != "search" || req.Channel() != testRoom || req.UserID() != testUser || req.UserName() != "alice" || req.Guild() != "" {
+		t.Errorf("unexpected request %s %s %s %s", req.CommandName(), req.Channel(), req.UserID(), req.UserName())
+	}
+	values := map[string]any{}
+	for _, opt := range req.Options() {
+		values[opt.Name] = opt.Value
+	}
+	want := map[string]any{"querytype": "simple", "query": "Basler Mission", "magic": true}
+	if len(values) != len(want) {
+		t.Errorf("options %v, want %v", values, want)
+	}
+	for name, value := range want {
+		if values[name] != value {
+			t.Errorf("option %s is %v, want %v", name, values[name], value)
+		}
+	}
+}
+
+func TestSyncRetry(t *testing.T) {
+	s := newStubServer(t)
+	c := NewClient(s.URL, testBot, "wrong", lookup(nil), testLogger())
+	if err := c.Ready(context.Background()); err == nil || !strings.Contains(err.Error(), "M_UNKNOWN_TOKEN") {
+		t.Errorf("Ready with invalid token returned %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Errorf("Run returned %v after failed syncs", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	s := newStubServer(t)
+	c := NewClient(s.URL, testBot, testToken, lookup(func(req chat.Request) {
+		t.Errorf("handler called for invalid command")
+	}), testLogger())
+
+	c.handleEvent(testRoom, mustEvent(t, messageEvent("$missing", testUser, "!search querytype:simple")))
+	content := s.nextMessage(t)
+	if body := content["body"].(string); !strings.Contains(body, "missing option query") {
+		t.Errorf("unexpected answer %q", body)
+	}
+	if reply := content["m.relates_to"].(map[string]any)["m.in_reply_to"].(map[string]any)["event_id"]; reply != "$missing" {
+		t.Errorf("answer relates to %v", reply)
+	}
+
+	c.handleEvent(testRoom, mustEvent(t, messageEvent("$quote", testUser, `!search query:"unterminated`)))
+	c.StopCommands()
+	c.handleEvent(testRoom, mustEvent(t, messageEvent("$stopped", testUser, "!search query:Basel")))
+	if body := s.nextMessage(t)["body"].(string); !strings.Contains(body, "shutting down") {
+		t.Errorf("unexpected answer %q", body)
+	}
+	select {
+	case content := <-s.sent:
+		t.Errorf("unexpected message %v", content)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type denyAll struct{}
+
+func (denyAll) Authorize(guildID, userID string, roles []string, guildAdmin bool, command string) error {
+	return errors.New("not allowed")
+}
+
+func TestAuthorizer(t *testing.T) {
+	s := newStubServer(t)
+	c := NewClient(s.URL, testBot, testToken, lookup(func(req chat.Request) {
+		t.Errorf("handler called for denied command")
+	}), testLogger())
+	c.SetAuthorizer(denyAll{})
+	c.handleEvent(testRoom, mustEvent(t, messageEvent("$denied", testUser, "!search query:Basel")))
+	if body := s.nextMessage(t)["body"].(string); body != "Permission denied: not allowed" {
+		t.Errorf("unexpected answer %q", body)
+	}
+}
+
+func mustEvent(t *testing.T, evt map[string]any) *event {
+	t.Helper()
+	data, err := json.Marshal(evt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &event{}
+	if err := json.Unmarshal(data, result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func testRequest(c *Client) *Request {
+	return &Request{
+		client:  c,
+		ctx:     context.Background(),
+		roomID:  testRoom,
+		eventID: "$cmd",
+		sender:  testUser,
+		name:    "search",
+	}
+}
+
+func TestSendMessages(t *testing.T) {
+	s := newStubServer(t)
+	c := NewClient(s.URL, testBot, testToken, lookup(nil), testLogger())
+	req := testRequest(c)
+
+	if err := req.SendInteractionResponseMessage("searching"); err != nil {
+		t.Fatal(err)
+	}
+	content := s.nextMessage(t)
+	if content["msgtype"] != "m.notice" || content["body"] != "searching" || content["m.relates_to"] == nil {
+		t.Errorf("unexpected response %v", content)
+	}
+
+	if err := req.SendChannelCards([]*chat.Card{{
+		Title:       "Query <Results>",
+		URL:         "https://example.org/?a=1&b=2",
+		Description: "line 1\nline 2",
+		Fields:      []*chat.CardField{{Name: "Total Hits", Value: "42"}},
+		Buttons:     []*chat.Button{{Label: "Open", URL: "https://example.org/open"}},
+		Footer:      &chat.CardFooter{Text: "footer"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	content = s.nextMessage(t)
+	if content["m.relates_to"] != nil {
+		t.Errorf("channel message relates to the command")
+	}
+	for _, want := range []string{"Query <Results>", "line 1\nline 2", "Total Hits: 42", "Open: https://example.org/open", "footer"} {
+		if !strings.Contains(content["body"].(string), want) {
+			t.Errorf("body %q does not contain %q", content["body"], want)
+		}
+	}
+	for _, want := range []string{`<a href="https://example.org/?a=1&amp;b=2">Query &lt;Results&gt;</a>`, "line 1<br>line 2", "<li><b>Total Hits</b>: 42</li>"} {
+		if !strings.Contains(content["formatted_body"].(string), want) {
+			t.Errorf("formatted body %q does not contain %q", content["formatted_body"], want)
+		}
+	}
+
+	if err := req.SendChannelCardsWithFiles(nil, []*chat.File{{
+		Name:        "trace.txt",
+		ContentType: "text/plain",
+		Reader:      strings.NewReader("trace"),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	content = s.nextMessage(t)
+	if content["msgtype"] != "m.file" || content["url"] != "mxc://example.org/file" || content["filename"] != "trace.txt" {
+		t.Errorf("unexpected file message %v", content)
+	}
+	s.mutex.Lock()
+	upload := s.uploads["trace.txt"]
+	s.mutex.Unlock()
+	if upload != "trace" {
+		t.Errorf("uploaded %q", upload)
+	}
+}
+
+func TestRoomState(t *testing.T) {
+	s := newStubServer(t)
+	c := NewClient(s.URL, testBot, testToken, lookup(nil), testLogger())
+	req := testRequest(c)
+
+	if topic, err := req.ChannelTopic(); err != nil || topic != "" {
+		t.Errorf("room without topic: %q, %v", topic, err)
+	}
+	s.mutex.Lock()
+	s.topic = "language:ger"
+	s.mutex.Unlock()
+	if topic, err := req.ChannelTopic(); err != nil || topic != "language:ger" {
+		t.Errorf("topic %q, %v", topic, err)
+	}
+	if req.IsGuildAdmin() {
+		t.Errorf("user without power level is admin")
+	}
+	s.mutex.Lock()
+	s.powerLevel = adminPowerLevel
+	s.mutex.Unlock()
+	if !req.IsGuildAdmin() {
+		t.Errorf("user with admin power level is not admin")
+	}
+}
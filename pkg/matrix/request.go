@@ -0,0 +1,204 @@
+package matrix
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/je4/ub-bot/v2/pkg/chat"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const adminPowerLevel = 100
+
+type Request struct {
+	client  *Client
+	ctx     context.Context
+	roomID  string
+	eventID string
+	sender  string
+	name    string
+	options []*chat.Option
+}
+
+func (r *Request) Context() context.Context {
+	return r.ctx
+}
+
+func (r *Request) CommandName() string {
+	return r.name
+}
+
+func (r *Request) Options() []*chat.Option {
+	return r.options
+}
+
+// Channel returns the room ID
+func (r *Request) Channel() string {
+	return r.roomID
+}
+
+// Guild returns an empty string, matrix rooms do not belong to a guild
+func (r *Request) Guild() string {
+	return ""
+}
+
+func (r *Request) UserID() string {
+	return r.sender
+}
+
+// UserName returns the localpart of the user ID
+func (r *Request) UserName() string {
+	name, _, _ := strings.Cut(strings.TrimPrefix(r.sender, "@"), ":")
+	return name
+}
+
+// Roles returns nil, matrix has no roles
+func (r *Request) Roles() []string {
+	return nil
+}
+
+// IsGuildAdmin returns true if the sender has the administrator power level in the room
+func (r *Request) IsGuildAdmin() bool {
+	var powerLevels struct {
+		Users map[string]int `json:"users"`
+	}
+	if err := r.client.do(r.ctx, http.MethodGet, r.statePath("m.room.power_levels"), nil, "", nil, &powerLevels); err != nil {
+		r.client.logger.Warn().Msgf("Cannot get power levels of room %s: %v", r.roomID, err)
+		return false
+	}
+	return powerLevels.Users[r.sender] >= adminPowerLevel
+}
+
+func (r *Request) ChannelTopic() (string, error) {
+	var topic struct {
+		Topic string `json:"topic"`
+	}
+	if err := r.client.do(r.ctx, http.MethodGet, r.statePath("m.room.topic"), nil, "", nil, &topic); err != nil {
+		if errors.Is(err, errNotFound) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "cannot get topic of room %s", r.roomID)
+	}
+	return topic.Topic, nil
+}
+
+func (r *Request) statePath(eventType string) string {
+	return fmt.Sprintf("/_matrix/client/v3/rooms/%s/state/%s", url.PathEscape(r.roomID), eventType)
+}
+
+// reply marks the message as answer to the command
+func (r *Request) reply(content map[string]any) map[string]any {
+	content["m.relates_to"] = map[string]any{
+		"m.in_reply_to": map[string]any{"event_id": r.eventID},
+	}
+	return content
+}
+
+func (r *Request) SendInteractionResponseMessage(msg string) error {
+	return r.client.sendEvent(r.ctx, r.roomID, r.reply(textContent(msg)))
+}
+
+func (r *Request) SendInteractionResponseCards(cards []*chat.Card) error {
+	return r.client.sendEvent(r.ctx, r.roomID, r.reply(cardContent(cards)))
+}
+
+func (r *Request) SendChannelMessage(msg string) error {
+	return r.client.sendEvent(r.ctx, r.roomID, textContent(msg))
+}
+
+func (r *Request) SendChannelCards(cards []*chat.Card) error {
+	return r.client.sendEvent(r.ctx, r.roomID, cardContent(cards))
+}
+
+// SendChannelCardsWithFiles sends the cards followed by a file message for each attachment
+func (r *Request) SendChannelCardsWithFiles(cards []*chat.Card, files []*chat.File) error {
+	if len(cards) > 0 {
+		if err := r.SendChannelCards(cards); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		uri, size, err := r.client.upload(r.ctx, file)
+		if err != nil {
+			return err
+		}
+		if err := r.client.sendEvent(r.ctx, r.roomID, map[string]any{
+			"msgtype":  "m.file",
+			"body":     file.Name,
+			"filename": file.Name,
+			"url":      uri,
+			"info": map[string]any{
+				"mimetype": file.ContentType,
+				"size":     size,
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// textContent creates a notice, the markdown of the messages is shown as plain text
+func textContent(msg string) map[string]any {
+	return map[string]any{
+		"msgtype": "m.notice",
+		"body":    msg,
+	}
+}
+
+// cardContent renders the cards as html with a plain text fallback. buttons become links
+func cardContent(cards []*chat.Card) map[string]any {
+	var text, formatted strings.Builder
+	for _, card := range cards {
+		if card.Author != nil && card.Author.Name != "" {
+			fmt.Fprintf(&text, "%s\n", card.Author.Name)
+			fmt.Fprintf(&formatted, "<p><sub>%s</sub></p>", html.EscapeString(card.Author.Name))
+		}
+		if card.Title != "" {
+			fmt.Fprintf(&text, "%s\n", card.Title)
+			if card.URL != "" {
+				fmt.Fprintf(&formatted, "<h4><a href=\"%s\">%s</a></h4>", html.EscapeString(card.URL), html.EscapeString(card.Title))
+			} else {
+				fmt.Fprintf(&formatted, "<h4>%s</h4>", html.EscapeString(card.Title))
+			}
+		}
+		if card.Description != "" {
+			fmt.Fprintf(&text, "%s\n", card.Description)
+			fmt.Fprintf(&formatted, "<p>%s</p>", htmlLines(card.Description))
+		}
+		if len(card.Fields) > 0 {
+			formatted.WriteString("<ul>")
+			for _, field := range card.Fields {
+				fmt.Fprintf(&text, "%s: %s\n", field.Name, field.Value)
+				fmt.Fprintf(&formatted, "<li><b>%s</b>: %s</li>", html.EscapeString(field.Name), htmlLines(field.Value))
+			}
+			formatted.WriteString("</ul>")
+		}
+		if len(card.Buttons) > 0 {
+			links := []string{}
+			for _, button := range card.Buttons {
+				fmt.Fprintf(&text, "%s: %s\n", button.Label, button.URL)
+				links = append(links, fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(button.URL), html.EscapeString(button.Label)))
+			}
+			fmt.Fprintf(&formatted, "<p>%s</p>", strings.Join(links, " | "))
+		}
+		if card.Footer != nil && card.Footer.Text != "" {
+			fmt.Fprintf(&text, "%s\n", card.Footer.Text)
+			fmt.Fprintf(&formatted, "<p><sub>%s</sub></p>", htmlLines(card.Footer.Text))
+		}
+		text.WriteString("\n")
+	}
+	return map[string]any{
+		"msgtype":        "m.notice",
+		"body":           strings.TrimSpace(text.String()),
+		"format":         "org.matrix.custom.html",
+		"formatted_body": formatted.String(),
+	}
+}
+
+func htmlLines(text string) string {
+	return strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "ubbot"
+
+// NewMetrics creates the bot metrics in a dedicated registry
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "commands_total",
+			Help:      "Number of command invocations",
+		}, []string{"command", "searchtype", "status"}),
+		commandLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "command_duration_seconds",
+			Help:      "Duration of command invocations",
+			Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"command", "searchtype"}),
+		openaiLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "openai_request_duration_seconds",
+			Help:      "Duration of OpenAI calls",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"operation"}),
+		openaiRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "openai_requests_total",
+			Help:      "Number of OpenAI calls",
+		}, []string{"operation", "status"}),
+		embeddingCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "embedding_cache_requests_total",
+			Help:      "Number of embedding cache lookups",
+		}, []string{"result"}),
+		elasticLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "elastic_query_duration_seconds",
+			Help:      "Duration of Elasticsearch queries",
+			Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"operation", "status"}),
+		elasticHits: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "elastic_query_hits",
+			Help:      "Total hits of Elasticsearch queries",
+			Buckets:   []float64{0, 1, 10, 100, 1000, 10000, 100000, 1000000},
+		}, []string{"operation"}),
+		discordReconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "discord_reconnects_total",
+			Help:      "Number of Discord gateway reconnects",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.commands,
+		m.commandLatency,
+		m.openaiLatency,
+		m.openaiRequests,
+		m.embeddingCache,
+		m.elasticLatency,
+		m.elasticHits,
+		m.discordReconnects,
+	)
+	return m
+}
+
+// Metrics collects the bot metrics. All methods may be called on a nil receiver
+type Metrics struct {
+	registry          *prometheus.Registry
+	commands          *prometheus.CounterVec
+	commandLatency    *prometheus.HistogramVec
+	openaiLatency     *prometheus.HistogramVec
+	openaiRequests    *prometheus.CounterVec
+	embeddingCache    *prometheus.CounterVec
+	elasticLatency    *prometheus.HistogramVec
+	elasticHits       *prometheus.HistogramVec
+	discordReconnects prometheus.Counter
+}
+
+func status(failed bool) string {
+	if failed {
+		return "error"
+	}
+	return "ok"
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+func (m *Metrics) ObserveCommand(command, searchType string, failed bool, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.commands.WithLabelValues(command, searchType, status(failed)).Inc()
+	m.commandLatency.WithLabelValues(command, searchType).Observe(latency.Seconds())
+}
+
+func (m *Metrics) ObserveOpenAI(operation string, err error, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.openaiRequests.WithLabelValues(operation, status(err != nil)).Inc()
+	m.openaiLatency.WithLabelValues(operation).Observe(latency.Seconds())
+}
+
+func (m *Metrics) EmbeddingCache(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.embeddingCache.WithLabelValues("hit").Inc()
+	} else {
+		m.embeddingCache.WithLabelValues("miss").Inc()
+	}
+}
+
+func (m *Metrics) ObserveElastic(operation string, err error, total int64, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.elasticLatency.WithLabelValues(operation, status(err != nil)).Observe(latency.Seconds())
+	if err == nil {
+		m.elasticHits.WithLabelValues(operation).Observe(float64(total))
+	}
+}
+
+func (m *Metrics) ActiveChannels(f func() float64) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_channel_states",
+		Help:      "Number of channels with search state",
+	}, f))
+}
+
+func (m *Metrics) DiscordReconnect() {
+	if m == nil {
+		return
+	}
+	m.discordReconnects.Inc()
+}
@@ -0,0 +1,249 @@
+package permission
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AllCommands allows every command which is not admin-only
+const AllCommands = "*"
+
+// DefaultAdminCommands are restricted to administrators if the config does not list admin commands
+var DefaultAdminCommands = []string{"cache", "reload", "rawquery"}
+
+type Role struct {
+	// Commands lists the allowed commands without prefix, "*" for all
+	Commands []string `json:"commands"`
+	// MaxResults limits the result size of searches, 0 for no limit
+	MaxResults int64 `json:"maxResults,omitempty"`
+	// Quota is the name of the quota class, empty for no quota
+	Quota string `json:"quota,omitempty"`
+	// Admin allows the admin-only commands
+	Admin bool `json:"admin,omitempty"`
+}
+
+// Guild configures the roles of a guild. roles are referenced by ID or name
+type Guild struct {
+	// Default applies to all members
+	Default Role            `json:"default"`
+	Roles   map[string]Role `json:"roles"`
+}
+
+type Quota struct {
+	PerHour int `json:"perHour"`
+}
+
+type Config struct {
+	AdminCommands []string         `json:"adminCommands,omitempty"`
+	Quotas        map[string]Quota `json:"quotas,omitempty"`
+	Guilds        map[string]Guild `json:"guilds"`
+}
+
+type Effective struct {
+	Commands   []string
+	MaxResults int64
+	Quota      string
+	PerHour    int
+	Admin      bool
+}
+
+func (e *Effective) allows(command string) bool {
+	return slices.Contains(e.Commands, AllCommands) || slices.Contains(e.Commands, command)
+}
+
+// Denied is returned if a member may not run a command. the message is shown to the user
+type Denied struct {
+	Message string
+}
+
+func (d *Denied) Error() string {
+	return d.Message
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read permission config %s", path)
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal permission config %s", path)
+	}
+	for name, guild := range cfg.Guilds {
+		for _, role := range append([]Role{guild.Default}, mapValues(guild.Roles)...) {
+			if _, ok := cfg.Quotas[role.Quota]; role.Quota != "" && !ok {
+				return nil, errors.Errorf("guild %s: unknown quota class %s", name, role.Quota)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+func mapValues(m map[string]Role) []Role {
+	result := []Role{}
+	for _, v := range m {
+		result = append(result, v)
+	}
+	return result
+}
+
+// NewPermissions creates the permission checker. command names are given without prefix.
+// path may be empty, then all commands except the admin commands are allowed
+func NewPermissions(path string, prefix string) (*Permissions, error) {
+	p := &Permissions{
+		path:   path,
+		prefix: prefix,
+		usage:  map[string][]time.Time{},
+	}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type Permissions struct {
+	sync.Mutex
+	path   string
+	prefix string
+	config *Config
+	// usage holds the command times of the last hour per user
+	usage     map[string][]time.Time
+	lastPrune time.Time
+}
+
+func (p *Permissions) Reload() error {
+	cfg := &Config{}
+	if p.path != "" {
+		var err error
+		if cfg, err = LoadConfig(p.path); err != nil {
+			return err
+		}
+	}
+	if len(cfg.AdminCommands) == 0 {
+		cfg.AdminCommands = DefaultAdminCommands
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.config = cfg
+	return nil
+}
+
+// IsAdminCommand returns true if the (prefixed) command is admin-only
+func (p *Permissions) IsAdminCommand(command string) bool {
+	p.Lock()
+	defer p.Unlock()
+	return slices.Contains(p.config.AdminCommands, strings.TrimPrefix(command, p.prefix))
+}
+
+// Effective combines the permissions of the roles. guilds without config allow everything except admin commands.
+// guildAdmin is true for members with the Discord administrator permission
+func (p *Permissions) Effective(guildID string, roles []string, guildAdmin bool) *Effective {
+	p.Lock()
+	defer p.Unlock()
+	return p.effective(guildID, roles, guildAdmin)
+}
+
+func (p *Permissions) effective(guildID string, roles []string, guildAdmin bool) *Effective {
+	guild, ok := p.config.Guilds[guildID]
+	if !ok {
+		return &Effective{
+			Commands: []string{AllCommands},
+			Admin:    guildAdmin,
+		}
+	}
+	// the most permissive setting of all roles wins
+	eff := &Effective{Admin: guildAdmin}
+	add := func(role Role, first bool) {
+		eff.Commands = append(eff.Commands, role.Commands...)
+		eff.Admin = eff.Admin || role.Admin
+		if first || (eff.MaxResults != 0 && (role.MaxResults == 0 || role.MaxResults > eff.MaxResults)) {
+			eff.MaxResults = role.MaxResults
+		}
+		perHour := 0
+		if role.Quota != "" {
+			perHour = p.config.Quotas[role.Quota].PerHour
+		}
+		if first || (eff.PerHour != 0 && (perHour == 0 || perHour > eff.PerHour)) {
+			eff.Quota = role.Quota
+			eff.PerHour = perHour
+		}
+	}
+	add(guild.Default, true)
+	for _, r := range roles {
+		if role, ok := guild.Roles[r]; ok {
+			add(role, false)
+		}
+	}
+	return eff
+}
+
+// Allowed returns true if the member may run the (prefixed) command. quotas are not checked
+func (p *Permissions) Allowed(guildID string, roles []string, guildAdmin bool, command string) bool {
+	p.Lock()
+	defer p.Unlock()
+	name := strings.TrimPrefix(command, p.prefix)
+	eff := p.effective(guildID, roles, guildAdmin)
+	if slices.Contains(p.config.AdminCommands, name) || eff.Admin {
+		return eff.Admin
+	}
+	return eff.allows(name)
+}
+
+// Authorize checks whether the member may run the (prefixed) command and counts it against the quota.
+// the returned error is a *Denied if the command is not allowed
+func (p *Permissions) Authorize(guildID, userID string, roles []string, guildAdmin bool, command string) error {
+	p.Lock()
+	defer p.Unlock()
+	name := strings.TrimPrefix(command, p.prefix)
+	eff := p.effective(guildID, roles, guildAdmin)
+	if slices.Contains(p.config.AdminCommands, name) {
+		if !eff.Admin {
+			return &Denied{Message: fmt.Sprintf("/%s is restricted to administrators", command)}
+		}
+		return nil
+	}
+	if eff.Admin {
+		return nil
+	}
+	if !eff.allows(name) {
+		return &Denied{Message: fmt.Sprintf("You are not allowed to use /%s", command)}
+	}
+	if eff.PerHour > 0 {
+		now := time.Now()
+		p.prune(now)
+		usage := slices.DeleteFunc(p.usage[userID], func(t time.Time) bool {
+			return now.Sub(t) >= time.Hour
+		})
+		if len(usage) >= eff.PerHour {
+			p.usage[userID] = usage
+			return &Denied{Message: fmt.Sprintf("Quota \"%s\" of %d commands per hour exceeded, try again in %v", eff.Quota, eff.PerHour, usage[0].Add(time.Hour).Sub(now).Round(time.Minute))}
+		}
+		p.usage[userID] = append(usage, now)
+	}
+	return nil
+}
+
+// prune removes the users without commands in the last hour, at most once a minute.
+// the lock must be held by the caller
+func (p *Permissions) prune(now time.Time) {
+	if now.Sub(p.lastPrune) < time.Minute {
+		return
+	}
+	p.lastPrune = now
+	for userID, usage := range p.usage {
+		usage = slices.DeleteFunc(usage, func(t time.Time) bool {
+			return now.Sub(t) >= time.Hour
+		})
+		if len(usage) == 0 {
+			delete(p.usage, userID)
+			continue
+		}
+		p.usage[userID] = usage
+	}
+}
@@ -0,0 +1,177 @@
+package permission
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfig = `{
+  "quotas": {
+    "small": {"perHour": 2},
+    "large": {"perHour": 10}
+  },
+  "guilds": {
+    "guild": {
+      "default": {"commands": ["search", "help"], "maxResults": 5, "quota": "small"},
+      "roles": {
+        "staff": {"commands": ["similar"], "maxResults": 20, "quota": "large"},
+        "unlimited": {"commands": ["*"]},
+        "admins": {"admin": true}
+      }
+    },
+    "closed": {
+      "default": {"commands": []}
+    }
+  }
+}`
+
+func newTestPermissions(t *testing.T, config string) *Permissions {
+	t.Helper()
+	path := ""
+	if config != "" {
+		path = filepath.Join(t.TempDir(), "permissions.json")
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, err := NewPermissions(path, "ub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestEffective(t *testing.T) {
+	p := newTestPermissions(t, testConfig)
+	for _, test := range []struct {
+		name       string
+		guild      string
+		roles      []string
+		guildAdmin bool
+		maxResults int64
+		quota      string
+		perHour    int
+		admin      bool
+	}{
+		{"default", "guild", nil, false, 5, "small", 2, false},
+		{"unknown role", "guild", []string{"visitor"}, false, 5, "small", 2, false},
+		{"larger limits win", "guild", []string{"staff"}, false, 20, "large", 10, false},
+		{"no limit wins", "guild", []string{"staff", "unlimited"}, false, 0, "", 0, false},
+		{"admin role", "guild", []string{"admins"}, false, 0, "", 0, true},
+		{"guild admin", "guild", nil, true, 5, "small", 2, true},
+		{"unconfigured guild", "other", nil, false, 0, "", 0, false},
+	} {
+		eff := p.Effective(test.guild, test.roles, test.guildAdmin)
+		if eff.MaxResults != test.maxResults || eff.Quota != test.quota || eff.PerHour != test.perHour || eff.Admin != test.admin {
+			t.Errorf("%s: got %+v", test.name, eff)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	p := newTestPermissions(t, testConfig)
+	for _, test := range []struct {
+		name       string
+		guild      string
+		roles      []string
+		guildAdmin bool
+		command    string
+		allowed    bool
+	}{
+		{"default command", "guild", nil, false, "ubsearch", true},
+		{"command not in default", "guild", nil, false, "ubsimilar", false},
+		{"command of role", "guild", []string{"staff"}, false, "ubsimilar", true},
+		{"all commands", "guild", []string{"unlimited"}, false, "ubresearch", true},
+		{"admin command for all commands", "guild", []string{"unlimited"}, false, "ubreload", false},
+		{"admin command for admin role", "guild", []string{"admins"}, false, "ubreload", true},
+		{"admin command for guild admin", "guild", nil, true, "ubcache", true},
+		{"admin role allows everything", "guild", []string{"admins"}, false, "ubresearch", true},
+		{"default deny", "closed", nil, false, "ubsearch", false},
+		{"unconfigured guild", "other", nil, false, "ubresearch", true},
+		{"admin command in unconfigured guild", "other", nil, false, "ubrawquery", false},
+		{"admin in unconfigured guild", "other", nil, true, "ubrawquery", true},
+	} {
+		// every case has its own user, the quota is tested separately
+		err := p.Authorize(test.guild, test.name, test.roles, test.guildAdmin, test.command)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: got %v, allowed %v", test.name, err, test.allowed)
+		}
+		var denied *Denied
+		if err != nil && !errors.As(err, &denied) {
+			t.Errorf("%s: %v is not Denied", test.name, err)
+		}
+		if allowed := p.Allowed(test.guild, test.roles, test.guildAdmin, test.command); allowed != test.allowed {
+			t.Errorf("%s: Allowed returned %v", test.name, allowed)
+		}
+	}
+}
+
+func TestPermissiveWithoutConfig(t *testing.T) {
+	p := newTestPermissions(t, "")
+	if err := p.Authorize("guild", "user", nil, false, "ubresearch"); err != nil {
+		t.Errorf("command denied without config: %v", err)
+	}
+	for _, command := range DefaultAdminCommands {
+		if err := p.Authorize("guild", "user", nil, false, "ub"+command); err == nil {
+			t.Errorf("admin command %s allowed without config", command)
+		}
+		if !p.IsAdminCommand("ub" + command) {
+			t.Errorf("%s is no admin command", command)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	p := newTestPermissions(t, testConfig)
+	for n := 0; n < 2; n++ {
+		if err := p.Authorize("guild", "user", nil, false, "ubsearch"); err != nil {
+			t.Fatalf("command %d denied: %v", n, err)
+		}
+	}
+	err := p.Authorize("guild", "user", nil, false, "ubsearch")
+	if err == nil {
+		t.Fatal("quota not exhausted")
+	}
+	// Allowed does not count or check the quota
+	if !p.Allowed("guild", nil, false, "ubsearch") {
+		t.Errorf("Allowed checks the quota")
+	}
+	// the quota is per user, a role with a larger quota has room
+	if err := p.Authorize("guild", "other", nil, false, "ubsearch"); err != nil {
+		t.Errorf("quota of other user exhausted: %v", err)
+	}
+	if err := p.Authorize("guild", "user", []string{"staff"}, false, "ubsearch"); err != nil {
+		t.Errorf("larger quota of role exhausted: %v", err)
+	}
+	// admins have no quota
+	for n := 0; n < 5; n++ {
+		if err := p.Authorize("guild", "admin", nil, true, "ubsearch"); err != nil {
+			t.Fatalf("admin denied: %v", err)
+		}
+	}
+
+	// an hour later the quota is available again and the usage of inactive users is pruned
+	p.Lock()
+	for userID, usage := range p.usage {
+		for n := range usage {
+			usage[n] = usage[n].Add(-time.Hour)
+		}
+		p.usage[userID] = usage
+	}
+	p.lastPrune = time.Time{}
+	p.Unlock()
+	if err := p.Authorize("guild", "user", nil, false, "ubsearch"); err != nil {
+		t.Errorf("quota not reset after an hour: %v", err)
+	}
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.usage["other"]; ok {
+		t.Errorf("usage of inactive user not pruned")
+	}
+	if len(p.usage["user"]) != 1 {
+		t.Errorf("%d commands counted after reset, want 1", len(p.usage["user"]))
+	}
+}
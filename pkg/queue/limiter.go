@@ -0,0 +1,41 @@
+package queue
+
+import (
+	"context"
+	"emperror.dev/errors"
+)
+
+// NewLimiter creates a limiter which allows max concurrent operations.
+// max < 1 means unlimited
+func NewLimiter(max int) *Limiter {
+	if max < 1 {
+		return nil
+	}
+	return &Limiter{
+		slots: make(chan struct{}, max),
+	}
+}
+
+// Limiter limits the number of concurrent calls to a backend. a nil limiter is unlimited
+type Limiter struct {
+	slots chan struct{}
+}
+
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "cannot acquire slot")
+	}
+}
+
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
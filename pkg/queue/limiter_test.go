@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(2)
+	for n := 0; n < 2; n++ {
+		if err := l.Acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("third acquire returned %v, want deadline exceeded", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		if err := l.Acquire(context.Background()); err != nil {
+			t.Error(err)
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired without free slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.Release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("release does not free a slot")
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := NewLimiter(0)
+	if l != nil {
+		t.Fatal("limiter for 0 is not unlimited")
+	}
+	for n := 0; n < 100; n++ {
+		if err := l.Acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Release()
+}
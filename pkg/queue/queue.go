@@ -0,0 +1,171 @@
+package queue
+
+import (
+	"emperror.dev/errors"
+	"sync"
+)
+
+var ErrQueueFull = errors.New("queue full")
+
+type job struct {
+	run  func()
+	drop func()
+}
+
+// NewQueue creates a queue with a fixed number of workers shared by all channels.
+// the jobs of a channel are executed one after another in submission order,
+// at most maxPending jobs of a channel may wait
+func NewQueue(workers, maxPending int) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &Queue{
+		maxPending: maxPending,
+		pending:    map[string][]*job{},
+		active:     map[string]bool{},
+		running:    map[string]bool{},
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+type Queue struct {
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	maxPending int
+	// pending holds the waiting jobs per channel
+	pending map[string][]*job
+	// active channels are either ready or running
+	active  map[string]bool
+	running map[string]bool
+	ready   []string
+	idle    int
+	closed  bool
+}
+
+// Submit adds a job to the queue of the channel.
+// position is the number of jobs which have to start before this one, 0 if it starts immediately.
+// drop is called instead of run if the job is removed by Drop
+func (q *Queue) Submit(channelID string, run func(), drop func()) (position int, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return 0, errors.New("queue closed")
+	}
+	if q.maxPending > 0 && len(q.pending[channelID]) >= q.maxPending {
+		return 0, ErrQueueFull
+	}
+	position = len(q.pending[channelID])
+	if q.running[channelID] {
+		position++
+	}
+	if position == 0 && !q.active[channelID] && q.idle <= len(q.ready) {
+		// no free worker, wait for the channels ahead
+		position = len(q.ready) - q.idle + 1
+	}
+	q.pending[channelID] = append(q.pending[channelID], &job{run: run, drop: drop})
+	if !q.active[channelID] {
+		q.active[channelID] = true
+		q.ready = append(q.ready, channelID)
+		q.cond.Signal()
+	}
+	return position, nil
+}
+
+// Drop removes all waiting jobs of the channel and returns their number. running jobs are not affected
+func (q *Queue) Drop(channelID string) int {
+	q.mutex.Lock()
+	jobs := q.pending[channelID]
+	delete(q.pending, channelID)
+	q.mutex.Unlock()
+	for _, j := range jobs {
+		if j.drop != nil {
+			j.drop()
+		}
+	}
+	return len(jobs)
+}
+
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	num := 0
+	for _, jobs := range q.pending {
+		num += len(jobs)
+	}
+	return num
+}
+
+// Close stops the workers after their current job. waiting jobs are not executed, their drop is called
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	q.closed = true
+	pending := q.pending
+	q.pending = map[string][]*job{}
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+	for _, jobs := range pending {
+		for _, j := range jobs {
+			if j.drop != nil {
+				j.drop()
+			}
+		}
+	}
+}
+
+func (q *Queue) next() (string, *job, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for {
+		for len(q.ready) == 0 && !q.closed {
+			q.idle++
+			q.cond.Wait()
+			q.idle--
+		}
+		if q.closed {
+			return "", nil, false
+		}
+		channelID := q.ready[0]
+		q.ready = q.ready[1:]
+		jobs := q.pending[channelID]
+		if len(jobs) == 0 {
+			// all jobs dropped while waiting for a worker
+			delete(q.active, channelID)
+			continue
+		}
+		q.pending[channelID] = jobs[1:]
+		if len(q.pending[channelID]) == 0 {
+			delete(q.pending, channelID)
+		}
+		q.running[channelID] = true
+		return channelID, jobs[0], true
+	}
+}
+
+func (q *Queue) done(channelID string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.running, channelID)
+	if len(q.pending[channelID]) > 0 {
+		q.ready = append(q.ready, channelID)
+		q.cond.Signal()
+		return
+	}
+	delete(q.active, channelID)
+}
+
+func (q *Queue) worker() {
+	for {
+		channelID, j, ok := q.next()
+		if !ok {
+			return
+		}
+		func() {
+			defer q.done(channelID)
+			j.run()
+		}()
+	}
+}
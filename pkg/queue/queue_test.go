@@ -0,0 +1,215 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitIdle waits until num workers wait for jobs, so that positions are deterministic
+func waitIdle(t *testing.T, q *Queue, num int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q.mutex.Lock()
+		idle := q.idle
+		q.mutex.Unlock()
+		if idle == num {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d idle workers, want %d", idle, num)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func blockingJob() (run func(), started chan struct{}, release chan struct{}) {
+	started = make(chan struct{})
+	release = make(chan struct{})
+	return func() {
+		close(started)
+		<-release
+	}, started, release
+}
+
+func wait(t *testing.T, ch chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s timed out", what)
+	}
+}
+
+func TestSubmitPosition(t *testing.T) {
+	q := NewQueue(1, 0)
+	defer q.Close()
+	waitIdle(t, q, 1)
+
+	run, started, release := blockingJob()
+	var mutex sync.Mutex
+	order := []string{}
+	var wg sync.WaitGroup
+	record := func(name string) func() {
+		wg.Add(1)
+		return func() {
+			defer wg.Done()
+			mutex.Lock()
+			order = append(order, name)
+			mutex.Unlock()
+		}
+	}
+	submit := func(channelID string, run func(), want int) {
+		t.Helper()
+		position, err := q.Submit(channelID, run, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if position != want {
+			t.Errorf("job on %s: position %d, want %d", channelID, position, want)
+		}
+	}
+
+	submit("a", run, 0)
+	wait(t, started, "first job")
+	submit("a", record("a2"), 1)
+	submit("a", record("a3"), 2)
+	// the only worker is busy
+	submit("b", record("b1"), 1)
+	close(release)
+	wg.Wait()
+
+	// b waited for the worker before the next job of a
+	if fmt.Sprint(order) != "[b1 a2 a3]" {
+		t.Errorf("unexpected order %v", order)
+	}
+}
+
+func TestChannelFIFO(t *testing.T) {
+	q := NewQueue(4, 0)
+	defer q.Close()
+	const channels = 3
+	const jobs = 50
+	var mutex sync.Mutex
+	order := map[string][]int{}
+	running := map[string]bool{}
+	var wg sync.WaitGroup
+	for n := 0; n < jobs; n++ {
+		for c := 0; c < channels; c++ {
+			channelID := fmt.Sprintf("channel-%d", c)
+			wg.Add(1)
+			if _, err := q.Submit(channelID, func() {
+				defer wg.Done()
+				mutex.Lock()
+				if running[channelID] {
+					t.Errorf("two jobs of %s run at the same time", channelID)
+				}
+				running[channelID] = true
+				order[channelID] = append(order[channelID], n)
+				mutex.Unlock()
+				time.Sleep(100 * time.Microsecond)
+				mutex.Lock()
+				running[channelID] = false
+				mutex.Unlock()
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wg.Wait()
+	for channelID, nums := range order {
+		if len(nums) != jobs {
+			t.Errorf("%s: %d jobs run, want %d", channelID, len(nums), jobs)
+		}
+		for pos, n := range nums {
+			if pos != n {
+				t.Fatalf("%s: job %d run at position %d", channelID, n, pos)
+			}
+		}
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	q := NewQueue(1, 1)
+	defer q.Close()
+	run, started, release := blockingJob()
+	defer close(release)
+	if _, err := q.Submit("a", run, nil); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, started, "first job")
+	if _, err := q.Submit("a", func() {}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Submit("a", func() {}, nil); err != ErrQueueFull {
+		t.Errorf("got %v, want ErrQueueFull", err)
+	}
+	if _, err := q.Submit("b", func() {}, nil); err != nil {
+		t.Errorf("other channel is full: %v", err)
+	}
+}
+
+func TestDrop(t *testing.T) {
+	q := NewQueue(1, 0)
+	defer q.Close()
+	run, started, release := blockingJob()
+	if _, err := q.Submit("a", run, nil); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, started, "first job")
+	dropped := 0
+	for n := 0; n < 3; n++ {
+		if _, err := q.Submit("a", func() {
+			t.Errorf("dropped job run")
+		}, func() {
+			dropped++
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if num := q.Drop("a"); num != 3 || dropped != 3 {
+		t.Errorf("dropped %d jobs, %d drop calls, want 3", num, dropped)
+	}
+	if q.Len() != 0 {
+		t.Errorf("%d jobs waiting after drop", q.Len())
+	}
+	close(release)
+
+	// the channel accepts jobs again
+	done := make(chan struct{})
+	if _, err := q.Submit("a", func() { close(done) }, nil); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, done, "job after drop")
+}
+
+func TestClose(t *testing.T) {
+	q := NewQueue(1, 0)
+	run, started, release := blockingJob()
+	finished := make(chan struct{})
+	if _, err := q.Submit("a", func() {
+		run()
+		close(finished)
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, started, "first job")
+	dropped := make(chan struct{})
+	if _, err := q.Submit("b", func() {
+		t.Errorf("waiting job run after close")
+	}, func() {
+		close(dropped)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	wait(t, dropped, "drop of waiting job")
+	if _, err := q.Submit("c", func() {}, nil); err == nil {
+		t.Errorf("closed queue accepts jobs")
+	}
+	// the running job is not interrupted
+	close(release)
+	wait(t, finished, "running job")
+}
@@ -0,0 +1,183 @@
+package templates
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Extension is the file extension of the templates, the file name without extension is the template name
+const Extension = ".gotmpl"
+
+// reloadDelay collects the file events of an editor save into one reload
+const reloadDelay = 500 * time.Millisecond
+
+type Template struct {
+	Name string
+	// Version is a hash of the template source
+	Version string
+	tmpl    *template.Template
+}
+
+func (t *Template) Execute(data any) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := t.tmpl.Execute(buf, data); err != nil {
+		return "", errors.Wrapf(err, "cannot execute template %s", t.Name)
+	}
+	return buf.String(), nil
+}
+
+// ID identifies the template version, e.g. prose@1a2b3c4d5e6f
+func (t *Template) ID() string {
+	return t.Name + "@" + t.Version
+}
+
+var funcs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// NewRegistry loads all templates from fsys. defaultName is the template used if no name is given, it must exist
+func NewRegistry(fsys fs.FS, defaultName string, logger zLogger.ZLogger) (*Registry, error) {
+	r := &Registry{
+		fsys:        fsys,
+		defaultName: defaultName,
+		logger:      logger,
+	}
+	if err := r.Load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type Registry struct {
+	sync.RWMutex
+	fsys        fs.FS
+	defaultName string
+	templates   map[string]*Template
+	logger      zLogger.ZLogger
+}
+
+// Load parses all templates. if a template is invalid, the loaded templates are kept
+func (r *Registry) Load() error {
+	entries, err := fs.ReadDir(r.fsys, ".")
+	if err != nil {
+		return errors.Wrap(err, "cannot read template directory")
+	}
+	templates := map[string]*Template{}
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != Extension {
+			continue
+		}
+		src, err := fs.ReadFile(r.fsys, entry.Name())
+		if err != nil {
+			return errors.Wrapf(err, "cannot read template %s", entry.Name())
+		}
+		name := strings.TrimSuffix(entry.Name(), Extension)
+		tmpl, err := template.New(entry.Name()).Funcs(funcs).Parse(string(src))
+		if err != nil {
+			return errors.Wrapf(err, "cannot parse template %s", entry.Name())
+		}
+		templates[name] = &Template{
+			Name:    name,
+			Version: fmt.Sprintf("%x", sha256.Sum256(src))[:12],
+			tmpl:    tmpl,
+		}
+	}
+	if _, ok := templates[r.defaultName]; !ok {
+		return errors.Errorf("default template %s%s missing", r.defaultName, Extension)
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.templates = templates
+	return nil
+}
+
+// Get returns the template with the given name. an empty name returns the default template
+func (r *Registry) Get(name string) (*Template, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+	r.RLock()
+	defer r.RUnlock()
+	tmpl, ok := r.templates[name]
+	if !ok {
+		return nil, errors.Errorf("unknown template %s", name)
+	}
+	return tmpl, nil
+}
+
+func (r *Registry) Names() []string {
+	r.RLock()
+	defer r.RUnlock()
+	names := []string{}
+	for name := range r.templates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (r *Registry) Versions() []string {
+	r.RLock()
+	defer r.RUnlock()
+	versions := []string{}
+	for _, tmpl := range r.templates {
+		versions = append(versions, tmpl.ID())
+	}
+	slices.Sort(versions)
+	return versions
+}
+
+// Watch reloads the templates if a file in dir changes, until ctx is cancelled.
+// the registry must have been created from os.DirFS(dir)
+func (r *Registry) Watch(ctx context.Context, dir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "cannot create file watcher")
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return errors.Wrapf(err, "cannot watch %s", dir)
+	}
+	go func() {
+		defer watcher.Close()
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if path.Ext(event.Name) == Extension {
+					reload = time.After(reloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				r.logger.Error().Msgf("Template watcher error: %v", err)
+			case <-reload:
+				reload = nil
+				if err := r.Load(); err != nil {
+					r.logger.Error().Msgf("Cannot reload templates, keeping previous versions: %v", err)
+					continue
+				}
+				r.logger.Info().Msgf("Templates reloaded: %s", strings.Join(r.Versions(), ", "))
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"os"
+)
+
+const instrumentationName = "github.com/je4/ub-bot/v2"
+
+// Init installs a global tracer provider which exports spans to stdout or to a file.
+// the returned function flushes and stops the exporter
+func Init(target string, serviceName string) (func(context.Context) error, error) {
+	var out io.Writer
+	var closer io.Closer
+	switch target {
+	case "stdout":
+		out = os.Stdout
+	default:
+		fp, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot open trace file %s", target)
+		}
+		out = fp
+		closer = fp
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(out))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create trace exporter")
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			err = errors.Combine(err, closer.Close())
+		}
+		return errors.Wrap(err, "cannot shutdown tracer provider")
+	}, nil
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func TraceID(ctx context.Context) string {
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if !spanCtx.HasTraceID() {
+		return ""
+	}
+	return spanCtx.TraceID().String()
+}
+
+// ErrorSuffix returns a trace reference to append to user facing error messages
+func ErrorSuffix(ctx context.Context) string {
+	traceID := TraceID(ctx)
+	if traceID == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (trace %s)", traceID)
+}
+
+// Logger returns a logger which adds trace and span id of ctx to every log line
+func Logger(ctx context.Context, logger zLogger.ZLogger) zLogger.ZLogger {
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if !spanCtx.IsValid() {
+		return logger
+	}
+	return &traceLogger{
+		ZLogger: logger,
+		traceID: spanCtx.TraceID().String(),
+		spanID:  spanCtx.SpanID().String(),
+	}
+}
+
+type traceLogger struct {
+	zLogger.ZLogger
+	traceID string
+	spanID  string
+}
+
+func (l *traceLogger) with(e *zerolog.Event) *zerolog.Event {
+	return e.Str("trace_id", l.traceID).Str("span_id", l.spanID)
+}
+
+func (l *traceLogger) Trace() *zerolog.Event { return l.with(l.ZLogger.Trace()) }
+func (l *traceLogger) Debug() *zerolog.Event { return l.with(l.ZLogger.Debug()) }
+func (l *traceLogger) Info() *zerolog.Event  { return l.with(l.ZLogger.Info()) }
+func (l *traceLogger) Warn() *zerolog.Event  { return l.with(l.ZLogger.Warn()) }
+func (l *traceLogger) Error() *zerolog.Event { return l.with(l.ZLogger.Error()) }
+func (l *traceLogger) Err(err error) *zerolog.Event {
+	return l.with(l.ZLogger.Err(err))
+}
+func (l *traceLogger) Fatal() *zerolog.Event { return l.with(l.ZLogger.Fatal()) }
+func (l *traceLogger) Panic() *zerolog.Event { return l.with(l.ZLogger.Panic()) }
+
+var _ zLogger.ZLogger = (*traceLogger)(nil)